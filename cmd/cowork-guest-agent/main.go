@@ -0,0 +1,85 @@
+// Command cowork-guest-agent is the reference guest agent for the VM
+// backend. It runs inside the VM, connects to the host over vsock and
+// serves the sdk-daemon protocol (see package guestagent).
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/patrickjaja/claude-cowork-service/guestagent"
+	"github.com/patrickjaja/claude-cowork-service/native"
+	"github.com/patrickjaja/claude-cowork-service/vm"
+)
+
+var version = "dev"
+
+// reconnectDelay is how long to wait before reconnecting to the host.
+const reconnectDelay = time.Second
+
+func main() {
+	// Run by the CLI as the stdio bridge of a proxied SDK MCP server.
+	if len(os.Args) > 1 && os.Args[1] == native.MCPBridgeArg {
+		native.RunMCPBridge(os.Args[2:])
+		return
+	}
+
+	socketPath := flag.String("socket", "", "Connect to this Unix socket instead of the host's vsock port (for testing)")
+	port := flag.Uint("port", vm.SDKDaemonPort, "Host vsock port")
+	debug := flag.Bool("debug", false, "Enable debug logging")
+	showVersion := flag.Bool("version", false, "Show version and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("cowork-guest-agent %s\n", version)
+		os.Exit(0)
+	}
+
+	if *debug {
+		log.SetFlags(log.LstdFlags | log.Lshortfile)
+	} else {
+		log.SetFlags(log.LstdFlags)
+	}
+
+	dial := func() (net.Conn, error) {
+		if *socketPath != "" {
+			return net.Dial("unix", *socketPath)
+		}
+		return vm.DialVsock(vm.HostCID, uint32(*port))
+	}
+
+	agent := guestagent.New(*debug)
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigCh
+		log.Printf("Received %s, shutting down...", sig)
+		agent.Shutdown()
+		os.Exit(0)
+	}()
+
+	log.Printf("cowork-guest-agent %s starting", version)
+	// The host may not be listening yet, and it drops the connection when
+	// it restarts; keep reconnecting. Processes survive reconnects.
+	for {
+		conn, err := dial()
+		if err != nil {
+			if *debug {
+				log.Printf("Connecting to host: %v", err)
+			}
+			time.Sleep(reconnectDelay)
+			continue
+		}
+		log.Printf("Connected to host")
+		err = agent.Serve(conn)
+		conn.Close()
+		log.Printf("Host connection lost: %v", err)
+		time.Sleep(reconnectDelay)
+	}
+}
@@ -0,0 +1,328 @@
+// Package eventbus fans out backend events to RPC subscribers with sequence
+// numbers, per-session replay buffers and a configurable overflow policy.
+// Both the native and the VM backend publish through it.
+package eventbus
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/patrickjaja/claude-cowork-service/process"
+)
+
+// eventQueueSize is the number of events buffered per subscriber before the
+// overflow policy kicks in. Large enough to absorb a burst of stream-json
+// lines while the client socket is briefly slow.
+const eventQueueSize = 4096
+
+// eventRingSize is the number of recent events kept per session so a
+// reconnecting subscriber can catch up with subscribeEvents(sinceSeq).
+// Kept below eventQueueSize so a full replay fits in a fresh queue.
+const eventRingSize = 2048
+
+// OverflowPolicy controls what happens when a subscriber's event queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDisconnect drops the subscription; the client is sent a
+	// subscriptionDropped event and its connection is closed. This is the
+	// default: a stalled client can't hold up anyone else, and it can
+	// resubscribe with sinceSeq to catch up.
+	OverflowDisconnect OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest queued event to make room.
+	OverflowDropOldest
+	// OverflowBlock makes the emitter wait until the subscriber catches up.
+	// No events are lost, but a stalled client applies back-pressure to
+	// every event source: process output, the vsock reader and the QMP
+	// reader.
+	OverflowBlock
+)
+
+// ParseOverflowPolicy parses "block", "drop-oldest" or "disconnect".
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "disconnect":
+		return OverflowDisconnect, nil
+	case "drop-oldest":
+		return OverflowDropOldest, nil
+	case "block":
+		return OverflowBlock, nil
+	default:
+		return OverflowDisconnect, fmt.Errorf("unknown overflow policy %q (want block, drop-oldest or disconnect)", s)
+	}
+}
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowBlock:
+		return "block"
+	default:
+		return "disconnect"
+	}
+}
+
+// subscriber is a single SubscribeEvents registration. Events are queued in a
+// bounded FIFO and delivered by one writer goroutine, so the callback is never
+// invoked concurrently and always sees events in emission order.
+type subscriber struct {
+	callback func(event interface{})
+	filter   process.SubscribeOptions
+	policy   OverflowPolicy
+	events   chan interface{}
+	quit     chan struct{}
+	once     sync.Once
+	reason   string // set when the subscription was dropped by the backend
+	mu       sync.Mutex
+}
+
+func newSubscriber(callback func(event interface{}), filter process.SubscribeOptions, policy OverflowPolicy) *subscriber {
+	s := &subscriber{
+		callback: callback,
+		filter:   filter,
+		policy:   policy,
+		events:   make(chan interface{}, eventQueueSize),
+		quit:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// run delivers queued events until the subscription is closed.
+func (s *subscriber) run() {
+	for {
+		select {
+		case <-s.quit:
+			if reason := s.droppedReason(); reason != "" {
+				s.callback(process.NewSubscriptionDroppedEvent(reason))
+			}
+			return
+		case event := <-s.events:
+			s.callback(event)
+		}
+	}
+}
+
+// enqueue adds an event to the queue, applying the overflow policy when full.
+// It returns false if the subscription is (or has just become) closed.
+func (s *subscriber) enqueue(event interface{}) bool {
+	select {
+	case <-s.quit:
+		return false
+	default:
+	}
+
+	select {
+	case s.events <- event:
+		return true
+	default:
+	}
+
+	switch s.policy {
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.events <- event:
+				return true
+			default:
+			}
+			select {
+			case <-s.events:
+			default:
+			}
+		}
+	case OverflowBlock:
+		select {
+		case s.events <- event:
+			return true
+		case <-s.quit:
+			return false
+		}
+	default:
+		s.closeWithReason("event queue overflow")
+		return false
+	}
+}
+
+// close stops delivery. Events still queued are discarded.
+func (s *subscriber) close() {
+	s.once.Do(func() { close(s.quit) })
+}
+
+func (s *subscriber) closeWithReason(reason string) {
+	s.mu.Lock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+	s.mu.Unlock()
+	s.close()
+}
+
+func (s *subscriber) droppedReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reason
+}
+
+// eventRing is a fixed-size buffer of the most recent events for one session.
+type eventRing struct {
+	events []process.SequencedEvent
+	next   int
+	full   bool
+}
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{events: make([]process.SequencedEvent, size)}
+}
+
+func (r *eventRing) add(event process.SequencedEvent) {
+	r.events[r.next] = event
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// since returns buffered events with Seq > seq, oldest first.
+func (r *eventRing) since(seq uint64) []process.SequencedEvent {
+	var ordered []process.SequencedEvent
+	if r.full {
+		ordered = append(ordered, r.events[r.next:]...)
+	}
+	ordered = append(ordered, r.events[:r.next]...)
+
+	i := sort.Search(len(ordered), func(i int) bool { return ordered[i].Seq > seq })
+	return ordered[i:]
+}
+
+// Bus fans out backend events to subscribers, honouring each
+// subscription's session and event filters.
+//
+// Every event gets a monotonic sequence number and is recorded in its
+// session's ring buffer before delivery.
+//
+// Ordering guarantee: every subscriber receives events in the order emit was
+// called. Because a process's output streams are fully drained before its
+// exit event is emitted, a subscriber always sees all stdout/stderr events
+// for a process ID before that process's exit event.
+type Bus struct {
+	subscribers map[int]*subscriber
+	nextID      int
+	policy      OverflowPolicy
+	seq         uint64                // guarded by emitMu
+	history     map[string]*eventRing // per-session replay buffers, guarded by emitMu
+	emitMu      sync.Mutex            // serializes emit so all subscribers see the same order
+	mu          sync.RWMutex
+}
+
+// New creates an empty event bus with the OverflowDisconnect policy.
+func New() *Bus {
+	return &Bus{
+		subscribers: make(map[int]*subscriber),
+		history:     make(map[string]*eventRing),
+	}
+}
+
+// SetPolicy changes the overflow policy for subscriptions created afterwards.
+func (eb *Bus) SetPolicy(policy OverflowPolicy) {
+	eb.mu.Lock()
+	eb.policy = policy
+	eb.mu.Unlock()
+}
+
+// Subscribe registers a callback and returns a function that cancels it.
+// If opts.SinceSeq is set, buffered events newer than it are queued ahead of
+// live events; holding emitMu while doing so guarantees no gap or duplicate
+// between the replay and the live stream.
+func (eb *Bus) Subscribe(opts process.SubscribeOptions, callback func(event interface{})) func() {
+	eb.emitMu.Lock()
+	defer eb.emitMu.Unlock()
+
+	eb.mu.Lock()
+	eb.nextID++
+	id := eb.nextID
+	s := newSubscriber(callback, opts, eb.policy)
+	eb.subscribers[id] = s
+	eb.mu.Unlock()
+
+	if opts.SinceSeq > 0 {
+		for _, event := range eb.replay(opts) {
+			s.enqueue(event)
+		}
+	}
+
+	return func() {
+		eb.mu.Lock()
+		delete(eb.subscribers, id)
+		eb.mu.Unlock()
+		s.close()
+	}
+}
+
+// replay collects buffered events matching a subscription, oldest first.
+// Caller must hold emitMu.
+func (eb *Bus) replay(opts process.SubscribeOptions) []process.SequencedEvent {
+	var events []process.SequencedEvent
+	for session, r := range eb.history {
+		for _, event := range r.since(opts.SinceSeq) {
+			if opts.Matches(session, event.Event) {
+				events = append(events, event)
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Seq < events[j].Seq })
+	if len(events) > eventRingSize {
+		events = events[len(events)-eventRingSize:]
+	}
+	return events
+}
+
+// DropHistory frees a session's replay buffer once the session has stopped.
+// Its events can no longer be replayed; sequence numbers are not reused.
+func (eb *Bus) DropHistory(session string) {
+	eb.emitMu.Lock()
+	defer eb.emitMu.Unlock()
+	delete(eb.history, session)
+}
+
+// Emit assigns the next sequence number to an event, records it in the
+// session's replay buffer and queues it for every current subscriber.
+func (eb *Bus) Emit(session string, event interface{}) {
+	eb.emitMu.Lock()
+	defer eb.emitMu.Unlock()
+
+	eb.seq++
+	seqEvent := process.SequencedEvent{Seq: eb.seq, Event: event}
+
+	r, ok := eb.history[session]
+	if !ok {
+		r = newEventRing(eventRingSize)
+		eb.history[session] = r
+	}
+	r.add(seqEvent)
+
+	eb.mu.RLock()
+	subs := make(map[int]*subscriber, len(eb.subscribers))
+	for id, s := range eb.subscribers {
+		subs[id] = s
+	}
+	eb.mu.RUnlock()
+
+	for id, s := range subs {
+		if !s.filter.Matches(session, event) {
+			continue
+		}
+		if !s.enqueue(seqEvent) {
+			eb.mu.Lock()
+			delete(eb.subscribers, id)
+			eb.mu.Unlock()
+			if reason := s.droppedReason(); reason != "" {
+				log.Printf("[events] subscriber %d dropped: %s", id, reason)
+			}
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package eventbus
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patrickjaja/claude-cowork-service/process"
+)
+
+// recorder collects the events delivered to one subscriber.
+type recorder struct {
+	mu     sync.Mutex
+	events []interface{}
+}
+
+func (r *recorder) callback(event interface{}) {
+	r.mu.Lock()
+	r.events = append(r.events, event)
+	r.mu.Unlock()
+}
+
+func (r *recorder) snapshot() []interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]interface{}(nil), r.events...)
+}
+
+// wait returns the recorded events once there are at least n.
+func (r *recorder) wait(t *testing.T, n int) []interface{} {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events := r.snapshot()
+		if len(events) >= n {
+			return events
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d events, want %d", len(events), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// seqs returns the sequence numbers of the sequenced events.
+func seqs(events []interface{}) []uint64 {
+	var out []uint64
+	for _, e := range events {
+		if se, ok := e.(process.SequencedEvent); ok {
+			out = append(out, se.Seq)
+		}
+	}
+	return out
+}
+
+// checkSeqs fails unless got is exactly from, from+1, ..., to.
+func checkSeqs(t *testing.T, got []uint64, from uint64, to uint64) {
+	t.Helper()
+	if want := int(to - from + 1); len(got) != want {
+		t.Fatalf("got %d events (%v...), want %d from seq %d", len(got), head(got), want, from)
+	}
+	for i, seq := range got {
+		if seq != from+uint64(i) {
+			t.Fatalf("event %d has seq %d, want %d", i, seq, from+uint64(i))
+		}
+	}
+}
+
+func head(s []uint64) []uint64 {
+	if len(s) > 5 {
+		return s[:5]
+	}
+	return s
+}
+
+func emitN(eb *Bus, session string, n int) {
+	for i := 0; i < n; i++ {
+		eb.Emit(session, process.NewStdoutEvent("p1", strconv.Itoa(i)))
+	}
+}
+
+// stall subscribes with policy and holds up delivery inside the callback for
+// the first event until release is called, so that the queue behind it fills
+// up deterministically. The first event has already been emitted on return.
+func stall(t *testing.T, eb *Bus, policy OverflowPolicy) (r *recorder, release func()) {
+	t.Helper()
+	eb.SetPolicy(policy)
+	r = &recorder{}
+	started := make(chan struct{})
+	gate := make(chan struct{})
+	var first sync.Once
+	cancel := eb.Subscribe(process.SubscribeOptions{}, func(event interface{}) {
+		r.callback(event)
+		first.Do(func() {
+			close(started)
+			<-gate
+		})
+	})
+	t.Cleanup(cancel)
+	var once sync.Once
+	release = func() { once.Do(func() { close(gate) }) }
+	t.Cleanup(release)
+
+	emitN(eb, "s", 1)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first event not delivered")
+	}
+	return r, release
+}
+
+func subscriberCount(eb *Bus) int {
+	eb.mu.RLock()
+	defer eb.mu.RUnlock()
+	return len(eb.subscribers)
+}
+
+func TestBusDeliversInEmitOrder(t *testing.T) {
+	eb := New()
+	eb.SetPolicy(OverflowBlock) // nothing may be lost, however slow a reader is
+	var a, b recorder
+	defer eb.Subscribe(process.SubscribeOptions{}, a.callback)()
+	defer eb.Subscribe(process.SubscribeOptions{}, b.callback)()
+
+	const emitters, perEmitter = 4, 2500
+	var wg sync.WaitGroup
+	for i := 0; i < emitters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			emitN(eb, "s", perEmitter)
+		}()
+	}
+	wg.Wait()
+
+	// Concurrent emitters are serialized: every subscriber sees each
+	// sequence number once, in order.
+	checkSeqs(t, seqs(a.wait(t, emitters*perEmitter)), 1, emitters*perEmitter)
+	checkSeqs(t, seqs(b.wait(t, emitters*perEmitter)), 1, emitters*perEmitter)
+}
+
+func TestBusOverflowDisconnect(t *testing.T) {
+	eb := New()
+	r, release := stall(t, eb, OverflowDisconnect)
+	emitN(eb, "s", eventQueueSize) // fills the queue
+	if n := subscriberCount(eb); n != 1 {
+		t.Fatalf("subscriber dropped before its queue overflowed (%d left)", n)
+	}
+	emitN(eb, "s", 1)
+	if n := subscriberCount(eb); n != 0 {
+		t.Fatalf("%d subscribers left after overflow, want 0", n)
+	}
+	release()
+
+	// Some of the queued events may still go out, in order, before the
+	// subscriptionDropped event, which is always last.
+	deadline := time.Now().Add(5 * time.Second)
+	var events []interface{}
+	for {
+		events = r.snapshot()
+		if _, ok := events[len(events)-1].(process.SubscriptionDroppedEvent); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no subscriptionDropped event")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	dropped := events[len(events)-1].(process.SubscriptionDroppedEvent)
+	if dropped.Reason != "event queue overflow" {
+		t.Errorf("reason = %q", dropped.Reason)
+	}
+	got := seqs(events)
+	checkSeqs(t, got, 1, uint64(len(got)))
+	if len(got) > eventQueueSize+1 {
+		t.Errorf("delivered %d events, more than fit in the queue", len(got))
+	}
+
+	emitN(eb, "s", 1)
+	time.Sleep(10 * time.Millisecond)
+	if n := len(r.snapshot()); n != len(events) {
+		t.Errorf("%d events delivered after the subscription was dropped", n-len(events))
+	}
+}
+
+func TestBusOverflowDropOldest(t *testing.T) {
+	eb := New()
+	r, release := stall(t, eb, OverflowDropOldest)
+	const extra = 10
+	emitN(eb, "s", eventQueueSize+extra)
+	if n := subscriberCount(eb); n != 1 {
+		t.Fatalf("%d subscribers, want 1", n)
+	}
+	release()
+
+	// The first event was already being delivered; of the rest, the queue
+	// kept the newest eventQueueSize.
+	got := seqs(r.wait(t, 1+eventQueueSize))
+	if got[0] != 1 {
+		t.Fatalf("first event has seq %d, want 1", got[0])
+	}
+	checkSeqs(t, got[1:], 2+extra, 1+eventQueueSize+extra)
+}
+
+func TestBusOverflowBlock(t *testing.T) {
+	eb := New()
+	r, release := stall(t, eb, OverflowBlock)
+	emitN(eb, "s", eventQueueSize)
+
+	done := make(chan struct{})
+	go func() {
+		emitN(eb, "s", 1)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Emit returned while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Emit still blocked after the subscriber caught up")
+	}
+
+	checkSeqs(t, seqs(r.wait(t, eventQueueSize+2)), 1, eventQueueSize+2)
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    OverflowPolicy
+		wantErr bool
+	}{
+		{"", OverflowDisconnect, false},
+		{"disconnect", OverflowDisconnect, false},
+		{"Drop-Oldest", OverflowDropOldest, false},
+		{"block", OverflowBlock, false},
+		{"wait", OverflowDisconnect, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseOverflowPolicy(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseOverflowPolicy(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestBusReplay(t *testing.T) {
+	tests := []struct {
+		name     string
+		emitted  int // events emitted before subscribing
+		drop     bool
+		sinceSeq uint64
+		first    uint64 // first seq delivered
+	}{
+		{name: "sinceSeq 0 replays nothing", emitted: 10, sinceSeq: 0, first: 11},
+		{name: "inside the ring", emitted: 10, sinceSeq: 4, first: 5},
+		{name: "up to date", emitted: 10, sinceSeq: 10, first: 11},
+		{name: "older than the ring", emitted: eventRingSize + 100, sinceSeq: 50, first: 101},
+		{name: "after DropHistory", emitted: 10, drop: true, sinceSeq: 1, first: 11},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eb := New()
+			emitN(eb, "s", tt.emitted)
+			if tt.drop {
+				eb.DropHistory("s")
+			}
+			var r recorder
+			defer eb.Subscribe(process.SubscribeOptions{Name: "s", SinceSeq: tt.sinceSeq}, r.callback)()
+			emitN(eb, "s", 2) // live
+			last := uint64(tt.emitted + 2)
+			checkSeqs(t, seqs(r.wait(t, int(last-tt.first+1))), tt.first, last)
+		})
+	}
+}
+
+func TestBusReplayWhileEmitting(t *testing.T) {
+	eb := New()
+	eb.SetPolicy(OverflowBlock)
+	emitN(eb, "s", 200)
+
+	// Keep emitting while subscribing; the total stays within the ring, so
+	// everything after sinceSeq is still buffered.
+	const total = eventRingSize
+	done := make(chan struct{})
+	go func() {
+		emitN(eb, "s", total-200)
+		close(done)
+	}()
+	var r recorder
+	defer eb.Subscribe(process.SubscribeOptions{Name: "s", SinceSeq: 150}, r.callback)()
+	<-done
+
+	// No gap or duplicate between the replay and the live events.
+	checkSeqs(t, seqs(r.wait(t, total-150)), 151, total)
+}
+
+func TestBusFilters(t *testing.T) {
+	// Emitted in this order, so event i has seq i+1.
+	emitted := []struct {
+		session string
+		event   interface{}
+	}{
+		{"a", process.NewStdoutEvent("p1", "out")},
+		{"a", process.NewExitEvent("p1", 0)},
+		{"b", process.NewStdoutEvent("p2", "out")},
+		{"", process.NewAPIReachableEvent(true)},
+		{"a", map[string]string{"type": "vmStarted", "name": "a"}},
+	}
+	tests := []struct {
+		name string
+		opts process.SubscribeOptions
+		want []uint64
+	}{
+		{"every session", process.SubscribeOptions{}, []uint64{1, 2, 3, 4, 5}},
+		{"AllSessions", process.SubscribeOptions{Name: process.AllSessions}, []uint64{1, 2, 3, 4, 5}},
+		{"one session", process.SubscribeOptions{Name: "a"}, []uint64{1, 2, 4, 5}},
+		{"unknown session", process.SubscribeOptions{Name: "c"}, []uint64{4}},
+		{"event type", process.SubscribeOptions{EventTypes: []string{"exit"}}, []uint64{2}},
+		{"session and event types", process.SubscribeOptions{Name: "b", EventTypes: []string{"stdout", "exit"}}, []uint64{3}},
+		{"process ID", process.SubscribeOptions{ProcessIDs: []string{"p2"}}, []uint64{3, 4, 5}},
+		{"session and process ID", process.SubscribeOptions{Name: "a", ProcessIDs: []string{"p2"}}, []uint64{4, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eb := New()
+			var r recorder
+			defer eb.Subscribe(tt.opts, r.callback)()
+			for _, e := range emitted {
+				eb.Emit(e.session, e.event)
+			}
+			r.wait(t, len(tt.want))
+			time.Sleep(10 * time.Millisecond) // let anything unwanted arrive
+			got := seqs(r.snapshot())
+			if len(got) != len(tt.want) {
+				t.Fatalf("got seqs %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got seqs %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBusReplayFilters(t *testing.T) {
+	eb := New()
+	eb.Emit("a", process.NewStdoutEvent("p1", "out"))
+	eb.Emit("b", process.NewStdoutEvent("p2", "out"))
+	eb.Emit("a", process.NewExitEvent("p1", 0))
+
+	// Replayed events go through the same filters as live ones.
+	var r recorder
+	defer eb.Subscribe(process.SubscribeOptions{Name: "a", SinceSeq: 1, EventTypes: []string{"exit"}}, r.callback)()
+	r.wait(t, 1)
+	time.Sleep(10 * time.Millisecond)
+	if got := seqs(r.snapshot()); len(got) != 1 || got[0] != 3 {
+		t.Errorf("replayed seqs %v, want [3]", got)
+	}
+}
@@ -0,0 +1,198 @@
+// Package guestagent is a reference implementation of the sdk-daemon that
+// runs inside the VM: it serves the commands vm.Manager sends over vsock
+// and streams process events back.
+//
+// Processes are run by a native.Backend, so they behave exactly as with the
+// native backend on the host. The agent only adds the framing and the
+// guest-side mounts for shared folders. Serve works on any net.Conn, so the
+// agent can also stand in for the guest over a Unix socket or net.Pipe
+// (see vm.VsockListener.Attach); in a real guest it connects with
+// vm.DialVsock.
+package guestagent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/patrickjaja/claude-cowork-service/native"
+	"github.com/patrickjaja/claude-cowork-service/pipe"
+	"github.com/patrickjaja/claude-cowork-service/process"
+	"github.com/patrickjaja/claude-cowork-service/vm"
+)
+
+// Agent serves the guest side of the vsock protocol.
+type Agent struct {
+	backend *native.Backend
+	mounts  *mountTable
+	debug   bool
+}
+
+// request is one command frame. Fields not used by a method are left empty.
+type request struct {
+	RequestID uint64            `json:"requestId"`
+	Method    string            `json:"method"`
+	Name      string            `json:"name"`
+	ID        string            `json:"id"`
+	ProcessID string            `json:"processId"`
+	Cmd       string            `json:"cmd"`
+	Args      []string          `json:"args"`
+	Env       map[string]string `json:"env"`
+	Cwd       string            `json:"cwd"`
+	PTY       bool              `json:"pty"`
+	Rows      int               `json:"rows"`
+	Cols      int               `json:"cols"`
+	Stderr    string            `json:"stderr"`
+	Encoding  string            `json:"outputEncoding"`
+	Signal    string            `json:"signal"`
+	Data      string            `json:"data"`
+	Server    string            `json:"server"`
+	Message   json.RawMessage   `json:"message"`
+	Path      string            `json:"path"`
+	Token     string            `json:"token"`
+	FSType    string            `json:"fsType"`
+	Tag       string            `json:"tag"`
+	Subdir    string            `json:"subdir"`
+	GuestPath string            `json:"guestPath"`
+	ReadOnly  bool              `json:"readOnly"`
+}
+
+// errMethodNotFound is returned for commands the agent doesn't know.
+var errMethodNotFound = errors.New("method not found")
+
+// New creates an agent with its own process backend.
+func New(debug bool) *Agent {
+	return &Agent{
+		backend: native.NewBackend(debug),
+		mounts:  newMountTable(),
+		debug:   debug,
+	}
+}
+
+// Serve handles commands from conn until it fails, sending every process
+// event as an unsolicited frame. Processes keep running when the connection
+// drops, so the host can reconnect.
+func (a *Agent) Serve(conn net.Conn) error {
+	var writeMu sync.Mutex
+	write := func(v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return pipe.WriteMessage(conn, data)
+	}
+
+	// Announce the multiplexed framing before anything else, so the host
+	// treats frames without a requestId as events.
+	if err := write(vm.GuestHello{Type: "hello", Protocol: vm.GuestProtocolMultiplexed}); err != nil {
+		return err
+	}
+
+	cancel, _ := a.backend.SubscribeEvents(process.SubscribeOptions{Name: process.AllSessions}, func(event interface{}) {
+		if err := write(event); err != nil && a.debug {
+			log.Printf("[agent] dropping event: %v", err)
+		}
+	})
+	defer cancel()
+
+	for {
+		data, err := pipe.ReadMessage(conn)
+		if err != nil {
+			return err
+		}
+		var req request
+		if err := json.Unmarshal(data, &req); err != nil || req.RequestID == 0 {
+			log.Printf("[agent] ignoring malformed command: %s", data)
+			continue
+		}
+		// Commands run concurrently; a blocked writeStdin must not hold up
+		// the others.
+		go func() {
+			resp := vm.GuestResponse{RequestID: req.RequestID}
+			result, err := a.handle(req)
+			if err == nil && result != nil {
+				resp.Result, err = json.Marshal(result)
+			}
+			resp.Success = err == nil
+			if err != nil {
+				resp.Error = err.Error()
+				resp.Code = pipe.ErrorCode(err)
+				if errors.Is(err, errMethodNotFound) {
+					resp.Code = pipe.CodeMethodNotFound
+				}
+			}
+			if a.debug {
+				log.Printf("[agent] %s (request %d): success=%v %s", req.Method, req.RequestID, resp.Success, resp.Error)
+			}
+			if err := write(resp); err != nil {
+				log.Printf("[agent] writing response: %v", err)
+			}
+		}()
+	}
+}
+
+// handle runs one command and returns its result.
+func (a *Agent) handle(req request) (interface{}, error) {
+	b := a.backend
+	switch req.Method {
+	case "spawn":
+		// The host validated these already; the agent doesn't rely on it.
+		stderrMode, err := process.ParseStderrMode(req.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		encoding, err := process.ParseOutputEncoding(req.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		// Shared folders are already mounted by mountPath.
+		return b.Spawn(req.Name, req.ID, req.Cmd, req.Args, req.Env, req.Cwd, nil, process.SpawnOptions{
+			PTY:            req.PTY,
+			Rows:           req.Rows,
+			Cols:           req.Cols,
+			Stderr:         stderrMode,
+			OutputEncoding: encoding,
+		})
+	case "kill":
+		return nil, b.Kill(req.ProcessID, req.Signal)
+	case "resizeTerminal":
+		return nil, b.ResizeTerminal(req.ProcessID, req.Rows, req.Cols)
+	case "writeStdin":
+		return nil, b.WriteStdin(req.ProcessID, []byte(req.Data))
+	case "sendMcpMessage":
+		return nil, b.SendMcpMessage(req.ProcessID, req.Server, req.Message)
+	case "isProcessRunning":
+		running, err := b.IsProcessRunning(req.ProcessID)
+		return map[string]bool{"running": running}, err
+	case "listProcesses":
+		processes, err := b.ListProcesses(req.Name)
+		return map[string]interface{}{"processes": processes}, err
+	case "getProcessInfo":
+		return b.GetProcessInfo(req.ProcessID)
+	case "readFile":
+		data, err := b.ReadFile(req.Name, req.Path)
+		return map[string]string{"data": string(data)}, err
+	case "installSdk":
+		// The SDK ships with the guest image.
+		return nil, nil
+	case "addApprovedOauthToken":
+		return nil, b.AddApprovedOauthToken(req.Name, req.Token)
+	case "mountPath":
+		return nil, a.mounts.mount(req.FSType, req.Tag, req.Subdir, req.GuestPath, req.ReadOnly)
+	case "unmountPath":
+		return nil, a.mounts.unmount(req.GuestPath)
+	default:
+		return nil, fmt.Errorf("%w: %q", errMethodNotFound, req.Method)
+	}
+}
+
+// Shutdown terminates all processes and unmounts shared folders.
+func (a *Agent) Shutdown() {
+	a.backend.Shutdown()
+	a.mounts.unmountAll()
+}
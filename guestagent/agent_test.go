@@ -0,0 +1,197 @@
+package guestagent_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/patrickjaja/claude-cowork-service/guestagent"
+	"github.com/patrickjaja/claude-cowork-service/process"
+	"github.com/patrickjaja/claude-cowork-service/vm"
+)
+
+// agentSession serves session "s" through vm.Manager, with the agent
+// standing in for the guest over net.Pipe, and returns the manager and the
+// session's events.
+func agentSession(t *testing.T) (*vm.Manager, <-chan interface{}) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir()) // the agent's backend creates session dirs there
+
+	m := vm.NewManager(t.TempDir(), t.TempDir(), false)
+	agent := guestagent.New(false)
+	host, guest := net.Pipe()
+	go agent.Serve(guest)
+
+	events := make(chan interface{}, 64)
+	cancel, _ := m.SubscribeEvents(process.SubscribeOptions{Name: "s"}, func(event interface{}) {
+		if e, ok := event.(process.SequencedEvent); ok {
+			event = e.Event
+		}
+		events <- event
+	})
+	t.Cleanup(func() {
+		cancel()
+		m.StopVM("s")
+		guest.Close()
+		agent.Shutdown()
+	})
+
+	m.AttachGuest("s", host)
+	if ok, _ := m.IsGuestConnected("s"); !ok {
+		t.Fatal("guest not connected after AttachGuest")
+	}
+	return m, events
+}
+
+// waitExit collects the stdout of process id until it exits.
+func waitExit(t *testing.T, events <-chan interface{}, id string) (string, process.ExitEvent) {
+	t.Helper()
+	var stdout string
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			switch e := event.(type) {
+			case process.StdoutEvent:
+				if e.ProcessID == id {
+					stdout += e.Data
+				}
+			case process.ExitEvent:
+				if e.ProcessID == id {
+					return stdout, e
+				}
+			}
+		case <-timeout:
+			t.Fatalf("no exit event for %s; stdout so far %q", id, stdout)
+		}
+	}
+}
+
+// waitStdout waits until process id has written want.
+func waitStdout(t *testing.T, events <-chan interface{}, id string, want string) {
+	t.Helper()
+	var stdout string
+	timeout := time.After(10 * time.Second)
+	for stdout != want {
+		select {
+		case event := <-events:
+			if e, ok := event.(process.StdoutEvent); ok && e.ProcessID == id {
+				stdout += e.Data
+			}
+		case <-timeout:
+			t.Fatalf("stdout of %s = %q, want %q", id, stdout, want)
+		}
+	}
+}
+
+// TestManagerWithAgent runs a process through vm.Manager, with the agent
+// standing in for the guest over net.Pipe.
+func TestManagerWithAgent(t *testing.T) {
+	m, events := agentSession(t)
+
+	result, err := m.Spawn("s", "p1", "/bin/sh", []string{"-c", "echo hello; exit 3"}, nil, "", nil, process.SpawnOptions{})
+	if err != nil {
+		t.Fatalf("Spawn: %v", err)
+	}
+	if result.ID != "p1" {
+		t.Errorf("spawned %q, want p1", result.ID)
+	}
+
+	stdout, exit := waitExit(t, events, "p1")
+	if exit.ExitCode != 3 {
+		t.Errorf("exit = %+v, want code 3", exit)
+	}
+	if stdout != "hello\n" {
+		t.Errorf("stdout = %q, want %q", stdout, "hello\n")
+	}
+}
+
+func TestAgentCommands(t *testing.T) {
+	t.Run("writeStdin, isProcessRunning and kill", func(t *testing.T) {
+		m, events := agentSession(t)
+		if _, err := m.Spawn("s", "cat", "/bin/cat", nil, nil, "", nil, process.SpawnOptions{}); err != nil {
+			t.Fatalf("Spawn: %v", err)
+		}
+		if running, err := m.IsProcessRunning("cat"); err != nil || !running {
+			t.Fatalf("IsProcessRunning = %v, %v; want true", running, err)
+		}
+
+		if err := m.WriteStdin("cat", []byte("ping\n")); err != nil {
+			t.Fatalf("WriteStdin: %v", err)
+		}
+		waitStdout(t, events, "cat", "ping\n")
+
+		if err := m.Kill("cat", "SIGTERM"); err != nil {
+			t.Fatalf("Kill: %v", err)
+		}
+		if _, exit := waitExit(t, events, "cat"); exit.Signal != "SIGTERM" {
+			t.Errorf("exit = %+v, want SIGTERM", exit)
+		}
+		if running, err := m.IsProcessRunning("cat"); err != nil || running {
+			t.Errorf("IsProcessRunning after kill = %v, %v; want false", running, err)
+		}
+	})
+
+	t.Run("unknown process", func(t *testing.T) {
+		m, _ := agentSession(t)
+		if err := m.Kill("nope", "SIGTERM"); !errors.Is(err, process.ErrProcessNotFound) {
+			t.Errorf("Kill error = %v, want ErrProcessNotFound", err)
+		}
+		if err := m.WriteStdin("nope", []byte("x")); !errors.Is(err, process.ErrProcessNotFound) {
+			t.Errorf("WriteStdin error = %v, want ErrProcessNotFound", err)
+		}
+		if running, err := m.IsProcessRunning("nope"); err != nil || running {
+			t.Errorf("IsProcessRunning = %v, %v; want false", running, err)
+		}
+	})
+
+	t.Run("readFile", func(t *testing.T) {
+		m, _ := agentSession(t)
+		path := filepath.Join(t.TempDir(), "notes.txt")
+		// Contents that would break a reply parsed as anything but {"data"}.
+		want := "{\"data\": 1}\n\x00binary\n"
+		if err := os.WriteFile(path, []byte(want), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := m.ReadFile("s", path)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("ReadFile = %q, want %q", got, want)
+		}
+
+		if _, err := m.ReadFile("s", filepath.Join(t.TempDir(), "missing")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("ReadFile of a missing file: error = %v, want ErrNotExist", err)
+		}
+	})
+
+	t.Run("installSdk", func(t *testing.T) {
+		m, _ := agentSession(t)
+		if err := m.InstallSdk("s"); err != nil {
+			t.Errorf("InstallSdk: %v", err)
+		}
+	})
+
+	t.Run("addApprovedOauthToken", func(t *testing.T) {
+		t.Setenv("CLAUDE_CODE_OAUTH_TOKEN", "")
+		m, events := agentSession(t)
+		if err := m.AddApprovedOauthToken("s", ""); !errors.Is(err, process.ErrInvalidParams) {
+			t.Errorf("empty token: error = %v, want ErrInvalidParams", err)
+		}
+		if err := m.AddApprovedOauthToken("s", "tok-123"); err != nil {
+			t.Fatalf("AddApprovedOauthToken: %v", err)
+		}
+
+		// Spawns in the session get the token.
+		if _, err := m.Spawn("s", "env", "/bin/sh", []string{"-c", `printf %s "$CLAUDE_CODE_OAUTH_TOKEN"`}, nil, "", nil, process.SpawnOptions{}); err != nil {
+			t.Fatalf("Spawn: %v", err)
+		}
+		if stdout, _ := waitExit(t, events, "env"); stdout != "tok-123" {
+			t.Errorf("CLAUDE_CODE_OAUTH_TOKEN = %q, want tok-123", stdout)
+		}
+	})
+}
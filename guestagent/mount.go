@@ -0,0 +1,135 @@
+package guestagent
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/patrickjaja/claude-cowork-service/process"
+)
+
+// exportRoot is where whole-tag 9p exports are mounted before subdirectories
+// of them are bound to their guest paths.
+const exportRoot = "/run/cowork/exports"
+
+// mountTable tracks the shared folders mounted in the guest.
+type mountTable struct {
+	mounts  map[string]bool // guest paths
+	exports map[string]bool // 9p tags mounted under exportRoot
+	mu      sync.Mutex
+}
+
+func newMountTable() *mountTable {
+	return &mountTable{
+		mounts:  make(map[string]bool),
+		exports: make(map[string]bool),
+	}
+}
+
+// mount mounts a shared folder at guestPath. fsType is "virtiofs", where tag
+// names the device, or "9p", where subdir selects a directory of the export
+// with that tag.
+func (mt *mountTable) mount(fsType string, tag string, subdir string, guestPath string, readOnly bool) error {
+	if tag == "" || !filepath.IsAbs(guestPath) {
+		return fmt.Errorf("%w: mountPath needs a tag and an absolute guestPath", process.ErrInvalidParams)
+	}
+	guestPath = filepath.Clean(guestPath)
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if mt.mounts[guestPath] {
+		if err := syscall.Unmount(guestPath, syscall.MNT_DETACH); err != nil {
+			return fmt.Errorf("replacing mount at %s: %w", guestPath, err)
+		}
+		delete(mt.mounts, guestPath)
+	}
+	if err := os.MkdirAll(guestPath, 0755); err != nil {
+		return err
+	}
+
+	var flags uintptr
+	if readOnly {
+		flags = syscall.MS_RDONLY
+	}
+	switch fsType {
+	case "virtiofs":
+		if err := syscall.Mount(tag, guestPath, "virtiofs", flags, ""); err != nil {
+			return fmt.Errorf("mounting virtiofs %s at %s: %w", tag, guestPath, err)
+		}
+	case "9p":
+		export, err := mt.export9p(tag)
+		if err != nil {
+			return err
+		}
+		source := filepath.Join(export, subdir)
+		if !strings.HasPrefix(source, export+"/") && source != export {
+			return fmt.Errorf("%w: subdir %q leaves the export", process.ErrInvalidParams, subdir)
+		}
+		if err := syscall.Mount(source, guestPath, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("binding %s at %s: %w", source, guestPath, err)
+		}
+		// A bind mount only becomes read-only when remounted.
+		if readOnly {
+			if err := syscall.Mount("", guestPath, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+				syscall.Unmount(guestPath, syscall.MNT_DETACH)
+				return fmt.Errorf("making %s read-only: %w", guestPath, err)
+			}
+		}
+	default:
+		return fmt.Errorf("%w: unknown fsType %q (want virtiofs or 9p)", process.ErrInvalidParams, fsType)
+	}
+	mt.mounts[guestPath] = true
+	log.Printf("[agent] mounted %s %s at %s (readOnly=%v)", fsType, filepath.Join(tag, subdir), guestPath, readOnly)
+	return nil
+}
+
+// export9p mounts the 9p export with the given tag once and returns where.
+func (mt *mountTable) export9p(tag string) (string, error) {
+	dir := filepath.Join(exportRoot, tag)
+	if mt.exports[tag] {
+		return dir, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if err := syscall.Mount(tag, dir, "9p", 0, "trans=virtio,version=9p2000.L,msize=262144"); err != nil {
+		return "", fmt.Errorf("mounting 9p export %s: %w", tag, err)
+	}
+	mt.exports[tag] = true
+	return dir, nil
+}
+
+// unmount removes the shared folder at guestPath. Unknown paths are not an
+// error, so the host can retry.
+func (mt *mountTable) unmount(guestPath string) error {
+	guestPath = filepath.Clean(guestPath)
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if !mt.mounts[guestPath] {
+		return nil
+	}
+	if err := syscall.Unmount(guestPath, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmounting %s: %w", guestPath, err)
+	}
+	delete(mt.mounts, guestPath)
+	return nil
+}
+
+// unmountAll removes every shared folder and 9p export.
+func (mt *mountTable) unmountAll() {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	for guestPath := range mt.mounts {
+		syscall.Unmount(guestPath, syscall.MNT_DETACH)
+		delete(mt.mounts, guestPath)
+	}
+	for tag := range mt.exports {
+		syscall.Unmount(filepath.Join(exportRoot, tag), syscall.MNT_DETACH)
+		delete(mt.exports, tag)
+	}
+}
@@ -8,17 +8,48 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
+	"github.com/patrickjaja/claude-cowork-service/eventbus"
 	"github.com/patrickjaja/claude-cowork-service/native"
 	"github.com/patrickjaja/claude-cowork-service/pipe"
+	"github.com/patrickjaja/claude-cowork-service/sandbox"
+	"github.com/patrickjaja/claude-cowork-service/vm"
 )
 
 var version = "dev"
 
+// serviceBackend is what main needs from either backend.
+type serviceBackend interface {
+	pipe.VMBackend
+	SetEventOverflowPolicy(policy eventbus.OverflowPolicy)
+	Shutdown()
+}
+
 func main() {
+	// Re-executed as the sandbox setup helper inside new namespaces.
+	if len(os.Args) > 1 && os.Args[1] == sandbox.InitArg {
+		sandbox.Init(os.Args[2:])
+		return
+	}
+	// Run by the CLI as the stdio bridge of a proxied SDK MCP server.
+	if len(os.Args) > 1 && os.Args[1] == native.MCPBridgeArg {
+		native.RunMCPBridge(os.Args[2:])
+		return
+	}
+
 	socketPath := flag.String("socket", defaultSocketPath(), "Unix socket path")
+	backendKind := flag.String("backend", "native", "Where processes run: native (on the host), vm (in a QEMU/KVM guest) or auto (vm if KVM and a prepared bundle are available)")
 	debug := flag.Bool("debug", false, "Enable debug logging")
 	showVersion := flag.Bool("version", false, "Show version and exit")
+	sandboxed := flag.Bool("sandbox", false, "Run spawned processes in unprivileged user/mount namespaces that only expose the session directory and its mounts")
+	strict := flag.Bool("strict", false, "Reject unknown RPC methods instead of returning success")
+	killGrace := flag.Duration("kill-grace", 10*time.Second, "How long stopVM and shutdown wait after SIGTERM before SIGKILLing spawned processes")
+	processRetention := flag.Duration("process-retention", 10*time.Minute, "How long exited processes stay queryable before they are forgotten")
+	maxProcesses := flag.Int("max-processes", 512, "Maximum number of tracked processes (running or recently exited)")
+	tokenStorage := flag.String("token-store", "memory", "Where approved OAuth tokens are kept besides memory: memory, file or keyring")
+	vm9pHome := flag.Bool("vm-9p-home", false, "With the vm backend and no virtiofsd, share folders by exporting the whole home directory read-write over 9p")
+	eventOverflow := flag.String("event-overflow", "disconnect", "Policy when a subscriber's event queue is full: disconnect, drop-oldest or block")
 	flag.Parse()
 
 	if *showVersion {
@@ -26,20 +57,64 @@ func main() {
 		os.Exit(0)
 	}
 
+	overflowPolicy, err := eventbus.ParseOverflowPolicy(*eventOverflow)
+	if err != nil {
+		log.Fatalf("Invalid -event-overflow: %v", err)
+	}
+
+	tokenStore, err := native.ParseTokenStorage(*tokenStorage)
+	if err != nil {
+		log.Fatalf("Invalid -token-store: %v", err)
+	}
+
 	if *debug {
 		log.SetFlags(log.LstdFlags | log.Lshortfile)
 	} else {
 		log.SetFlags(log.LstdFlags)
 	}
 
-	log.Printf("cowork-svc-linux %s starting (native backend)", version)
+	bundlesDir := vm.DefaultBundlesDir()
+	kind, err := selectBackend(*backendKind, bundlesDir)
+	if err != nil {
+		log.Fatalf("Invalid -backend: %v", err)
+	}
+
+	log.Printf("cowork-svc-linux %s starting (%s backend)", version, kind)
 	log.Printf("Socket: %s", *socketPath)
 
-	// Create native backend (executes directly on host, no VM)
-	backend := native.NewBackend(*debug)
+	var backend serviceBackend
+	if kind == "vm" {
+		// Processes run in the guest; the host-side process flags don't apply.
+		flag.Visit(func(f *flag.Flag) {
+			if reason, ok := nativeOnlyFlags[f.Name]; ok {
+				log.Printf("Ignoring -%s: %s", f.Name, reason)
+			}
+		})
+		home, _ := os.UserHomeDir()
+		vmm := vm.NewManager(filepath.Join(home, ".local", "share", "claude-cowork", "vm"), bundlesDir, *debug)
+		vmm.SetHomeShare9p(*vm9pHome)
+		backend = vmm
+	} else {
+		// Create native backend (executes directly on host, no VM)
+		nb := native.NewBackend(*debug)
+		nb.SetTerminationGrace(*killGrace)
+		nb.SetProcessRetention(*processRetention, *maxProcesses)
+		if err := nb.SetTokenStorage(tokenStore); err != nil {
+			log.Fatalf("Token storage unavailable: %v", err)
+		}
+		if *sandboxed {
+			if err := nb.EnableSandbox(); err != nil {
+				log.Fatalf("Sandbox unavailable: %v", err)
+			}
+		}
+		backend = nb
+	}
+	backend.SetEventOverflowPolicy(overflowPolicy)
 
 	// Create and start the Unix socket server
 	server := pipe.NewServer(*socketPath, backend, *debug)
+	server.SetInfo(pipe.ServerInfo{Version: version, Backend: kind})
+	server.SetStrict(*strict)
 	if err := server.Start(); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
@@ -55,10 +130,41 @@ func main() {
 	backend.Shutdown()
 }
 
+// nativeOnlyFlags maps the flags that only configure the native backend to
+// why the vm backend ignores them.
+var nativeOnlyFlags = map[string]string{
+	"sandbox":           "the vm backend already isolates processes in the guest",
+	"kill-grace":        "the guest's sdk-daemon stops its own processes",
+	"process-retention": "the guest's sdk-daemon tracks its own processes",
+	"max-processes":     "the guest's sdk-daemon tracks its own processes",
+	"token-store":       "approved OAuth tokens are forwarded to the guest",
+}
+
+// selectBackend resolves the -backend flag to "native" or "vm". An explicit
+// "vm" fails if the VM can't run; "auto" falls back to native.
+func selectBackend(kind string, bundlesDir string) (string, error) {
+	switch kind {
+	case "native":
+		return "native", nil
+	case "vm":
+		if err := vm.Available(bundlesDir); err != nil {
+			return "", err
+		}
+		return "vm", nil
+	case "auto":
+		if err := vm.Available(bundlesDir); err != nil {
+			log.Printf("VM backend unavailable (%v), using native backend", err)
+			return "native", nil
+		}
+		return "vm", nil
+	default:
+		return "", fmt.Errorf("unknown backend %q (want native, vm or auto)", kind)
+	}
+}
+
 func defaultSocketPath() string {
 	if xdg := os.Getenv("XDG_RUNTIME_DIR"); xdg != "" {
 		return filepath.Join(xdg, "cowork-vm-service.sock")
 	}
 	return "/tmp/cowork-vm-service.sock"
 }
-
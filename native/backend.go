@@ -9,7 +9,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/patrickjaja/claude-cowork-service/eventbus"
 	"github.com/patrickjaja/claude-cowork-service/process"
+	"github.com/patrickjaja/claude-cowork-service/sandbox"
 )
 
 // Backend implements pipe.VMBackend by executing commands directly on the host.
@@ -17,23 +19,80 @@ import (
 type Backend struct {
 	debug   bool
 	started bool
+	sandbox bool // run spawned processes in user/mount namespaces
 	memory  int
 	cpus    int
 
-	tracker     *processTracker
-	subscribers []func(event interface{})
-	mu          sync.RWMutex
+	tracker *processTracker
+	events  *eventbus.Bus
+	cgroups *cgroupManager
+	tokens  *tokenStore
+	mu      sync.RWMutex
 }
 
 // NewBackend creates a native backend that runs processes on the host.
 func NewBackend(debug bool) *Backend {
 	b := &Backend{
-		debug: debug,
+		debug:   debug,
+		events:  eventbus.New(),
+		cgroups: newCgroupManager(debug),
+		tokens:  newTokenStore(),
 	}
-	b.tracker = newProcessTracker(b.emitEvent, debug)
+	b.tracker = newProcessTracker(b.emitEvent, b.cgroups, debug)
 	return b
 }
 
+// SetEventOverflowPolicy sets how new subscriptions handle a full event queue.
+func (b *Backend) SetEventOverflowPolicy(policy eventbus.OverflowPolicy) {
+	b.events.SetPolicy(policy)
+}
+
+// SetTerminationGrace sets how long stopVM and shutdown wait after SIGTERM
+// before SIGKILLing a process group.
+func (b *Backend) SetTerminationGrace(grace time.Duration) {
+	b.tracker.grace = grace
+}
+
+// SetProcessRetention sets how long exited processes stay queryable through
+// isProcessRunning and kill, and how many processes (running or retained)
+// may be tracked at once. Zero values keep the current setting.
+func (b *Backend) SetProcessRetention(retention time.Duration, limit int) {
+	pt := b.tracker
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if retention > 0 {
+		pt.retention = retention
+	}
+	if limit > 0 {
+		pt.limit = limit
+	}
+}
+
+// SetTokenStorage selects where approved OAuth tokens are kept besides
+// memory. It fails if the storage is unavailable.
+func (b *Backend) SetTokenStorage(storage TokenStorage) error {
+	if err := b.tokens.setStorage(storage); err != nil {
+		return err
+	}
+	if storage != TokenStorageMemory {
+		log.Printf("[native] approved OAuth tokens are persisted to the %s", storage)
+	}
+	return nil
+}
+
+// EnableSandbox makes future spawns run inside unprivileged user and mount
+// namespaces. It fails if the kernel doesn't allow that.
+func (b *Backend) EnableSandbox() error {
+	if err := sandbox.Available(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.sandbox = true
+	b.mu.Unlock()
+	log.Printf("[native] sandbox enabled: processes only see their session directory and mounts")
+	return nil
+}
+
 func (b *Backend) Configure(memoryMB int, cpuCount int) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -45,8 +104,11 @@ func (b *Backend) Configure(memoryMB int, cpuCount int) error {
 		b.cpus = cpuCount
 	}
 
+	// Limits apply per session, to every process spawned for it.
+	b.cgroups.configure(b.memory, b.cpus)
+
 	if b.debug {
-		log.Printf("[native] configured: memoryMB=%d, cpuCount=%d (ignored, running natively)", b.memory, b.cpus)
+		log.Printf("[native] configured: memoryMB=%d, cpuCount=%d (cgroup limits: %v)", b.memory, b.cpus, b.cgroups.enabled)
 	}
 	return nil
 }
@@ -70,8 +132,8 @@ func (b *Backend) StartVM(name string) error {
 	// (both calls arrive simultaneously on different connections)
 	go func() {
 		time.Sleep(500 * time.Millisecond)
-		b.emitEvent(map[string]string{"type": "vmStarted", "name": name})
-		b.emitEvent(process.NewAPIReachableEvent(true))
+		b.emitEvent(name, map[string]string{"type": "vmStarted", "name": name})
+		b.emitEvent(name, process.NewAPIReachableEvent(true))
 	}()
 	return nil
 }
@@ -81,12 +143,24 @@ func (b *Backend) StopVM(name string) error {
 	b.started = false
 	b.mu.Unlock()
 
-	b.tracker.killAll()
+	forced := b.tracker.terminateSession(name)
+	if len(forced) > 0 {
+		log.Printf("[native] stopVM %s: force-killed %d process(es) after the grace period: %s", name, len(forced), strings.Join(forced, ", "))
+	}
+	b.cgroups.removeSession(name)
+	if err := b.tokens.clear(name); err != nil {
+		log.Printf("[native] stopVM %s: %v", name, err)
+	}
 
 	if b.debug {
 		log.Printf("[native] stopVM %s", name)
 	}
-	b.emitEvent(map[string]string{"type": "vmStopped", "name": name})
+	stopped := map[string]interface{}{"type": "vmStopped", "name": name}
+	if len(forced) > 0 {
+		stopped["forceKilled"] = forced
+	}
+	b.emitEvent(name, stopped)
+	b.events.DropHistory(name)
 	return nil
 }
 
@@ -103,9 +177,17 @@ func (b *Backend) IsGuestConnected(name string) (bool, error) {
 	return b.started, nil
 }
 
-func (b *Backend) Spawn(name string, id string, cmd string, args []string, env map[string]string, cwd string, mounts map[string]string) (string, error) {
+func (b *Backend) Spawn(name string, id string, cmd string, args []string, env map[string]string, cwd string, mounts map[string]process.Mount, opts process.SpawnOptions) (process.SpawnResult, error) {
 	if b.debug {
-		log.Printf("[native] spawn: %s %v (cwd=%s, mounts=%v)", cmd, args, cwd, mounts)
+		log.Printf("[native] spawn: %s %v (cwd=%s, mounts=%v, pty=%v)", cmd, args, cwd, mounts, opts.PTY)
+	}
+	if cmd == "" {
+		return process.SpawnResult{}, fmt.Errorf("%w: empty command", process.ErrInvalidParams)
+	}
+	if opts.PTY {
+		opts.Stderr = ""
+	} else {
+		opts.Stderr = process.ResolveStderrMode(opts.Stderr, cmd, args)
 	}
 
 	// The client sends VM paths like /sessions/<name>/mnt/<mount>.
@@ -115,11 +197,55 @@ func (b *Backend) Spawn(name string, id string, cmd string, args []string, env m
 	realSessionDir := filepath.Join(home, ".local", "share", "claude-cowork", "sessions", name)
 	mntDir := filepath.Join(realSessionDir, "mnt")
 	if err := os.MkdirAll(mntDir, 0755); err != nil {
-		return "", fmt.Errorf("creating session dir: %w", err)
+		return process.SpawnResult{}, fmt.Errorf("creating session dir: %w", err)
+	}
+
+	// Remove empty env vars that might confuse auth (e.g. empty ANTHROPIC_API_KEY)
+	for k, v := range env {
+		if v == "" {
+			delete(env, k)
+		}
+	}
+
+	// Fall back to the token approved for the session.
+	if !hasCredentials(env) {
+		token, err := b.tokens.get(name)
+		if err != nil {
+			log.Printf("[native] spawn %s: %v", name, err)
+		} else if token != "" {
+			if env == nil {
+				env = make(map[string]string)
+			}
+			env[oauthTokenEnv] = token
+			if b.debug {
+				log.Printf("[native] injecting approved OAuth token for session %s", name)
+			}
+		}
+	}
+
+	// SDK-type MCP servers live in Claude Desktop; proxy them through
+	// the daemon so the CLI can reach them (see mcpProxy).
+	mcp, err := newMCPProxy(args, b.debug)
+	if err != nil {
+		return process.SpawnResult{}, err
 	}
 
-	for mountName, relPath := range mounts {
-		hostPath := filepath.Join(home, relPath)
+	b.mu.RLock()
+	sandboxed := b.sandbox
+	b.mu.RUnlock()
+	if sandboxed {
+		return b.spawnSandboxed(name, id, cmd, args, env, cwd, mounts, opts, mcp, home, realSessionDir)
+	}
+
+	// Without namespaces a mount is just a symlink, so read-only can't be
+	// enforced; report the effective mode so the client knows.
+	effective := make(map[string]string, len(mounts))
+	for mountName, m := range mounts {
+		effective[mountName] = process.MountReadWrite
+		if m.ReadOnly() {
+			log.Printf("[native] mount %q requested read-only, but only -sandbox can enforce that; mounting read-write", mountName)
+		}
+		hostPath := filepath.Join(home, m.Path)
 		os.MkdirAll(hostPath, 0755)
 		linkPath := filepath.Join(mntDir, mountName)
 		os.Remove(linkPath)
@@ -174,11 +300,11 @@ func (b *Backend) Spawn(name string, id string, cmd string, args []string, env m
 	// The session's mnt/ dir uses symlinks for mounts, but Glob doesn't follow
 	// directory symlinks, so files aren't found. Setting cwd to the actual
 	// workspace path lets the model search real files directly.
-	for mountName, relPath := range mounts {
+	for mountName, m := range mounts {
 		if strings.HasPrefix(mountName, ".") || mountName == "uploads" || mountName == "outputs" {
 			continue
 		}
-		wsPath := filepath.Join(home, relPath)
+		wsPath := filepath.Join(home, m.Path)
 		if info, err := os.Stat(wsPath); err == nil && info.IsDir() {
 			if b.debug {
 				log.Printf("[native] using workspace mount %q as cwd: %s (was %s)", mountName, wsPath, cwd)
@@ -188,33 +314,13 @@ func (b *Backend) Spawn(name string, id string, cmd string, args []string, env m
 		break
 	}
 
-	// Remove empty env vars that might confuse auth (e.g. empty ANTHROPIC_API_KEY)
-	for k, v := range env {
-		if v == "" {
-			delete(env, k)
-		}
-	}
-
-	// Strip --mcp-config with sdk-type servers — we can't provide them
-	// as they require the parent to proxy stdio connections.
-	// Replace the config with an empty one so Claude Code starts without blocking.
-	for i, a := range args {
-		if a == "--mcp-config" && i+1 < len(args) {
-			args[i+1] = `{"mcpServers":{}}`
-			if b.debug {
-				log.Printf("[native] stripped sdk MCP servers from --mcp-config")
-			}
-			break
-		}
-	}
-
 	// Build mount path remappings: session/mnt/<mount> → real target path.
 	// After VM→real prefix mapping, stdin still contains paths like
 	// <realSessionDir>/mnt/<mount> which are symlinks that Glob can't follow.
 	// These remappings replace them with the actual target directories.
 	var mountRemap []pathRemap
-	for mountName, relPath := range mounts {
-		hostPath := filepath.Join(home, relPath)
+	for mountName, m := range mounts {
+		hostPath := filepath.Join(home, m.Path)
 		mntPath := realSessionDir + "/mnt/" + mountName
 		if mntPath != hostPath {
 			mountRemap = append(mountRemap, pathRemap{
@@ -227,7 +333,113 @@ func (b *Backend) Spawn(name string, id string, cmd string, args []string, env m
 		}
 	}
 
-	return b.tracker.spawn(id, cmd, args, env, cwd, sessionPrefix, realSessionDir, mountRemap)
+	// Manifests are read through the same paths the CLI gets: after the
+	// arg remap above they resolve on the host.
+	skills := loadSkillMap(pluginDirArgs(args), b.debug)
+
+	processID, err := b.tracker.spawn(spawnOptions{
+		session:    name,
+		id:         id,
+		cmd:        cmd,
+		args:       args,
+		env:        env,
+		cwd:        cwd,
+		vmPrefix:   sessionPrefix,
+		realPrefix: realSessionDir,
+		mountRemap: mountRemap,
+		skills:     skills,
+		mcp:        mcp,
+		cgroup:     b.cgroups.sessionCgroup(name),
+		pty:        opts.PTY,
+		rows:       opts.Rows,
+		cols:       opts.Cols,
+		stderr:     opts.Stderr,
+		encoding:   opts.OutputEncoding,
+	})
+	if err != nil {
+		mcp.close()
+		return process.SpawnResult{}, err
+	}
+	return process.SpawnResult{ID: processID, Mounts: effective, Stderr: opts.Stderr, MCPServers: mcp.names()}, nil
+}
+
+// spawnSandboxed runs a process inside user and mount namespaces where the
+// session directory and its mounts exist at their real /sessions/<name>
+// paths, so cwd, env, args and stdin need no remapping.
+// Read-only mounts are enforced with read-only bind mounts.
+func (b *Backend) spawnSandboxed(name string, id string, cmd string, args []string, env map[string]string, cwd string, mounts map[string]process.Mount, opts process.SpawnOptions, mcp *mcpProxy, home string, realSessionDir string) (process.SpawnResult, error) {
+	sessionPath := sandbox.SessionPath(name)
+	cfg := &sandbox.Config{
+		Session:    name,
+		SessionDir: realSessionDir,
+		Home:       home,
+	}
+
+	effective := make(map[string]string, len(mounts))
+	for mountName, m := range mounts {
+		hostPath := filepath.Join(home, m.Path)
+		os.MkdirAll(hostPath, 0755)
+
+		// Replace any symlink left by an unsandboxed run with a real
+		// directory to serve as the bind mount point.
+		mountPoint := filepath.Join(realSessionDir, "mnt", mountName)
+		if info, err := os.Lstat(mountPoint); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			os.Remove(mountPoint)
+		}
+		os.MkdirAll(mountPoint, 0755)
+
+		cfg.Mounts = append(cfg.Mounts, sandbox.Mount{
+			Source:   hostPath,
+			Target:   filepath.Join(sessionPath, "mnt", mountName),
+			ReadOnly: m.ReadOnly(),
+		})
+		effective[mountName] = process.NormalizeMountMode(m.Mode)
+		if b.debug {
+			log.Printf("[native] sandbox mount: %s → %s (%s)", hostPath, filepath.Join(sessionPath, "mnt", mountName), effective[mountName])
+		}
+	}
+
+	// The host home directory is hidden; give the CLI the session dir instead.
+	if _, ok := env["HOME"]; !ok {
+		if env == nil {
+			env = make(map[string]string)
+		}
+		env["HOME"] = sessionPath
+	}
+	if cwd == "" {
+		cwd = sessionPath
+	}
+
+	// The CLI sees plugin dirs at their sandbox paths; read the manifests
+	// from the host directories mounted there.
+	var pluginDirs []string
+	for _, dir := range pluginDirArgs(args) {
+		pluginDirs = append(pluginDirs, cfg.HostPath(dir))
+	}
+	skills := loadSkillMap(pluginDirs, b.debug)
+
+	processID, err := b.tracker.spawn(spawnOptions{
+		session:  name,
+		id:       id,
+		cmd:      cmd,
+		args:     args,
+		env:      env,
+		cwd:      cwd,
+		skills:   skills,
+		mcp:      mcp,
+		sandbox:  cfg,
+		cgroup:   b.cgroups.sessionCgroup(name),
+		pty:      opts.PTY,
+		rows:     opts.Rows,
+		cols:     opts.Cols,
+		stderr:   opts.Stderr,
+		encoding: opts.OutputEncoding,
+	})
+	if err != nil {
+		mcp.close()
+		return process.SpawnResult{}, err
+	}
+	return process.SpawnResult{ID: processID, Mounts: effective, Stderr: opts.Stderr, MCPServers: mcp.names()}, nil
 }
 
 func (b *Backend) Kill(processID string, signal string) error {
@@ -237,20 +449,50 @@ func (b *Backend) Kill(processID string, signal string) error {
 	return b.tracker.kill(processID, signal)
 }
 
+// ResizeTerminal changes the terminal size of a process spawned with a PTY.
+func (b *Backend) ResizeTerminal(processID string, rows int, cols int) error {
+	if b.debug {
+		log.Printf("[native] resizeTerminal %s %dx%d", processID, cols, rows)
+	}
+	return b.tracker.resize(processID, rows, cols)
+}
+
 func (b *Backend) WriteStdin(processID string, data []byte) error {
 	return b.tracker.writeStdin(processID, data)
 }
 
+// SendMcpMessage relays a JSON-RPC message from the client to one of a
+// process's proxied SDK MCP servers.
+func (b *Backend) SendMcpMessage(processID string, server string, message []byte) error {
+	if b.debug {
+		log.Printf("[native] sendMcpMessage %s %s: %s", processID, server, message)
+	}
+	return b.tracker.sendMCP(processID, server, message)
+}
+
 func (b *Backend) IsProcessRunning(processID string) (bool, error) {
 	return b.tracker.isRunning(processID)
 }
 
-func (b *Backend) MountPath(name string, hostPath string, guestPath string) error {
-	// Paths are already native — no mounting needed
+// ListProcesses describes the processes spawned for a session, or for all
+// sessions if name is empty or "*". Exited processes are included until
+// they fall out of the retention window.
+func (b *Backend) ListProcesses(name string) ([]process.Info, error) {
+	return b.tracker.list(name), nil
+}
+
+// GetProcessInfo describes a single process.
+func (b *Backend) GetProcessInfo(processID string) (process.Info, error) {
+	return b.tracker.info(processID)
+}
+
+func (b *Backend) MountPath(name string, hostPath string, guestPath string, mode string) (string, error) {
+	// Paths are already native — no mounting needed, and nothing stops
+	// writes to them.
 	if b.debug {
 		log.Printf("[native] mountPath %s → %s (no-op, paths are native)", hostPath, guestPath)
 	}
-	return nil
+	return process.MountReadWrite, nil
 }
 
 func (b *Backend) ReadFile(name string, path string) ([]byte, error) {
@@ -267,11 +509,17 @@ func (b *Backend) InstallSdk(name string) error {
 	return nil
 }
 
+// AddApprovedOauthToken stores the OAuth token for a session, replacing any
+// previous one. Spawns in the session get it as CLAUDE_CODE_OAUTH_TOKEN
+// unless the client passes credentials itself.
 func (b *Backend) AddApprovedOauthToken(name string, token string) error {
+	if token == "" {
+		return fmt.Errorf("%w: empty token", process.ErrInvalidParams)
+	}
 	if b.debug {
-		log.Printf("[native] addApprovedOauthToken (no-op)")
+		log.Printf("[native] addApprovedOauthToken %s", name)
 	}
-	return nil
+	return b.tokens.set(name, token)
 }
 
 func (b *Backend) SetDebugLogging(enabled bool) {
@@ -284,43 +532,27 @@ func (b *Backend) SetDebugLogging(enabled bool) {
 	}
 }
 
-func (b *Backend) SubscribeEvents(name string, callback func(event interface{})) (func(), error) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-
-	b.subscribers = append(b.subscribers, callback)
-	idx := len(b.subscribers) - 1
-
-	cancel := func() {
-		b.mu.Lock()
-		defer b.mu.Unlock()
-		if idx < len(b.subscribers) {
-			b.subscribers[idx] = nil
-		}
-	}
-
-	return cancel, nil
+// SubscribeEvents registers a callback that receives events in emission order
+// from a dedicated queue (see eventbus.Bus for the ordering guarantee), replaying
+// buffered events newer than opts.SinceSeq first.
+func (b *Backend) SubscribeEvents(opts process.SubscribeOptions, callback func(event interface{})) (func(), error) {
+	return b.events.Subscribe(opts, callback), nil
 }
 
 func (b *Backend) GetDownloadStatus() string {
 	return "ready"
 }
 
-// Shutdown kills all tracked processes.
+// Shutdown terminates all tracked processes and waits for them to exit.
 func (b *Backend) Shutdown() {
 	log.Printf("[native] shutting down...")
-	b.tracker.killAll()
+	if forced := b.tracker.terminateAll(); len(forced) > 0 {
+		log.Printf("[native] force-killed %d process(es) after the grace period: %s", len(forced), strings.Join(forced, ", "))
+	}
+	b.tracker.close()
 }
 
-func (b *Backend) emitEvent(event interface{}) {
-	b.mu.RLock()
-	subs := make([]func(event interface{}), len(b.subscribers))
-	copy(subs, b.subscribers)
-	b.mu.RUnlock()
-
-	for _, cb := range subs {
-		if cb != nil {
-			go cb(event)
-		}
-	}
+// emitEvent publishes an event belonging to the given session.
+func (b *Backend) emitEvent(session string, event interface{}) {
+	b.events.Emit(session, event)
 }
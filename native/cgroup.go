@@ -0,0 +1,317 @@
+package native
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	cgroupRoot        = "/sys/fs/cgroup"
+	cgroup2SuperMagic = 0x63677270
+	cpuPeriodUS       = 100000
+)
+
+// unsafeCgroupChars matches characters not allowed in session cgroup names.
+var unsafeCgroupChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// cgroupManager places each session's processes in its own cgroup v2 under
+// the daemon's delegated cgroup, with memory.max and cpu.max taken from the
+// configure RPC. The layout is:
+//
+//	<service cgroup>/daemon                   — the daemon itself
+//	<service cgroup>/session-<name>           — limits for one session
+//	<service cgroup>/session-<name>/proc-<id> — one spawned process tree
+//
+// The per-process leaves have no limits of their own; they exist so that
+// memory.events can attribute OOM kills to a single process.
+//
+// It needs a delegated subtree (Delegate=yes in the systemd unit). Without
+// one, enabled stays false and processes run without limits.
+type cgroupManager struct {
+	base      string // the daemon's own cgroup directory
+	enabled   bool
+	cloneInto bool // kernel supports CLONE_INTO_CGROUP
+	memoryMB  int
+	cpus      int
+	sessions  map[string]string // session name → cgroup directory
+	debug     bool
+	mu        sync.Mutex
+}
+
+func newCgroupManager(debug bool) *cgroupManager {
+	cm := &cgroupManager{
+		sessions: make(map[string]string),
+		debug:    debug,
+	}
+	if err := cm.setup(); err != nil {
+		log.Printf("[native] cgroup limits unavailable, running without resource limits: %v", err)
+		return cm
+	}
+	cm.enabled = true
+	log.Printf("[native] cgroup limits enabled under %s", cm.base)
+	return cm
+}
+
+// setup checks for a writable cgroup v2 subtree, moves the daemon into a leaf
+// and enables the memory and cpu controllers for session cgroups.
+func (cm *cgroupManager) setup() error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(cgroupRoot, &st); err != nil {
+		return fmt.Errorf("statfs %s: %w", cgroupRoot, err)
+	}
+	if st.Type != cgroup2SuperMagic {
+		return fmt.Errorf("%s is not a cgroup v2 (unified) hierarchy", cgroupRoot)
+	}
+
+	rel, err := ownCgroup()
+	if err != nil {
+		return err
+	}
+	cm.base = filepath.Join(cgroupRoot, rel)
+
+	controllers, err := os.ReadFile(filepath.Join(cm.base, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("reading controllers: %w", err)
+	}
+	for _, want := range []string{"memory", "cpu"} {
+		if !containsField(string(controllers), want) {
+			return fmt.Errorf("controller %q not delegated to %s (set Delegate=yes in the service unit)", want, cm.base)
+		}
+	}
+
+	// cgroup v2 forbids processes in a cgroup that distributes controllers
+	// to children, so the daemon moves into its own leaf first.
+	leaf := filepath.Join(cm.base, "daemon")
+	if err := os.MkdirAll(leaf, 0755); err != nil {
+		return fmt.Errorf("creating daemon cgroup (is the subtree delegated?): %w", err)
+	}
+	pid := strconv.Itoa(os.Getpid())
+	if err := writeCgroupFile(leaf, "cgroup.procs", pid); err != nil {
+		return fmt.Errorf("moving daemon into %s: %w", leaf, err)
+	}
+	if err := writeCgroupFile(cm.base, "cgroup.subtree_control", "+memory +cpu"); err != nil {
+		// Running without limits, the daemon goes back where it was
+		// started rather than sitting in a leaf nothing else uses.
+		if err := writeCgroupFile(cm.base, "cgroup.procs", pid); err != nil {
+			log.Printf("[native] moving daemon back to %s: %v", cm.base, err)
+		} else {
+			os.Remove(leaf)
+		}
+		return fmt.Errorf("enabling controllers: %w", err)
+	}
+
+	cm.cloneInto = probeCloneIntoCgroup(leaf)
+	return nil
+}
+
+// configure updates the limits applied to new and existing session cgroups.
+func (cm *cgroupManager) configure(memoryMB int, cpus int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.memoryMB = memoryMB
+	cm.cpus = cpus
+	if !cm.enabled {
+		return
+	}
+	for session, dir := range cm.sessions {
+		if err := cm.applyLimits(dir); err != nil {
+			log.Printf("[native] cgroup limits for session %s: %v", session, err)
+		}
+	}
+}
+
+// sessionCgroup returns the cgroup directory for a session, creating it with
+// the current limits. It returns "" when cgroups are unavailable.
+func (cm *cgroupManager) sessionCgroup(session string) string {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if !cm.enabled {
+		return ""
+	}
+	if dir, ok := cm.sessions[session]; ok {
+		return dir
+	}
+
+	dir := filepath.Join(cm.base, "session-"+unsafeCgroupChars.ReplaceAllString(session, "_"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("[native] creating cgroup for session %s: %v", session, err)
+		return ""
+	}
+	if err := cm.applyLimits(dir); err != nil {
+		log.Printf("[native] cgroup limits for session %s: %v", session, err)
+	}
+	// Process leaves need the memory controller for their memory.events.
+	if err := writeCgroupFile(dir, "cgroup.subtree_control", "+memory"); err != nil {
+		log.Printf("[native] enabling memory controller for session %s: %v", session, err)
+	}
+	cm.sessions[session] = dir
+	if cm.debug {
+		log.Printf("[native] session %s cgroup: %s (memoryMB=%d, cpus=%d)", session, dir, cm.memoryMB, cm.cpus)
+	}
+	return dir
+}
+
+// processCgroup creates the leaf cgroup for one process inside a session
+// cgroup. It returns "" if the leaf can't be created.
+func (cm *cgroupManager) processCgroup(sessionDir string, id string) string {
+	dir := filepath.Join(sessionDir, "proc-"+unsafeCgroupChars.ReplaceAllString(id, "_"))
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		log.Printf("[native] creating cgroup for process %s: %v", id, err)
+		return ""
+	}
+	return dir
+}
+
+// removeProcess deletes a process leaf once its processes have exited.
+// Background children that outlived the process keep it alive; it is then
+// left in place.
+func (cm *cgroupManager) removeProcess(dir string) {
+	if err := os.Remove(dir); err != nil && cm.debug {
+		log.Printf("[native] removing cgroup %s: %v", dir, err)
+	}
+}
+
+// kill SIGKILLs every process in cgroup dir via cgroup.kill (Linux 5.14+).
+func (cm *cgroupManager) kill(dir string) {
+	if err := writeCgroupFile(dir, "cgroup.kill", "1"); err != nil && cm.debug {
+		log.Printf("[native] cgroup.kill %s: %v", dir, err)
+	}
+}
+
+// oomKills returns the number of processes in cgroup dir killed by the OOM
+// killer, from the oom_kill counter in memory.events.
+func (cm *cgroupManager) oomKills(dir string) int {
+	data, err := os.ReadFile(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "oom_kill "); ok {
+			n, _ := strconv.Atoi(strings.TrimSpace(value))
+			return n
+		}
+	}
+	return 0
+}
+
+// removeSession deletes a session's cgroup. It only succeeds once all of the
+// session's processes have exited; failures are harmless and retried on the
+// next stop of the same session.
+func (cm *cgroupManager) removeSession(session string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	dir, ok := cm.sessions[session]
+	if !ok {
+		return
+	}
+	if err := os.Remove(dir); err != nil {
+		if cm.debug {
+			log.Printf("[native] removing cgroup %s: %v", dir, err)
+		}
+		return
+	}
+	delete(cm.sessions, session)
+}
+
+// applyLimits writes memory.max and cpu.max. Caller must hold cm.mu.
+func (cm *cgroupManager) applyLimits(dir string) error {
+	memoryMax := "max"
+	if cm.memoryMB > 0 {
+		memoryMax = strconv.FormatInt(int64(cm.memoryMB)*1024*1024, 10)
+	}
+	if err := writeCgroupFile(dir, "memory.max", memoryMax); err != nil {
+		return err
+	}
+
+	cpuMax := fmt.Sprintf("max %d", cpuPeriodUS)
+	if cm.cpus > 0 {
+		cpuMax = fmt.Sprintf("%d %d", cm.cpus*cpuPeriodUS, cpuPeriodUS)
+	}
+	return writeCgroupFile(dir, "cpu.max", cpuMax)
+}
+
+// attach configures attr so the process is created inside cgroup dir. The
+// returned function must be called after Start with the new pid, or 0 if
+// Start failed: it closes the cgroup fd or, on kernels without
+// CLONE_INTO_CGROUP, moves the started process into dir.
+func (cm *cgroupManager) attach(attr *syscall.SysProcAttr, dir string) (afterStart func(pid int), err error) {
+	if !cm.cloneInto {
+		return func(pid int) {
+			if pid == 0 {
+				return
+			}
+			if err := writeCgroupFile(dir, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+				log.Printf("[native] moving pid %d into %s: %v", pid, dir, err)
+			}
+		}, nil
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("opening cgroup %s: %w", dir, err)
+	}
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(f.Fd())
+	return func(int) { f.Close() }, nil
+}
+
+// probeCloneIntoCgroup reports whether processes can be started directly in
+// a cgroup (clone3 with CLONE_INTO_CGROUP, Linux 5.7+).
+func probeCloneIntoCgroup(dir string) bool {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	pid, err := syscall.ForkExec("/bin/true", []string{"true"}, &syscall.ProcAttr{
+		Sys: &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(f.Fd())},
+	})
+	if err != nil {
+		return false
+	}
+	var ws syscall.WaitStatus
+	syscall.Wait4(pid, &ws, 0, nil)
+	return true
+}
+
+// ownCgroup returns the daemon's cgroup v2 path from /proc/self/cgroup.
+func ownCgroup() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rest, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return rest, nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup v2 entry in /proc/self/cgroup")
+}
+
+func writeCgroupFile(dir string, name string, value string) error {
+	return os.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+}
+
+func containsField(s string, field string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,322 @@
+package native
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/patrickjaja/claude-cowork-service/process"
+)
+
+// MCPBridgeArg is the first argument that makes the daemon binary act as the
+// stdio bridge of a proxied SDK MCP server instead of starting the service.
+const MCPBridgeArg = "__mcp-bridge"
+
+// mcpWriteTimeout bounds a write of one message to a bridge.
+const mcpWriteTimeout = 10 * time.Second
+
+// mcpProxy serves the SDK-type MCP servers of one process.
+//
+// SDK servers live inside Claude Desktop, so the CLI can't start them. For
+// each one the daemon listens on an abstract Unix socket and replaces the
+// server in --mcp-config with a stdio server that runs this binary as a
+// bridge (see RunMCPBridge) to that socket. JSON-RPC messages from the CLI
+// are emitted as mcpMessage events; the client answers with sendMcpMessage.
+//
+// Abstract sockets need no filesystem path, so the bridge reaches them from
+// inside the sandbox too (it doesn't unshare the network namespace).
+type mcpProxy struct {
+	exe     string // the daemon binary, run by the CLI as the bridge
+	servers map[string]*mcpServer
+	debug   bool
+}
+
+// mcpServer is the daemon side of one proxied server.
+type mcpServer struct {
+	name     string
+	address  string // abstract socket address, "@cowork-mcp-<random>"
+	listener *net.UnixListener
+	conn     net.Conn // the current bridge connection, if any
+	mu       sync.Mutex
+}
+
+// newMCPProxy rewrites the --mcp-config arguments in place, replacing every
+// "sdk" server with a bridge to a new socket. It returns nil if there are no
+// SDK servers. Configs given as file paths are left alone.
+func newMCPProxy(args []string, debug bool) (*mcpProxy, error) {
+	var mp *mcpProxy
+	for i, a := range args {
+		value, inline := strings.CutPrefix(a, "--mcp-config=")
+		if !inline {
+			if a != "--mcp-config" || i+1 >= len(args) {
+				continue
+			}
+			value = args[i+1]
+		}
+		if !strings.HasPrefix(strings.TrimSpace(value), "{") {
+			continue
+		}
+
+		if mp == nil {
+			exe, err := os.Executable()
+			if err != nil {
+				return nil, fmt.Errorf("locating daemon binary for MCP bridge: %w", err)
+			}
+			mp = &mcpProxy{exe: exe, servers: make(map[string]*mcpServer), debug: debug}
+		}
+		rewritten, err := mp.rewriteConfig(value)
+		if err != nil {
+			mp.close()
+			return nil, err
+		}
+		if inline {
+			args[i] = "--mcp-config=" + rewritten
+		} else {
+			args[i+1] = rewritten
+		}
+	}
+	if mp != nil && len(mp.servers) == 0 {
+		return nil, nil
+	}
+	return mp, nil
+}
+
+// rewriteConfig replaces the SDK servers in one --mcp-config JSON value.
+func (mp *mcpProxy) rewriteConfig(value string) (string, error) {
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(value), &config); err != nil {
+		return "", fmt.Errorf("%w: parsing --mcp-config: %v", process.ErrInvalidParams, err)
+	}
+	var servers map[string]json.RawMessage
+	if raw, ok := config["mcpServers"]; ok {
+		if err := json.Unmarshal(raw, &servers); err != nil {
+			return "", fmt.Errorf("%w: parsing --mcp-config mcpServers: %v", process.ErrInvalidParams, err)
+		}
+	}
+
+	changed := false
+	for name, raw := range servers {
+		var server struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(raw, &server) != nil || server.Type != "sdk" {
+			continue
+		}
+		s, err := mp.listen(name)
+		if err != nil {
+			return "", err
+		}
+		bridge, _ := json.Marshal(map[string]interface{}{
+			"type":    "stdio",
+			"command": mp.exe,
+			"args":    []string{MCPBridgeArg, s.address},
+		})
+		servers[name] = bridge
+		changed = true
+		if mp.debug {
+			log.Printf("[native] proxying SDK MCP server %q via %s", name, s.address)
+		}
+	}
+	if !changed {
+		return value, nil
+	}
+	config["mcpServers"], _ = json.Marshal(servers)
+	out, err := json.Marshal(config)
+	return string(out), err
+}
+
+// listen creates the socket for one server.
+func (mp *mcpProxy) listen(name string) (*mcpServer, error) {
+	if _, ok := mp.servers[name]; ok {
+		return nil, fmt.Errorf("%w: MCP server %q configured twice", process.ErrInvalidParams, name)
+	}
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return nil, err
+	}
+	address := "@cowork-mcp-" + hex.EncodeToString(token[:])
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: address, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("listening for MCP server %q: %w", name, err)
+	}
+	s := &mcpServer{name: name, address: address, listener: ln}
+	mp.servers[name] = s
+	return s, nil
+}
+
+// names returns the proxied server names, sorted.
+func (mp *mcpProxy) names() []string {
+	if mp == nil {
+		return nil
+	}
+	names := make([]string, 0, len(mp.servers))
+	for name := range mp.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// start accepts bridge connections for the process with the given ID and
+// relays their messages as events.
+func (mp *mcpProxy) start(session string, processID string, emit func(session string, event interface{})) {
+	for _, s := range mp.servers {
+		go mp.serve(s, session, processID, emit)
+	}
+}
+
+// serve accepts bridge connections until the listener is closed. The CLI
+// may restart a server; a new connection replaces the previous one.
+func (mp *mcpProxy) serve(s *mcpServer, session string, processID string, emit func(session string, event interface{})) {
+	for {
+		conn, err := s.listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+		// Abstract sockets have no file permissions; only accept our own user.
+		if uid, err := peerUID(conn); err != nil || uid != os.Getuid() {
+			log.Printf("[native] %s: rejected MCP bridge connection for %q (uid=%d, err=%v)", processID, s.name, uid, err)
+			conn.Close()
+			continue
+		}
+
+		s.mu.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.conn = conn
+		s.mu.Unlock()
+		if mp.debug {
+			log.Printf("[native] %s: MCP server %q connected", processID, s.name)
+		}
+		go mp.relay(s, conn, session, processID, emit)
+	}
+}
+
+// relay emits every newline-delimited JSON-RPC message read from conn.
+func (mp *mcpProxy) relay(s *mcpServer, conn net.Conn, session string, processID string, emit func(session string, event interface{})) {
+	defer func() {
+		s.mu.Lock()
+		if s.conn == conn {
+			s.conn = nil
+		}
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReaderSize(conn, readBufferSize)
+	for {
+		line, err := r.ReadBytes('\n')
+		if msg := bytes.TrimSpace(line); len(msg) > 0 {
+			if json.Valid(msg) {
+				if mp.debug {
+					log.Printf("[native] %s: MCP %s → client: %s", processID, s.name, msg)
+				}
+				emit(session, process.NewMCPMessageEvent(processID, s.name, json.RawMessage(msg)))
+			} else {
+				log.Printf("[native] %s: dropping non-JSON message from MCP server %q", processID, s.name)
+			}
+		}
+		if err != nil {
+			if err != io.EOF && mp.debug {
+				log.Printf("[native] %s: MCP server %q read error: %v", processID, s.name, err)
+			}
+			return
+		}
+	}
+}
+
+// send writes one JSON-RPC message to a server's bridge.
+func (mp *mcpProxy) send(processID string, server string, message []byte) error {
+	var s *mcpServer
+	if mp != nil {
+		s = mp.servers[server]
+	}
+	if s == nil {
+		return fmt.Errorf("%w: process %s has no SDK MCP server %q", process.ErrInvalidParams, processID, server)
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, message); err != nil {
+		return fmt.Errorf("%w: message is not valid JSON: %v", process.ErrInvalidParams, err)
+	}
+	buf.WriteByte('\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return fmt.Errorf("%w: MCP server %q of process %s is not connected", process.ErrBackendUnavailable, server, processID)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(mcpWriteTimeout))
+	if _, err := s.conn.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("writing to MCP server %q: %w", server, err)
+	}
+	return nil
+}
+
+// close stops accepting connections and closes open ones.
+func (mp *mcpProxy) close() {
+	if mp == nil {
+		return
+	}
+	for _, s := range mp.servers {
+		s.listener.Close()
+		s.mu.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// peerUID returns the uid of the process on the other end of conn.
+func peerUID(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return -1, err
+	}
+	if credErr != nil {
+		return -1, credErr
+	}
+	return int(cred.Uid), nil
+}
+
+// RunMCPBridge is the entry point of the bridge the CLI starts for a proxied
+// SDK MCP server. It is invoked as "<daemon> __mcp-bridge <address>" and
+// copies stdin to the daemon's socket and the socket to stdout until either
+// side closes.
+func RunMCPBridge(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s <address>\n", MCPBridgeArg)
+		os.Exit(2)
+	}
+	conn, err := net.Dial("unix", args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cowork mcp bridge: %v\n", err)
+		os.Exit(1)
+	}
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.(*net.UnixConn).CloseWrite()
+	}()
+	io.Copy(os.Stdout, conn)
+}
@@ -0,0 +1,116 @@
+package native
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/patrickjaja/claude-cowork-service/process"
+)
+
+// TestMain lets the test binary act as the MCP bridge, as the daemon binary
+// does: the rewritten --mcp-config runs os.Executable().
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == MCPBridgeArg {
+		RunMCPBridge(os.Args[2:])
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// stdioServer is an --mcp-config stdio server entry.
+type stdioServer struct {
+	Type    string   `json:"type"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+func TestMCPBridgeRoundTrip(t *testing.T) {
+	args := []string{"-p", "--mcp-config", `{"mcpServers": {
+		"tools": {"type": "sdk", "name": "tools"},
+		"fs": {"type": "stdio", "command": "fs-server"}
+	}}`}
+	mp, err := newMCPProxy(args, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.close()
+	if names := mp.names(); !reflect.DeepEqual(names, []string{"tools"}) {
+		t.Fatalf("proxied servers = %v, want [tools]", names)
+	}
+
+	var config struct {
+		MCPServers map[string]stdioServer `json:"mcpServers"`
+	}
+	if err := json.Unmarshal([]byte(args[2]), &config); err != nil {
+		t.Fatalf("rewritten config %s: %v", args[2], err)
+	}
+	if fs := config.MCPServers["fs"]; fs.Command != "fs-server" {
+		t.Errorf("non-SDK server rewritten: %+v", fs)
+	}
+	bridge := config.MCPServers["tools"]
+	if bridge.Type != "stdio" || len(bridge.Args) != 2 || bridge.Args[0] != MCPBridgeArg {
+		t.Fatalf("tools server = %+v, want a stdio bridge", bridge)
+	}
+
+	events := make(chan interface{}, 4)
+	mp.start("s", "p1", func(session string, event interface{}) {
+		if session != "s" {
+			t.Errorf("event for session %q", session)
+		}
+		events <- event
+	})
+
+	// Run the bridge the way the CLI starts a stdio server.
+	c := exec.Command(bridge.Command, bridge.Args...)
+	stdin, _ := c.StdinPipe()
+	stdout, _ := c.StdoutPipe()
+	c.Stderr = os.Stderr
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Process.Kill()
+
+	// CLI → client, as an mcpMessage event.
+	io.WriteString(stdin, `{"jsonrpc":"2.0","id":1,"method":"tools/list"}`+"\n")
+	select {
+	case event := <-events:
+		e, ok := event.(process.MCPMessageEvent)
+		if !ok || e.ProcessID != "p1" || e.Server != "tools" || string(e.Message) != `{"jsonrpc":"2.0","id":1,"method":"tools/list"}` {
+			t.Errorf("event = %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mcpMessage event from the bridge")
+	}
+
+	// Client → CLI, compacted to one line.
+	if err := mp.send("p1", "tools", []byte("{\n  \"jsonrpc\": \"2.0\",\n  \"id\": 1,\n  \"result\": {\"tools\": []}\n}")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading bridge stdout: %v", err)
+	}
+	if line != `{"jsonrpc":"2.0","id":1,"result":{"tools":[]}}`+"\n" {
+		t.Errorf("bridge wrote %q", line)
+	}
+
+	// The bridge exits once the CLI closes its stdin.
+	stdin.Close()
+	if err := c.Wait(); err != nil {
+		t.Errorf("bridge: %v", err)
+	}
+
+	if err := mp.send("p1", "other", []byte(`{}`)); !errors.Is(err, process.ErrInvalidParams) {
+		t.Errorf("send to an unknown server: %v, want ErrInvalidParams", err)
+	}
+	if err := mp.send("p1", "tools", []byte(`{"jsonrpc":`)); !errors.Is(err, process.ErrInvalidParams) {
+		t.Errorf("send of invalid JSON: %v, want ErrInvalidParams", err)
+	}
+}
@@ -0,0 +1,211 @@
+package native
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/patrickjaja/claude-cowork-service/process"
+)
+
+const (
+	// readBufferSize is the size of a single read from a process's output.
+	readBufferSize = 64 * 1024
+	// flushTimeout is how long a partial line (a prompt, a progress bar)
+	// waits for its newline before it is emitted anyway.
+	flushTimeout = 50 * time.Millisecond
+	// maxChunk caps a single event in chunk mode.
+	maxChunk = 64 * 1024
+	// maxLine caps a single event in line mode, leaving room for JSON
+	// escaping under the 10 MB message limit. Longer lines are emitted in
+	// pieces rather than failing the stream.
+	maxLine = 8 * 1024 * 1024
+)
+
+// streamOutput reads a process's stdout or stderr and emits events.
+//
+// In line mode (the claude CLI, whose stream-json the client parses one
+// event at a time) every complete line becomes one event, as before. In
+// chunk mode everything up to the last newline is emitted at once and a
+// trailing partial line is flushed after flushTimeout. In both modes
+// output is never lost: a line longer than the cap is split.
+func (pt *processTracker) streamOutput(lp *localProcess, r io.Reader, stream string) {
+	chunks := make(chan []byte)
+	var readErr error
+	go func() {
+		defer close(chunks)
+		buf := make([]byte, readBufferSize)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				chunks <- append([]byte(nil), buf[:n]...)
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+		}
+	}()
+
+	limit := maxChunk
+	if lp.lineMode {
+		limit = maxLine
+	}
+
+	timer := time.NewTimer(flushTimeout)
+	timer.Stop()
+	var pending []byte
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				timer.Stop()
+				if len(pending) > 0 {
+					pt.emitOutput(lp, stream, pending)
+				}
+				if readErr != nil {
+					log.Printf("[native] %s %s read error: %v", lp.id, stream, readErr)
+					pt.emit(lp.session, process.NewErrorEvent(lp.id, fmt.Sprintf("%s read error: %v", stream, readErr), false))
+				}
+				return
+			}
+			pending = append(pending, chunk...)
+			pending = pt.emitLines(lp, stream, pending)
+			for len(pending) >= limit {
+				if lp.lineMode {
+					log.Printf("[native] %s %s: line longer than %d bytes, emitting it in pieces", lp.id, stream, limit)
+				}
+				piece, rest := lp.splitOutput(pending[:limit])
+				pt.emitOutput(lp, stream, piece)
+				pending = append(rest, pending[limit:]...)
+			}
+			timer.Stop()
+			if len(pending) > 0 && !lp.lineMode {
+				timer.Reset(flushTimeout)
+			}
+		case <-timer.C:
+			var piece []byte
+			piece, pending = lp.splitOutput(pending)
+			if len(piece) > 0 {
+				pt.emitOutput(lp, stream, piece)
+			}
+		}
+	}
+}
+
+// emitLines emits the complete lines in buf and returns the remainder.
+func (pt *processTracker) emitLines(lp *localProcess, stream string, buf []byte) []byte {
+	if !lp.lineMode {
+		end := bytes.LastIndexByte(buf, '\n') + 1
+		if end > 0 {
+			pt.emitOutput(lp, stream, buf[:end])
+		}
+		return append([]byte(nil), buf[end:]...)
+	}
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			return append([]byte(nil), buf...)
+		}
+		pt.emitOutput(lp, stream, buf[:i+1])
+		buf = buf[i+1:]
+	}
+}
+
+// streamTerminal forwards raw chunks read from a terminal master as stdout
+// events. Unlike streamOutput it doesn't wait for newlines at all, so
+// prompts such as "Password: " reach the client immediately.
+func (pt *processTracker) streamTerminal(lp *localProcess, master *os.File) {
+	buf := make([]byte, readBufferSize)
+	var pending []byte // incomplete UTF-8 sequence held back from the last read
+	for {
+		n, err := master.Read(buf)
+		if n > 0 {
+			var chunk []byte
+			chunk, pending = lp.splitOutput(append(pending, buf[:n]...))
+			if len(chunk) > 0 {
+				pt.emitOutput(lp, "stdout", chunk)
+			}
+		}
+		if err != nil {
+			// EIO just means every process closed the terminal.
+			if !errors.Is(err, syscall.EIO) && !errors.Is(err, io.EOF) {
+				log.Printf("[native] %s pty read error: %v", lp.id, err)
+				pt.emit(lp.session, process.NewErrorEvent(lp.id, fmt.Sprintf("pty read error: %v", err), false))
+			}
+			break
+		}
+	}
+	if len(pending) > 0 {
+		pt.emitOutput(lp, "stdout", pending)
+	}
+}
+
+// emitOutput sends one piece of output as a stdout or stderr event.
+// Claude Code sends its stream-json output on stderr, so in merge mode both
+// streams are emitted as "stdout" events — that's what the client reads.
+func (pt *processTracker) emitOutput(lp *localProcess, stream string, data []byte) {
+	// Remap real paths back to VM paths in output (only if VM path exists)
+	if lp.reverseMap {
+		data = bytes.ReplaceAll(data, lp.realPrefix, lp.vmPrefix)
+	}
+
+	if pt.debug {
+		line := string(data)
+		truncated := line
+		maxLen := 2000
+		if len(truncated) > maxLen {
+			truncated = truncated[:maxLen] + "...[TRUNCATED]"
+		}
+		// Highlight skill-related messages
+		if strings.Contains(strings.ToLower(line), "skill") || strings.Contains(line, "Unknown") {
+			log.Printf("[native] !!SKILL!! %s %s: %s", lp.id, stream, truncated)
+		} else {
+			log.Printf("[native] %s %s: %s", lp.id, stream, truncated)
+		}
+	}
+
+	encoding, text := "", string(data)
+	if lp.encoding == process.EncodingBase64 {
+		encoding, text = process.EncodingBase64, base64.StdEncoding.EncodeToString(data)
+	}
+
+	if stream == "stderr" && !lp.mergeStderr {
+		event := process.NewStderrEvent(lp.id, text)
+		event.Encoding = encoding
+		pt.emit(lp.session, event)
+		return
+	}
+	event := process.NewStdoutEvent(lp.id, text)
+	event.Encoding = encoding
+	pt.emit(lp.session, event)
+}
+
+// splitOutput splits b into a piece that can be emitted now and a remainder
+// to hold back: with text encoding, a multi-byte character cut by a read
+// boundary is held back rather than mangled into U+FFFD. Base64 output can
+// be cut anywhere.
+func (lp *localProcess) splitOutput(b []byte) (piece []byte, rest []byte) {
+	if lp.encoding == process.EncodingBase64 {
+		return b, nil
+	}
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i], append([]byte(nil), b[i:]...)
+			}
+			break
+		}
+	}
+	return b, nil
+}
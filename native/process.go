@@ -1,7 +1,6 @@
 package native
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"io"
@@ -9,13 +8,14 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/patrickjaja/claude-cowork-service/process"
+	"github.com/patrickjaja/claude-cowork-service/sandbox"
 )
 
 // pathRemap represents a from→to byte replacement for path remapping.
@@ -26,36 +26,105 @@ type pathRemap struct {
 
 // localProcess tracks a single spawned host process.
 type localProcess struct {
-	id         string
-	cmd        *exec.Cmd
-	stdin      io.WriteCloser
-	done       chan struct{}
-	mu         sync.Mutex
-	vmPrefix   []byte // e.g. "/sessions/optimistic-nice-brahmagupta"
-	realPrefix []byte // e.g. "/home/user/.local/share/claude-cowork/sessions/optimistic-nice-brahmagupta"
-	reverseMap bool   // only reverse-map output if VM path exists on filesystem
-	mountRemap []pathRemap // remap session/mnt/<mount> paths to real mount targets
+	id          string
+	session     string // VM/session name the process was spawned for
+	cmd         *exec.Cmd
+	command     string   // resolved command, before any sandbox wrapping
+	args        []string // arguments as passed to command
+	cwd         string
+	startedAt   time.Time
+	stdin       io.WriteCloser
+	done        chan struct{}
+	mu          sync.Mutex
+	vmPrefix    []byte         // e.g. "/sessions/optimistic-nice-brahmagupta"
+	realPrefix  []byte         // e.g. "/home/user/.local/share/claude-cowork/sessions/optimistic-nice-brahmagupta"
+	reverseMap  bool           // only reverse-map output if VM path exists on filesystem
+	stdinRW     *stdinRewriter // rewrites stream-json written to stdin
+	mcp         *mcpProxy      // proxied SDK MCP servers, nil if none
+	pty         *os.File       // terminal master for PTY-mode processes, nil otherwise
+	cgroup      string         // per-process cgroup, if cgroup limits are enabled
+	exitedAt    time.Time      // set just before done is closed
+	exitCode    int            // valid once done is closed
+	exitSignal  string         // valid once done is closed
+	mergeStderr bool           // emit stderr as stdout events
+	lineMode    bool           // one event per complete line (see streamOutput)
+	encoding    string         // process.EncodingText or process.EncodingBase64
+}
+
+// spawnOptions describes a process for processTracker.spawn.
+type spawnOptions struct {
+	session    string // VM/session name the process belongs to
+	id         string // client-chosen process ID; generated if empty
+	cmd        string
+	args       []string
+	env        map[string]string
+	cwd        string
+	vmPrefix   string          // VM session path, remapped to realPrefix in stdin
+	realPrefix string          // real host session path
+	mountRemap []pathRemap     // session/mnt/<mount> → real mount target remaps
+	skills     *skillMap       // translates UI skill commands written to stdin
+	mcp        *mcpProxy       // SDK MCP servers proxied for the process, if any
+	sandbox    *sandbox.Config // run inside user/mount namespaces if set
+	cgroup     string          // session cgroup to start the process under, if any
+	pty        bool            // run on a pseudo-terminal instead of pipes
+	rows, cols int             // initial terminal size in PTY mode
+	stderr     string          // process.StderrMerge or process.StderrSeparate
+	encoding   string          // output encoding, process.EncodingText if empty
 }
 
 // processTracker manages all spawned processes and streams their output via event callbacks.
 type processTracker struct {
 	processes map[string]*localProcess
 	nextID    int
-	emit      func(event interface{})
+	emit      func(session string, event interface{})
+	cgroups   *cgroupManager
+	grace     time.Duration   // SIGTERM → SIGKILL delay in terminate
+	retention time.Duration   // how long exited processes stay queryable
+	limit     int             // max tracked processes, running or retained
+	starting  map[string]bool // IDs of spawns past reserve but not yet tracked
+	quit      chan struct{}   // stops sweepLoop
 	debug     bool
 	mu        sync.RWMutex
 }
 
-func newProcessTracker(emit func(event interface{}), debug bool) *processTracker {
-	return &processTracker{
+// defaultGracePeriod is how long terminate waits after SIGTERM.
+const defaultGracePeriod = 10 * time.Second
+
+// Defaults for the process table; see SetProcessRetention.
+const (
+	defaultRetention    = 10 * time.Minute
+	defaultProcessLimit = 512
+)
+
+// sweepInterval is how often exited processes past the retention window are
+// removed from the process table when no spawn or lookup does it first.
+const sweepInterval = time.Minute
+
+// killWait bounds how long terminate waits for a process after SIGKILL,
+// e.g. one stuck in uninterruptible sleep.
+const killWait = 5 * time.Second
+
+func newProcessTracker(emit func(session string, event interface{}), cgroups *cgroupManager, debug bool) *processTracker {
+	pt := &processTracker{
 		processes: make(map[string]*localProcess),
 		emit:      emit,
+		cgroups:   cgroups,
+		grace:     defaultGracePeriod,
+		retention: defaultRetention,
+		limit:     defaultProcessLimit,
+		starting:  make(map[string]bool),
+		quit:      make(chan struct{}),
 		debug:     debug,
 	}
+	go pt.sweepLoop()
+	return pt
 }
 
 // spawn starts a new process and streams its stdout/stderr via events.
-func (pt *processTracker) spawn(id string, cmd string, args []string, env map[string]string, cwd string, vmPrefix string, realPrefix string, mountRemap []pathRemap) (string, error) {
+func (pt *processTracker) spawn(opts spawnOptions) (string, error) {
+	session, id, cmd, args, env, cwd := opts.session, opts.id, opts.cmd, opts.args, opts.env, opts.cwd
+	vmPrefix, realPrefix := opts.vmPrefix, opts.realPrefix
+
 	if id == "" {
 		pt.mu.Lock()
 		pt.nextID++
@@ -63,6 +132,16 @@ func (pt *processTracker) spawn(id string, cmd string, args []string, env map[st
 		pt.mu.Unlock()
 	}
 
+	if err := pt.reserve(id); err != nil {
+		return "", err
+	}
+	tracked := false
+	defer func() {
+		if !tracked {
+			pt.release(id)
+		}
+	}()
+
 	// If the given path doesn't exist, try to find it in PATH
 	if _, err := os.Stat(cmd); err != nil {
 		if resolved, lookErr := exec.LookPath(filepath.Base(cmd)); lookErr == nil {
@@ -100,9 +179,37 @@ func (pt *processTracker) spawn(id string, cmd string, args []string, env map[st
 		}
 	}
 
-	c := exec.Command(cmd, args...)
-	if cwd != "" {
-		c.Dir = cwd
+	var c *exec.Cmd
+	cleanup := func() {}
+	if opts.sandbox != nil {
+		cfg := *opts.sandbox
+		cfg.Cwd = cwd
+		cfg.ReadOnlyPaths = append(cfg.ReadOnlyPaths, commandPaths(cmd, cfg.Home)...)
+		if opts.mcp != nil {
+			// The CLI runs the daemon binary as the MCP bridge.
+			cfg.ReadOnlyPaths = append(cfg.ReadOnlyPaths, commandPaths(opts.mcp.exe, cfg.Home)...)
+		}
+		var err error
+		c, cleanup, err = sandbox.Command(cfg, cmd, args)
+		if err != nil {
+			return "", fmt.Errorf("preparing sandbox: %w", err)
+		}
+		if pt.debug {
+			log.Printf("[native] sandboxing %s (session=%s, mounts=%d, ro=%v)", id, cfg.Session, len(cfg.Mounts), cfg.ReadOnlyPaths)
+		}
+	} else {
+		c = exec.Command(cmd, args...)
+		if cwd != "" {
+			c.Dir = cwd
+		}
+	}
+	if opts.pty {
+		if _, ok := env["TERM"]; !ok {
+			if env == nil {
+				env = make(map[string]string)
+			}
+			env["TERM"] = "xterm-256color"
+		}
 	}
 	if len(env) > 0 {
 		// Start with current environment and overlay requested vars
@@ -129,38 +236,140 @@ func (pt *processTracker) spawn(id string, cmd string, args []string, env map[st
 	}
 
 	// Set up process group so we can kill children too
-	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-
-	stdin, err := c.StdinPipe()
-	if err != nil {
-		return "", fmt.Errorf("creating stdin pipe: %w", err)
+	// (sandbox.Command already configures this along with the namespaces).
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	}
 
-	stdout, err := c.StdoutPipe()
-	if err != nil {
-		return "", fmt.Errorf("creating stdout pipe: %w", err)
+	var (
+		stdin          io.WriteCloser
+		stdout, stderr io.ReadCloser
+		master         *os.File
+		err            error
+	)
+	if opts.pty {
+		var slave *os.File
+		master, slave, err = openPTY()
+		if err != nil {
+			cleanup()
+			return "", err
+		}
+		rows, cols := opts.rows, opts.cols
+		if rows <= 0 || cols <= 0 {
+			rows, cols = defaultRows, defaultCols
+		}
+		if err := setWinsize(master, rows, cols); err != nil {
+			master.Close()
+			slave.Close()
+			cleanup()
+			return "", fmt.Errorf("setting terminal size: %w", err)
+		}
+		c.Stdin, c.Stdout, c.Stderr = slave, slave, slave
+
+		// Start a new session with the terminal as its controlling tty. The
+		// session leader's process group doubles as the group kill targets.
+		c.SysProcAttr.Setpgid = false
+		c.SysProcAttr.Setsid = true
+		c.SysProcAttr.Setctty = true
+		c.SysProcAttr.Ctty = 0
+
+		// The parent only keeps the master; the slave is closed once the
+		// child has it, so reads hit EIO when the last user goes away.
+		sandboxCleanup := cleanup
+		cleanup = func() {
+			sandboxCleanup()
+			slave.Close()
+			master.Close()
+		}
+		stdin = master
+	} else {
+		stdin, err = c.StdinPipe()
+		if err != nil {
+			cleanup()
+			return "", fmt.Errorf("creating stdin pipe: %w", err)
+		}
+
+		stdout, err = c.StdoutPipe()
+		if err != nil {
+			cleanup()
+			return "", fmt.Errorf("creating stdout pipe: %w", err)
+		}
+
+		stderr, err = c.StderrPipe()
+		if err != nil {
+			cleanup()
+			return "", fmt.Errorf("creating stderr pipe: %w", err)
+		}
 	}
 
-	stderr, err := c.StderrPipe()
-	if err != nil {
-		return "", fmt.Errorf("creating stderr pipe: %w", err)
+	// Each process gets its own leaf cgroup so OOM kills can be attributed
+	// to it (see cgroupManager).
+	procCgroup := ""
+	afterStart := func(int) {}
+	if opts.cgroup != "" && pt.cgroups != nil {
+		procCgroup = pt.cgroups.processCgroup(opts.cgroup, id)
+	}
+	if procCgroup != "" {
+		afterStart, err = pt.cgroups.attach(c.SysProcAttr, procCgroup)
+		if err != nil {
+			pt.cgroups.removeProcess(procCgroup)
+			cleanup()
+			return "", err
+		}
 	}
 
 	if err := c.Start(); err != nil {
-		pt.emit(process.NewErrorEvent(id, fmt.Sprintf("failed to start process: %v", err), true))
+		afterStart(0)
+		if procCgroup != "" {
+			pt.cgroups.removeProcess(procCgroup)
+		}
+		cleanup()
+		pt.emit(session, process.NewErrorEvent(id, fmt.Sprintf("failed to start process: %v", err), true))
 		return "", fmt.Errorf("starting process: %w", err)
 	}
+	afterStart(c.Process.Pid)
+	if opts.pty {
+		c.Stdin.(*os.File).Close()
+	}
 
 	lp := &localProcess{
-		id:         id,
-		cmd:        c,
-		stdin:      stdin,
-		done:       make(chan struct{}),
-		mountRemap: mountRemap,
+		id:        id,
+		session:   session,
+		cmd:       c,
+		command:   cmd,
+		args:      args,
+		cwd:       cwd,
+		startedAt: time.Now(),
+		stdin:     stdin,
+		done:      make(chan struct{}),
+		stdinRW: &stdinRewriter{
+			remaps: opts.mountRemap,
+			skills: opts.skills,
+			onSkill: func(skill string, resolved string) {
+				if resolved == "" {
+					log.Printf("[native] %s: unresolved skill %q", id, skill)
+					_, bare, _ := strings.Cut(skill, ":")
+					pt.emit(session, process.NewErrorEvent(id, fmt.Sprintf("skill %q is not provided by any --plugin-dir plugin; passing it on as /%s", skill, bare), false))
+				} else if pt.debug {
+					log.Printf("[native] %s: skill %s → %s", id, skill, resolved)
+				}
+			},
+		},
+		mcp:         opts.mcp,
+		pty:         master,
+		cgroup:      procCgroup,
+		mergeStderr: opts.stderr == process.StderrMerge,
+		// Merged output is the claude CLI's stream-json, which the
+		// client expects one line per event.
+		lineMode: opts.stderr == process.StderrMerge,
+		encoding: opts.encoding,
 	}
 	if vmPrefix != "" && realPrefix != "" {
 		lp.vmPrefix = []byte(vmPrefix)
 		lp.realPrefix = []byte(realPrefix)
+		// VM paths map to real paths first; mount remaps then apply to the
+		// resulting <realPrefix>/mnt/<mount> paths.
+		lp.stdinRW.remaps = append([]pathRemap{{from: lp.vmPrefix, to: lp.realPrefix}}, lp.stdinRW.remaps...)
 		// Only reverse-map output if the VM path exists on the filesystem.
 		// Without root, /sessions/<name> can't be created, so reverse-mapping
 		// would produce paths the model can't access for tool calls.
@@ -173,7 +382,13 @@ func (pt *processTracker) spawn(id string, cmd string, args []string, env map[st
 
 	pt.mu.Lock()
 	pt.processes[id] = lp
+	delete(pt.starting, id)
 	pt.mu.Unlock()
+	tracked = true
+
+	if lp.mcp != nil {
+		lp.mcp.start(session, id, pt.emit)
+	}
 
 	if pt.debug {
 		log.Printf("[native] spawned %s: %s %v (pid=%d)", id, cmd, args, c.Process.Pid)
@@ -188,22 +403,36 @@ func (pt *processTracker) spawn(id string, cmd string, args []string, env map[st
 
 	// Stream stdout/stderr in goroutines
 	var wg sync.WaitGroup
-	wg.Add(2)
+	if master != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pt.streamTerminal(lp, master)
+		}()
+	} else {
+		wg.Add(2)
 
-	go func() {
-		defer wg.Done()
-		pt.streamOutput(id, stdout, "stdout")
-	}()
+		go func() {
+			defer wg.Done()
+			pt.streamOutput(lp, stdout, "stdout")
+		}()
 
-	go func() {
-		defer wg.Done()
-		pt.streamOutput(id, stderr, "stderr")
-	}()
+		go func() {
+			defer wg.Done()
+			pt.streamOutput(lp, stderr, "stderr")
+		}()
+	}
 
 	// Wait for process exit in background
 	go func() {
 		wg.Wait() // wait for output streams to drain first
 		err := c.Wait()
+		var sandboxSig syscall.Signal
+		if opts.sandbox != nil {
+			sandboxSig = sandbox.ExitSignal(c)
+		}
+		cleanup()
+		lp.mcp.close()
 		code := 0
 		sig := ""
 		if err != nil {
@@ -217,93 +446,170 @@ func (pt *processTracker) spawn(id string, cmd string, args []string, env map[st
 				code = -1
 			}
 		}
+		// The sandbox helper exits with 128+signal when the command is killed.
+		if sandboxSig != 0 {
+			code, sig = -1, signalName(sandboxSig)
+		}
 
-		if pt.debug {
+		// Count OOM kills anywhere in the process tree, not just the
+		// direct child: a killed compiler can still let the CLI exit 1.
+		oomKills := 0
+		if procCgroup != "" {
+			oomKills = pt.cgroups.oomKills(procCgroup)
+			pt.cgroups.removeProcess(procCgroup)
+		}
+
+		if pt.debug || oomKills > 0 {
 			if sig != "" {
-				log.Printf("[native] %s exited with code %d (signal=%s)", id, code, sig)
+				log.Printf("[native] %s exited with code %d (signal=%s, oomKills=%d)", id, code, sig, oomKills)
 			} else {
-				log.Printf("[native] %s exited with code %d", id, code)
+				log.Printf("[native] %s exited with code %d (oomKills=%d)", id, code, oomKills)
 			}
 		}
 
+		var event process.ExitEvent
 		if sig != "" {
-			pt.emit(process.NewExitEventWithSignal(id, code, sig))
+			event = process.NewExitEventWithSignal(id, code, sig)
 		} else {
-			pt.emit(process.NewExitEvent(id, code))
+			event = process.NewExitEvent(id, code)
 		}
+		event.OOMKillCount = oomKills
+		pt.emit(session, event)
+		lp.exitCode = code
+		lp.exitSignal = sig
+		lp.exitedAt = time.Now()
 		close(lp.done)
 	}()
 
 	return id, nil
 }
 
-// streamOutput reads lines from a reader and emits events.
-// Claude Code sends its stream-json output on stderr, so we emit both
-// stdout and stderr data as "stdout" events — that's what the client reads.
-func (pt *processTracker) streamOutput(id string, r io.Reader, stream string) {
-	// Look up process for reverse path mapping
-	pt.mu.RLock()
-	lp := pt.processes[id]
-	pt.mu.RUnlock()
-
-	scanner := bufio.NewScanner(r)
-	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024) // 10MB max for large Opus stream-json lines
-	for scanner.Scan() {
-		line := scanner.Text() + "\n"
+// commandPaths returns the directories a sandboxed command needs from inside
+// the hidden home directory: the one holding cmd and, if cmd is a symlink
+// (e.g. ~/.local/bin/claude → ~/.local/share/claude/versions/x), the one
+// holding its target. Paths outside home are already visible.
+func commandPaths(cmd string, home string) []string {
+	if home == "" {
+		return nil
+	}
+	candidates := []string{filepath.Dir(cmd)}
+	if resolved, err := filepath.EvalSymlinks(cmd); err == nil {
+		candidates = append(candidates, filepath.Dir(resolved))
+	}
 
-		// Remap real paths back to VM paths in output (only if VM path exists)
-		if lp != nil && lp.reverseMap {
-			line = string(bytes.ReplaceAll([]byte(line), lp.realPrefix, lp.vmPrefix))
-		}
-		if pt.debug {
-			truncated := line
-			maxLen := 2000
-			if len(truncated) > maxLen {
-				truncated = truncated[:maxLen] + "...[TRUNCATED]"
-			}
-			// Highlight skill-related messages
-			if strings.Contains(strings.ToLower(line), "skill") || strings.Contains(line, "Unknown") {
-				log.Printf("[native] !!SKILL!! %s %s: %s", id, stream, truncated)
-			} else {
-				log.Printf("[native] %s %s: %s", id, stream, truncated)
-			}
+	var paths []string
+	for _, p := range candidates {
+		if strings.HasPrefix(p, home+"/") {
+			paths = append(paths, p)
 		}
+	}
+	return paths
+}
 
-		// Always emit as stdout — Claude Desktop only processes stdout events,
-		// and Claude Code writes its stream-json data to stderr.
-		pt.emit(process.NewStdoutEvent(id, line))
+// resize changes the terminal size of a PTY-mode process.
+func (pt *processTracker) resize(processID string, rows int, cols int) error {
+	lp, ok := pt.lookup(processID)
+
+	if !ok {
+		return processError(processID, fmt.Errorf("%w: %s", process.ErrProcessNotFound, processID))
 	}
-	if err := scanner.Err(); err != nil {
-		log.Printf("[native] %s %s scanner error: %v", id, stream, err)
-		pt.emit(process.NewErrorEvent(id, fmt.Sprintf("%s scanner error: %v", stream, err), false))
+	if lp.pty == nil {
+		return processError(processID, fmt.Errorf("%w: process %s has no terminal", process.ErrInvalidParams, processID))
 	}
+	select {
+	case <-lp.done:
+		return processError(processID, fmt.Errorf("%w: %s", process.ErrProcessExited, processID))
+	default:
+	}
+	return setWinsize(lp.pty, rows, cols)
 }
 
 // kill sends a signal to a process. If signal is empty, defaults to SIGTERM.
 func (pt *processTracker) kill(processID string, signal string) error {
-	pt.mu.RLock()
-	lp, ok := pt.processes[processID]
-	pt.mu.RUnlock()
+	lp, ok := pt.lookup(processID)
 
 	if !ok {
-		return fmt.Errorf("process %s not found", processID)
+		return processError(processID, fmt.Errorf("%w: %s", process.ErrProcessNotFound, processID))
 	}
 
 	if lp.cmd.Process == nil {
 		return nil
 	}
+	// Killing an exited process is a no-op; its process group ID may
+	// already belong to something else.
+	select {
+	case <-lp.done:
+		return nil
+	default:
+	}
 
 	sig := mapSignal(signal)
 
-	// Kill the entire process group
+	// On a terminal, job-control signals go to the foreground job, as if
+	// typed (Ctrl-C, Ctrl-\, Ctrl-Z), so a shell survives interrupting its
+	// current command.
+	if lp.pty != nil && isTerminalSignal(sig) {
+		if pgrp, err := foregroundPgrp(lp.pty); err == nil && pgrp > 0 {
+			syscall.Kill(-pgrp, sig)
+			return nil
+		}
+	}
+
+	signalGroup(lp, sig)
+	return nil
+}
+
+// signalGroup sends sig to the process's entire process group.
+func signalGroup(lp *localProcess, sig syscall.Signal) {
 	pgid, err := syscall.Getpgid(lp.cmd.Process.Pid)
 	if err == nil {
 		syscall.Kill(-pgid, sig)
 	} else {
 		lp.cmd.Process.Signal(sig)
 	}
+}
 
-	return nil
+// terminate stops a process: SIGTERM to its process group, then SIGKILL
+// once the grace period has passed. It returns when the process has exited
+// (or killWait after SIGKILL) and reports whether SIGKILL was needed.
+func (pt *processTracker) terminate(lp *localProcess) (forced bool) {
+	if lp.cmd.Process == nil {
+		return false
+	}
+	select {
+	case <-lp.done:
+		return false
+	default:
+	}
+
+	signalGroup(lp, syscall.SIGTERM)
+	timer := time.NewTimer(pt.grace)
+	defer timer.Stop()
+	select {
+	case <-lp.done:
+		return false
+	case <-timer.C:
+	}
+
+	log.Printf("[native] %s did not exit within %s of SIGTERM, sending SIGKILL", lp.id, pt.grace)
+	pt.emit(lp.session, process.NewErrorEvent(lp.id, fmt.Sprintf("process did not exit within %s of SIGTERM and was killed", pt.grace), false))
+	signalGroup(lp, syscall.SIGKILL)
+	// Also catch descendants that left the process group (setsid, daemons).
+	if lp.cgroup != "" {
+		pt.cgroups.kill(lp.cgroup)
+	}
+
+	select {
+	case <-lp.done:
+	case <-time.After(killWait):
+		log.Printf("[native] %s still running %s after SIGKILL", lp.id, killWait)
+	}
+	return true
+}
+
+// processError attaches the process ID to err as structured error data.
+func processError(processID string, err error) error {
+	return process.WithData(err, map[string]string{"id": processID})
 }
 
 // mapSignal maps a signal name string to a syscall.Signal.
@@ -322,11 +628,27 @@ func mapSignal(name string) syscall.Signal {
 		return syscall.SIGUSR1
 	case "USR2":
 		return syscall.SIGUSR2
+	case "TSTP":
+		return syscall.SIGTSTP
+	case "CONT":
+		return syscall.SIGCONT
+	case "WINCH":
+		return syscall.SIGWINCH
 	default:
 		return syscall.SIGTERM
 	}
 }
 
+// isTerminalSignal reports whether sig is one a terminal delivers to its
+// foreground job.
+func isTerminalSignal(sig syscall.Signal) bool {
+	switch sig {
+	case syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTSTP, syscall.SIGWINCH:
+		return true
+	}
+	return false
+}
+
 // signalName returns the name of a signal (e.g. "SIGTERM").
 func signalName(sig syscall.Signal) string {
 	switch sig {
@@ -350,6 +672,12 @@ func signalName(sig syscall.Signal) string {
 		return "SIGABRT"
 	case syscall.SIGSEGV:
 		return "SIGSEGV"
+	case syscall.SIGTSTP:
+		return "SIGTSTP"
+	case syscall.SIGCONT:
+		return "SIGCONT"
+	case syscall.SIGWINCH:
+		return "SIGWINCH"
 	default:
 		return fmt.Sprintf("SIG%d", int(sig))
 	}
@@ -357,45 +685,22 @@ func signalName(sig syscall.Signal) string {
 
 // writeStdin writes data to a process's stdin pipe with timeout and exit checks.
 func (pt *processTracker) writeStdin(processID string, data []byte) error {
-	pt.mu.RLock()
-	lp, ok := pt.processes[processID]
-	pt.mu.RUnlock()
+	lp, ok := pt.lookup(processID)
 
 	if !ok {
-		return fmt.Errorf("process %s not found", processID)
-	}
-
-	// Remap VM paths to real paths in stdin data
-	if lp.vmPrefix != nil {
-		data = bytes.ReplaceAll(data, lp.vmPrefix, lp.realPrefix)
-	}
-
-	// Remap session/mnt/<mount> paths to real mount targets.
-	// Glob doesn't follow directory symlinks, so the model must see
-	// the real target paths instead of symlinked mnt/ paths.
-	for _, rm := range lp.mountRemap {
-		data = bytes.ReplaceAll(data, rm.from, rm.to)
+		return processError(processID, fmt.Errorf("%w: %s", process.ErrProcessNotFound, processID))
 	}
 
-	// Strip plugin prefix from skill invocations in user messages.
-	// The Cowork UI sends "/document-skills:pdf ..." but the CLI expects
-	// just "/pdf ..." (bare skill name). The plugin prefix in the UI
-	// (from marketplace.json) doesn't match the CLI's plugin.json name,
-	// so we strip it to let the CLI resolve by userFacingName().
-	if bytes.Contains(data, []byte(`"content":"/`)) {
-		re := regexp.MustCompile(`"content":"/[a-zA-Z0-9_-]+:`)
-		if re.Match(data) {
-			if pt.debug {
-				log.Printf("[native] stripping skill plugin prefix from user message")
-			}
-			data = re.ReplaceAll(data, []byte(`"content":"/`))
-		}
-	}
+	// Remap VM paths to real paths and session/mnt/<mount> paths to real
+	// mount targets (Glob doesn't follow directory symlinks, so the model
+	// must see the real target paths), and translate skill commands to the
+	// CLI's plugin names. See stdinRewriter for which fields are touched.
+	data = lp.stdinRW.rewrite(data)
 
 	// Check if process already exited
 	select {
 	case <-lp.done:
-		return fmt.Errorf("process %s has exited", processID)
+		return processError(processID, fmt.Errorf("%w: %s", process.ErrProcessExited, processID))
 	default:
 	}
 
@@ -413,17 +718,233 @@ func (pt *processTracker) writeStdin(processID string, data []byte) error {
 	case res := <-ch:
 		return res.err
 	case <-lp.done:
-		return fmt.Errorf("process %s exited during write", processID)
+		return processError(processID, fmt.Errorf("%w during write: %s", process.ErrProcessExited, processID))
 	case <-time.After(10 * time.Second):
-		return fmt.Errorf("stdin write timeout for process %s", processID)
+		return processError(processID, fmt.Errorf("%w for process %s", process.ErrStdinTimeout, processID))
 	}
 }
 
-// isRunning checks if a tracked process is still running.
-func (pt *processTracker) isRunning(processID string) (bool, error) {
+// sendMCP writes a JSON-RPC message to one of a process's proxied SDK MCP
+// servers.
+func (pt *processTracker) sendMCP(processID string, server string, message []byte) error {
+	lp, ok := pt.lookup(processID)
+	if !ok {
+		return processError(processID, fmt.Errorf("%w: %s", process.ErrProcessNotFound, processID))
+	}
+	select {
+	case <-lp.done:
+		return processError(processID, fmt.Errorf("%w: %s", process.ErrProcessExited, processID))
+	default:
+	}
+	return lp.mcp.send(processID, server, message)
+}
+
+// lookup returns a tracked process. Exited processes are found until their
+// retention window has passed, after which they are dropped.
+func (pt *processTracker) lookup(processID string) (*localProcess, bool) {
 	pt.mu.RLock()
 	lp, ok := pt.processes[processID]
+	stale := ok && pt.expired(lp, time.Now())
 	pt.mu.RUnlock()
+	if !stale {
+		return lp, ok
+	}
+
+	pt.mu.Lock()
+	if pt.processes[processID] == lp {
+		delete(pt.processes, processID)
+	}
+	pt.mu.Unlock()
+	return nil, false
+}
+
+// expired reports whether lp exited longer than the retention window ago.
+// Caller must hold pt.mu.
+func (pt *processTracker) expired(lp *localProcess, now time.Time) bool {
+	select {
+	case <-lp.done:
+		return now.Sub(lp.exitedAt) >= pt.retention
+	default:
+		return false
+	}
+}
+
+// reserve claims a slot in the process table for a new spawn with the given
+// ID, pruning expired entries first. The ID must not belong to a running
+// process or another spawn in progress; an exited process with the same ID
+// is replaced. If the table is full, exited processes are evicted oldest
+// first, even inside their retention window; only running processes count
+// against the limit for good. Every successful reserve must be followed by
+// adding the process or by release.
+func (pt *processTracker) reserve(id string) error {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if lp, ok := pt.processes[id]; (ok && !exited(lp)) || pt.starting[id] {
+		return processError(id, fmt.Errorf("%w: process %s is already running", process.ErrInvalidParams, id))
+	}
+
+	pt.pruneLocked(time.Now())
+	var done []*localProcess
+	for _, lp := range pt.processes {
+		if exited(lp) {
+			done = append(done, lp)
+		}
+	}
+
+	if excess := len(pt.processes) + len(pt.starting) + 1 - pt.limit; excess > 0 {
+		sort.Slice(done, func(i, j int) bool { return done[i].exitedAt.Before(done[j].exitedAt) })
+		for _, lp := range done {
+			if excess == 0 {
+				break
+			}
+			delete(pt.processes, lp.id)
+			excess--
+		}
+		if excess > 0 {
+			return process.WithData(
+				fmt.Errorf("%w: limit of %d running processes reached", process.ErrTooManyProcesses, pt.limit),
+				map[string]int{"limit": pt.limit},
+			)
+		}
+	}
+	pt.starting[id] = true
+	return nil
+}
+
+// release gives back a slot claimed by reserve for a spawn that failed.
+func (pt *processTracker) release(id string) {
+	pt.mu.Lock()
+	delete(pt.starting, id)
+	pt.mu.Unlock()
+}
+
+// pruneLocked removes processes whose retention window has passed. Caller
+// must hold pt.mu.
+func (pt *processTracker) pruneLocked(now time.Time) {
+	for id, lp := range pt.processes {
+		if pt.expired(lp, now) {
+			delete(pt.processes, id)
+		}
+	}
+}
+
+// sweepLoop prunes the process table every sweepInterval, so exited
+// processes are garbage-collected even when nothing is spawned.
+func (pt *processTracker) sweepLoop() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pt.quit:
+			return
+		case now := <-ticker.C:
+			pt.mu.Lock()
+			pt.pruneLocked(now)
+			pt.mu.Unlock()
+		}
+	}
+}
+
+// close stops the periodic sweep. It may be called more than once.
+func (pt *processTracker) close() {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	select {
+	case <-pt.quit:
+	default:
+		close(pt.quit)
+	}
+}
+
+// exited reports whether lp has exited.
+func exited(lp *localProcess) bool {
+	select {
+	case <-lp.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// list describes the tracked processes of a session (all sessions if
+// session is "" or process.AllSessions), oldest first.
+func (pt *processTracker) list(session string) []process.Info {
+	now := time.Now()
+	pt.mu.RLock()
+	var procs []*localProcess
+	for _, lp := range pt.processes {
+		if pt.expired(lp, now) {
+			continue
+		}
+		if session == "" || session == process.AllSessions || lp.session == session {
+			procs = append(procs, lp)
+		}
+	}
+	pt.mu.RUnlock()
+
+	sort.Slice(procs, func(i, j int) bool { return procs[i].startedAt.Before(procs[j].startedAt) })
+	usage := readGroupUsage()
+	infos := make([]process.Info, 0, len(procs))
+	for _, lp := range procs {
+		infos = append(infos, lp.info(usage))
+	}
+	return infos
+}
+
+// info describes one tracked process.
+func (pt *processTracker) info(processID string) (process.Info, error) {
+	lp, ok := pt.lookup(processID)
+	if !ok {
+		return process.Info{}, processError(processID, fmt.Errorf("%w: %s", process.ErrProcessNotFound, processID))
+	}
+	return lp.info(readGroupUsage()), nil
+}
+
+// info builds the Info for lp. usage comes from readGroupUsage and
+// is only consulted while the process is running.
+func (lp *localProcess) info(usage map[int]*groupUsage) process.Info {
+	info := process.Info{
+		ID:        lp.id,
+		Name:      lp.session,
+		Command:   lp.command,
+		Args:      process.RedactArgs(lp.args),
+		Cwd:       lp.cwd,
+		PID:       lp.cmd.Process.Pid,
+		PTY:       lp.pty != nil,
+		State:     process.StateRunning,
+		StartedAt: lp.startedAt,
+	}
+
+	select {
+	case <-lp.done:
+		exitedAt, code := lp.exitedAt, lp.exitCode
+		info.State = process.StateExited
+		info.ExitedAt = &exitedAt
+		info.ExitCode = &code
+		info.Signal = lp.exitSignal
+		if ps := lp.cmd.ProcessState; ps != nil {
+			info.CPUSeconds = (ps.UserTime() + ps.SystemTime()).Seconds()
+			if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+				info.MemoryBytes = uint64(ru.Maxrss) * 1024 // Maxrss is in KiB
+			}
+		}
+	default:
+		// The child is its own process group leader (Setpgid or Setsid).
+		if g := usage[info.PID]; g != nil {
+			info.CPUSeconds = g.cpu.Seconds()
+			info.MemoryBytes = g.rss
+			if g.stopped {
+				info.State = process.StateStopped
+			}
+		}
+	}
+	return info
+}
+
+// isRunning checks if a tracked process is still running.
+func (pt *processTracker) isRunning(processID string) (bool, error) {
+	lp, ok := pt.lookup(processID)
 
 	if !ok {
 		return false, nil
@@ -437,16 +958,45 @@ func (pt *processTracker) isRunning(processID string) (bool, error) {
 	}
 }
 
-// killAll terminates all tracked processes.
-func (pt *processTracker) killAll() {
+// terminateAll terminates all tracked processes in parallel and waits for
+// them to exit. It returns the IDs of processes that had to be SIGKILLed.
+func (pt *processTracker) terminateAll() []string {
+	return pt.terminateWhere(func(*localProcess) bool { return true })
+}
+
+// terminateSession is terminateAll for the processes of one session.
+func (pt *processTracker) terminateSession(session string) []string {
+	return pt.terminateWhere(func(lp *localProcess) bool { return lp.session == session })
+}
+
+// terminateWhere terminates the tracked processes match selects.
+func (pt *processTracker) terminateWhere(match func(*localProcess) bool) []string {
 	pt.mu.RLock()
-	ids := make([]string, 0, len(pt.processes))
-	for id := range pt.processes {
-		ids = append(ids, id)
+	var procs []*localProcess
+	for _, lp := range pt.processes {
+		if match(lp) {
+			procs = append(procs, lp)
+		}
 	}
 	pt.mu.RUnlock()
 
-	for _, id := range ids {
-		pt.kill(id, "")
+	var (
+		forced []string
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+	)
+	for _, lp := range procs {
+		wg.Add(1)
+		go func(lp *localProcess) {
+			defer wg.Done()
+			if pt.terminate(lp) {
+				mu.Lock()
+				forced = append(forced, lp.id)
+				mu.Unlock()
+			}
+		}(lp)
 	}
+	wg.Wait()
+	sort.Strings(forced)
+	return forced
 }
@@ -0,0 +1,67 @@
+package native
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc/<pid>/stat. It is
+// 100 on every Linux architecture Go supports.
+const clockTicks = 100
+
+// groupUsage is the summed resource usage of one process group.
+type groupUsage struct {
+	cpu     time.Duration
+	rss     uint64
+	stopped bool // the group leader is stopped (state T)
+}
+
+// readGroupUsage scans /proc once and sums CPU time and resident memory per
+// process group. Processes that exit mid-scan are skipped.
+func readGroupUsage() map[int]*groupUsage {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	pageSize := uint64(os.Getpagesize())
+	groups := make(map[int]*groupUsage)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile("/proc/" + e.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// The command name (field 2) may contain spaces and parentheses;
+		// the remaining fields start after the last ')'.
+		end := strings.LastIndexByte(string(data), ')')
+		if end < 0 {
+			continue
+		}
+		fields := strings.Fields(string(data[end+1:]))
+		if len(fields) < 22 {
+			continue
+		}
+		// fields[i] is stat field i+3 (see proc(5)).
+		pgrp, _ := strconv.Atoi(fields[2])
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		rss, _ := strconv.ParseUint(fields[21], 10, 64)
+
+		g := groups[pgrp]
+		if g == nil {
+			g = &groupUsage{}
+			groups[pgrp] = g
+		}
+		g.cpu += time.Duration(utime+stime) * time.Second / clockTicks
+		g.rss += rss * pageSize
+		if pid == pgrp && (fields[0] == "T" || fields[0] == "t") {
+			g.stopped = true
+		}
+	}
+	return groups
+}
@@ -0,0 +1,74 @@
+package native
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Default terminal size when the client doesn't send one.
+const (
+	defaultRows = 24
+	defaultCols = 80
+)
+
+// winsize mirrors struct winsize from <sys/ioctl.h>.
+type winsize struct {
+	rows   uint16
+	cols   uint16
+	xpixel uint16
+	ypixel uint16
+}
+
+// openPTY allocates a pseudo-terminal pair from /dev/ptmx. The caller passes
+// slave to the child and closes its own copy once the child has started.
+func openPTY() (master *os.File, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening /dev/ptmx: %w", err)
+	}
+
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("unlocking pty: %w", err)
+	}
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("getting pty number: %w", err)
+	}
+
+	name := fmt.Sprintf("/dev/pts/%d", n)
+	slave, err = os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("opening %s: %w", name, err)
+	}
+	return master, slave, nil
+}
+
+// setWinsize sets the terminal size. The kernel sends SIGWINCH to the
+// terminal's foreground process group when it changes.
+func setWinsize(f *os.File, rows int, cols int) error {
+	ws := winsize{rows: uint16(rows), cols: uint16(cols)}
+	return ioctl(f.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+}
+
+// foregroundPgrp returns the terminal's foreground process group, i.e. the
+// job that would receive Ctrl-C.
+func foregroundPgrp(f *os.File) (int, error) {
+	var pgrp int32
+	if err := ioctl(f.Fd(), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp))); err != nil {
+		return 0, err
+	}
+	return int(pgrp), nil
+}
+
+func ioctl(fd uintptr, req uintptr, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package native
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// marketplaceSearchDepth is how many directories above a plugin directory are
+// searched for a marketplace.json that lists it.
+const marketplaceSearchDepth = 3
+
+// skillMap translates the skill commands Claude Desktop sends ("/<ui
+// plugin>:<skill>") into the names the CLI resolves ("/<cli plugin>:<skill>").
+//
+// The UI qualifies a skill with the plugin's name from marketplace.json,
+// while the CLI registers it under the name in the plugin's own plugin.json.
+// The two often differ, and a bare skill name can be provided by more than
+// one plugin, so the map is built from the manifests in the --plugin-dir
+// directories passed to the CLI.
+type skillMap struct {
+	// plugins maps a UI or CLI plugin name to the CLI plugin name.
+	plugins map[string]string
+	// skills maps a CLI plugin name to the skills and commands it provides.
+	skills map[string]map[string]bool
+	// owners maps a bare skill name to the CLI plugins providing it.
+	owners map[string][]string
+}
+
+// pluginManifest is the part of .claude-plugin/plugin.json we read.
+type pluginManifest struct {
+	Name string `json:"name"`
+}
+
+// marketplaceManifest is the part of .claude-plugin/marketplace.json we read.
+type marketplaceManifest struct {
+	Plugins []struct {
+		Name   string          `json:"name"`
+		Source json.RawMessage `json:"source"`
+	} `json:"plugins"`
+}
+
+// pluginDirArgs returns the directories passed to the CLI with --plugin-dir.
+func pluginDirArgs(args []string) []string {
+	var dirs []string
+	for i, a := range args {
+		if a == "--plugin-dir" && i+1 < len(args) {
+			dirs = append(dirs, args[i+1])
+		} else if dir, ok := strings.CutPrefix(a, "--plugin-dir="); ok {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// loadSkillMap reads the plugin and marketplace manifests of the given
+// plugin directories. Unreadable directories are logged and skipped.
+func loadSkillMap(dirs []string, debug bool) *skillMap {
+	sm := &skillMap{
+		plugins: make(map[string]string),
+		skills:  make(map[string]map[string]bool),
+		owners:  make(map[string][]string),
+	}
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			log.Printf("[native] plugin dir %s not readable, its skills won't be mapped", dir)
+			continue
+		}
+
+		// The CLI falls back to the directory name when plugin.json has none.
+		name := filepath.Base(dir)
+		var pm pluginManifest
+		if readManifest(filepath.Join(dir, ".claude-plugin", "plugin.json"), &pm) && pm.Name != "" {
+			name = pm.Name
+		}
+		if sm.skills[name] == nil {
+			sm.skills[name] = make(map[string]bool)
+		}
+		sm.plugins[name] = name
+		for _, skill := range pluginSkills(dir) {
+			if !sm.skills[name][skill] {
+				sm.skills[name][skill] = true
+				sm.owners[skill] = append(sm.owners[skill], name)
+			}
+		}
+		for _, alias := range marketplaceNames(dir) {
+			// A CLI name always wins over another plugin's marketplace alias.
+			if _, taken := sm.plugins[alias]; !taken {
+				sm.plugins[alias] = name
+			}
+		}
+		if debug {
+			log.Printf("[native] plugin %s (%s): %d skills", name, dir, len(sm.skills[name]))
+		}
+	}
+	return sm
+}
+
+// resolve translates a UI skill identifier "<plugin>:<skill>" into the name
+// the CLI resolves. It reports false if no loaded plugin provides the skill.
+func (sm *skillMap) resolve(id string) (string, bool) {
+	plugin, skill, ok := strings.Cut(id, ":")
+	if !ok || sm == nil {
+		return "", false
+	}
+	if name, ok := sm.plugins[plugin]; ok && sm.skills[name][skill] {
+		return name + ":" + skill, true
+	}
+	// Unknown plugin name: fall back to the bare skill name, but only when
+	// exactly one plugin provides it.
+	if owners := sm.owners[skill]; len(owners) == 1 {
+		return owners[0] + ":" + skill, true
+	}
+	return "", false
+}
+
+// pluginSkills lists the skills (skills/<dir>/SKILL.md) and commands
+// (commands/<name>.md) a plugin directory provides.
+func pluginSkills(dir string) []string {
+	var names []string
+	if entries, err := os.ReadDir(filepath.Join(dir, "skills")); err == nil {
+		for _, e := range entries {
+			skillFile := filepath.Join(dir, "skills", e.Name(), "SKILL.md")
+			if _, err := os.Stat(skillFile); err != nil {
+				continue
+			}
+			name := frontmatterName(skillFile)
+			if name == "" {
+				name = e.Name()
+			}
+			names = append(names, name)
+		}
+	}
+	if entries, err := os.ReadDir(filepath.Join(dir, "commands")); err == nil {
+		for _, e := range entries {
+			if !e.IsDir() && strings.HasSuffix(e.Name(), ".md") {
+				names = append(names, strings.TrimSuffix(e.Name(), ".md"))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// marketplaceNames returns the names under which marketplace.json files in
+// dir or its parents list the plugin at dir.
+func marketplaceNames(dir string) []string {
+	var names []string
+	root := dir
+	for i := 0; i <= marketplaceSearchDepth; i++ {
+		var mm marketplaceManifest
+		if readManifest(filepath.Join(root, ".claude-plugin", "marketplace.json"), &mm) {
+			for _, p := range mm.Plugins {
+				var source string
+				// Non-string sources (git, github) aren't local directories.
+				if json.Unmarshal(p.Source, &source) != nil || p.Name == "" {
+					continue
+				}
+				if filepath.Clean(filepath.Join(root, source)) == dir {
+					names = append(names, p.Name)
+				}
+			}
+		}
+		parent := filepath.Dir(root)
+		if parent == root {
+			break
+		}
+		root = parent
+	}
+	return names
+}
+
+// frontmatterName returns the name: field of a Markdown file's YAML
+// frontmatter, or "" if there is none.
+func frontmatterName(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "---" {
+		return ""
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "---" {
+			break
+		}
+		if value, ok := strings.CutPrefix(line, "name:"); ok {
+			return strings.Trim(strings.TrimSpace(value), `"'`)
+		}
+	}
+	return ""
+}
+
+// readManifest decodes the JSON file at path into v. It reports whether the
+// file existed and parsed.
+func readManifest(path string, v interface{}) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		log.Printf("[native] ignoring %s: %v", path, err)
+		return false
+	}
+	return true
+}
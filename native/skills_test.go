@@ -0,0 +1,137 @@
+package native
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFiles creates files under root from a path → content map.
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testMarketplace lays out a marketplace whose two plugins both provide a
+// "pdf" skill, and returns their plugin directories.
+func testMarketplace(t *testing.T) (docs string, office string) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		".claude-plugin/marketplace.json": `{"plugins": [
+			{"name": "document-skills", "source": "./plugins/docs"},
+			{"name": "office-suite", "source": "./plugins/office"},
+			{"name": "office", "source": "./plugins/docs"},
+			{"name": "remote", "source": {"source": "github", "repo": "x/y"}}
+		]}`,
+		"plugins/docs/.claude-plugin/plugin.json": `{"name": "doc-tools", "version": "1.0.0"}`,
+		"plugins/docs/skills/pdf/SKILL.md":        "---\nname: pdf\ndescription: PDFs\n---\n# PDF\n",
+		"plugins/docs/skills/word/SKILL.md":       "---\nname: \"docx\"\n---\n",
+		"plugins/docs/commands/summarize.md":      "Summarize.\n",
+		"plugins/docs/commands/notes.txt":         "not a command",
+		// No plugin.json: the CLI names the plugin after its directory.
+		"plugins/office/skills/pdf/SKILL.md":  "# no frontmatter\n",
+		"plugins/office/skills/xlsx/SKILL.md": "---\ndescription: sheets\n---\n",
+		"plugins/office/skills/draft/README":  "no SKILL.md, not a skill",
+	})
+	return filepath.Join(root, "plugins", "docs"), filepath.Join(root, "plugins", "office")
+}
+
+func TestLoadSkillMap(t *testing.T) {
+	docs, office := testMarketplace(t)
+	sm := loadSkillMap([]string{docs, office, filepath.Join(docs, "missing")}, false)
+
+	wantPlugins := map[string]string{
+		"doc-tools":       "doc-tools",
+		"document-skills": "doc-tools",
+		"office":          "office", // the CLI name wins over the docs alias
+		"office-suite":    "office",
+	}
+	if !reflect.DeepEqual(sm.plugins, wantPlugins) {
+		t.Errorf("plugins = %v, want %v", sm.plugins, wantPlugins)
+	}
+	wantSkills := map[string]map[string]bool{
+		"doc-tools": {"docx": true, "pdf": true, "summarize": true},
+		"office":    {"pdf": true, "xlsx": true},
+	}
+	if !reflect.DeepEqual(sm.skills, wantSkills) {
+		t.Errorf("skills = %v, want %v", sm.skills, wantSkills)
+	}
+	if got := sm.owners["pdf"]; !reflect.DeepEqual(got, []string{"doc-tools", "office"}) {
+		t.Errorf("owners of pdf = %v", got)
+	}
+}
+
+func TestSkillMapResolve(t *testing.T) {
+	docs, office := testMarketplace(t)
+	sm := loadSkillMap([]string{docs, office}, false)
+
+	tests := []struct {
+		id   string
+		want string // "" if unresolved
+	}{
+		{"document-skills:pdf", "doc-tools:pdf"},
+		{"office-suite:pdf", "office:pdf"},
+		{"office:pdf", "office:pdf"},
+		{"doc-tools:docx", "doc-tools:docx"},
+		{"doc-tools:word", ""}, // the frontmatter name replaces the directory name
+		{"document-skills:summarize", "doc-tools:summarize"},
+		{"other:xlsx", "office:xlsx"},           // unique bare name
+		{"document-skills:xlsx", "office:xlsx"}, // known plugin without it, unique bare name
+		{"other:pdf", ""},                       // provided by both plugins
+		{"remote:pdf", ""},                      // non-local marketplace source
+		{"doc-tools:draft", ""},                 // directory without SKILL.md
+		{"notes", ""},                           // not plugin-qualified
+	}
+	for _, tt := range tests {
+		got, ok := sm.resolve(tt.id)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("resolve(%q) = %q, %v; want %q", tt.id, got, ok, tt.want)
+		}
+	}
+}
+
+func TestSkillMapDuplicateBareNames(t *testing.T) {
+	docs, office := testMarketplace(t)
+
+	// Stripping the plugin was ambiguous for pdf; the qualified name picks
+	// the plugin the user chose, whichever order the plugins load in.
+	for _, dirs := range [][]string{{docs, office}, {office, docs}} {
+		sm := loadSkillMap(dirs, false)
+		for id, want := range map[string]string{
+			"document-skills:pdf": "doc-tools:pdf",
+			"office-suite:pdf":    "office:pdf",
+		} {
+			if got, _ := sm.resolve(id); got != want {
+				t.Errorf("with %v, resolve(%q) = %q, want %q", dirs, id, got, want)
+			}
+		}
+	}
+}
+
+func TestPluginDirArgs(t *testing.T) {
+	args := []string{"-p", "--plugin-dir", "/a", "--plugin-dir=/b", "--model", "x", "--plugin-dir"}
+	if got := pluginDirArgs(args); !reflect.DeepEqual(got, []string{"/a", "/b"}) {
+		t.Errorf("pluginDirArgs = %v", got)
+	}
+}
+
+func TestReadManifestInvalidJSON(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "my-plugin")
+	writeFiles(t, dir, map[string]string{
+		".claude-plugin/plugin.json": `{"name": `,
+		"commands/go.md":             "Go.\n",
+	})
+	sm := loadSkillMap([]string{dir}, false)
+	if got, ok := sm.resolve("my-plugin:go"); !ok || got != "my-plugin:go" {
+		t.Errorf("resolve = %q, %v; want the directory name after a broken plugin.json", got, ok)
+	}
+}
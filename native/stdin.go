@@ -0,0 +1,262 @@
+package native
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// skillCommand matches a plugin-qualified slash command at the start of a
+// user message, e.g. "/document-skills:pdf".
+var skillCommand = regexp.MustCompile(`^/([a-zA-Z0-9_.-]+:[^\s/]+)`)
+
+// stdinRewriter rewrites the Claude stream-json messages Claude Desktop
+// writes to a process's stdin. Each line is decoded and only these fields
+// are touched:
+//
+//   - user message text (string content, "text" blocks and the text of
+//     "tool_result" blocks): VM paths are remapped wherever they appear, and
+//     a leading "/plugin:skill" command is translated through skills;
+//   - any other string value that is itself a VM path, e.g. a control
+//     response's file_path: remapped.
+//
+// Lines that aren't JSON objects fall back to remapping paths as in free
+// text. Unchanged lines are passed through byte for byte; rewritten ones are
+// re-encoded with their keys sorted.
+type stdinRewriter struct {
+	// remaps are applied in order, e.g. /sessions/<name> → the real session
+	// dir, then <session dir>/mnt/<mount> → the mount's real target.
+	remaps []pathRemap
+	// skills translates UI skill names into CLI ones.
+	skills *skillMap
+	// onSkill is called for every skill command with its translation, or
+	// "" if no plugin provides the skill.
+	onSkill func(id string, resolved string)
+}
+
+// rewrite rewrites every newline-terminated or trailing line in data.
+func (rw *stdinRewriter) rewrite(data []byte) []byte {
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	var out []byte
+	for _, line := range lines {
+		out = append(out, rw.rewriteLine(line)...)
+	}
+	return out
+}
+
+// rewriteLine rewrites a single line, keeping its line ending.
+func (rw *stdinRewriter) rewriteLine(line []byte) []byte {
+	body := bytes.TrimRight(line, "\r\n")
+	ending := line[len(body):]
+	if len(bytes.TrimSpace(body)) == 0 {
+		return line
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber() // keep large integers exact when re-encoding
+	var msg map[string]interface{}
+	if err := dec.Decode(&msg); err != nil || dec.More() {
+		return append(rw.rewriteRaw(body), ending...)
+	}
+
+	if !rw.rewriteMessage(msg) {
+		return line
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(msg); err != nil {
+		return append(rw.rewriteRaw(body), ending...)
+	}
+	return append(bytes.TrimRight(buf.Bytes(), "\n"), ending...)
+}
+
+// rewriteRaw is the fallback for input that isn't a stream-json message.
+// Paths are remapped as in free text.
+func (rw *stdinRewriter) rewriteRaw(data []byte) []byte {
+	return []byte(rw.remapText(string(data)))
+}
+
+// rewriteMessage rewrites msg in place and reports whether it changed.
+func (rw *stdinRewriter) rewriteMessage(msg map[string]interface{}) bool {
+	changed := false
+	if msg["type"] == "user" {
+		if m, ok := msg["message"].(map[string]interface{}); ok {
+			changed = rw.rewriteUserContent(m)
+		}
+	}
+	return rw.rewritePaths(msg) || changed
+}
+
+// rewriteUserContent handles the free text of a user message, whose
+// content is either a string or a list of content blocks.
+func (rw *stdinRewriter) rewriteUserContent(m map[string]interface{}) bool {
+	switch content := m["content"].(type) {
+	case string:
+		text := rw.mapSkill(rw.remapText(content))
+		m["content"] = text
+		return text != content
+	case []interface{}:
+		changed := false
+		first := true
+		for _, b := range content {
+			block, ok := b.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch block["type"] {
+			case "text":
+				text, _ := block["text"].(string)
+				newText := rw.remapText(text)
+				// Only the message's opening text can be a slash command.
+				if first {
+					newText = rw.mapSkill(newText)
+				}
+				first = false
+				if newText != text {
+					block["text"] = newText
+					changed = true
+				}
+			case "tool_result":
+				if rw.rewriteToolResult(block) {
+					changed = true
+				}
+			}
+		}
+		return changed
+	}
+	return false
+}
+
+// rewriteToolResult remaps paths in the text of a tool_result block.
+func (rw *stdinRewriter) rewriteToolResult(block map[string]interface{}) bool {
+	switch content := block["content"].(type) {
+	case string:
+		text := rw.remapText(content)
+		block["content"] = text
+		return text != content
+	case []interface{}:
+		changed := false
+		for _, b := range content {
+			inner, ok := b.(map[string]interface{})
+			if !ok || inner["type"] != "text" {
+				continue
+			}
+			text, _ := inner["text"].(string)
+			if newText := rw.remapText(text); newText != text {
+				inner["text"] = newText
+				changed = true
+			}
+		}
+		return changed
+	}
+	return false
+}
+
+// rewritePaths remaps every string value in v that is itself a VM path.
+func (rw *stdinRewriter) rewritePaths(v interface{}) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if s, ok := val.(string); ok {
+				if p, ok := rw.remapPath(s); ok {
+					v[k] = p
+					changed = true
+				}
+				continue
+			}
+			if rw.rewritePaths(val) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for i, val := range v {
+			if s, ok := val.(string); ok {
+				if p, ok := rw.remapPath(s); ok {
+					v[i] = p
+					changed = true
+				}
+				continue
+			}
+			if rw.rewritePaths(val) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// remapPath remaps s if it is a path under one of the remapped prefixes.
+func (rw *stdinRewriter) remapPath(s string) (string, bool) {
+	out := s
+	for _, rm := range rw.remaps {
+		from := string(rm.from)
+		if out == from || strings.HasPrefix(out, from+"/") {
+			out = string(rm.to) + out[len(from):]
+		}
+	}
+	return out, out != s
+}
+
+// remapText remaps VM paths appearing anywhere in free text. A prefix only
+// matches as a whole path component, so /sessions/a doesn't touch
+// /sessions/ab.
+func (rw *stdinRewriter) remapText(s string) string {
+	for _, rm := range rw.remaps {
+		s = replacePathPrefix(s, string(rm.from), string(rm.to))
+	}
+	return s
+}
+
+// mapSkill translates a leading "/plugin:skill" command into the name the
+// CLI resolves (see skillMap). Unresolved commands are passed on as the bare
+// "/skill", which the CLI can still resolve by itself when the client gave
+// no --plugin-dir.
+func (rw *stdinRewriter) mapSkill(text string) string {
+	m := skillCommand.FindStringSubmatchIndex(text)
+	if m == nil {
+		return text
+	}
+	id := text[m[2]:m[3]]
+	resolved, ok := rw.skills.resolve(id)
+	if rw.onSkill != nil {
+		rw.onSkill(id, resolved)
+	}
+	if !ok {
+		_, skill, _ := strings.Cut(id, ":")
+		return "/" + skill + text[m[1]:]
+	}
+	return "/" + resolved + text[m[1]:]
+}
+
+// replacePathPrefix replaces occurrences of the path from in s that end at
+// a path component boundary.
+func replacePathPrefix(s string, from string, to string) string {
+	if from == "" || !strings.Contains(s, from) {
+		return s
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, from)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end := i + len(from)
+		b.WriteString(s[:i])
+		if end == len(s) || !isPathNameByte(s[end]) {
+			b.WriteString(to)
+		} else {
+			b.WriteString(from)
+		}
+		s = s[end:]
+	}
+}
+
+// isPathNameByte reports whether c can continue a file name.
+func isPathNameByte(c byte) bool {
+	return c == '-' || c == '_' || c == '.' ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
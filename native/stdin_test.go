@@ -0,0 +1,214 @@
+package native
+
+import (
+	"testing"
+)
+
+// testRewriter maps /sessions/a to /real/a and its mount mnt/docs to
+// /home/u/docs, with two plugins that both provide a "pdf" skill.
+func testRewriter(onSkill func(id string, resolved string)) *stdinRewriter {
+	return &stdinRewriter{
+		remaps: []pathRemap{
+			{from: []byte("/sessions/a"), to: []byte("/real/a")},
+			{from: []byte("/real/a/mnt/docs"), to: []byte("/home/u/docs")},
+		},
+		skills: &skillMap{
+			plugins: map[string]string{
+				"document-skills": "doc-tools", // marketplace alias
+				"doc-tools":       "doc-tools",
+				"office":          "office",
+			},
+			skills: map[string]map[string]bool{
+				"doc-tools": {"pdf": true, "docx": true},
+				"office":    {"pdf": true, "xlsx": true},
+			},
+			owners: map[string][]string{
+				"pdf":  {"doc-tools", "office"},
+				"docx": {"doc-tools"},
+				"xlsx": {"office"},
+			},
+		},
+		onSkill: onSkill,
+	}
+}
+
+func TestStdinRewriterLines(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "string content",
+			in:   `{"type":"user","message":{"role":"user","content":"read /sessions/a/notes.md"}}` + "\n",
+			want: `{"message":{"content":"read /real/a/notes.md","role":"user"},"type":"user"}` + "\n",
+		},
+		{
+			name: "text blocks",
+			in:   `{"type":"user","message":{"role":"user","content":[{"type":"text","text":"see /sessions/a"},{"type":"image","source":{"data":"/sessions/a"}}]}}`,
+			// The image's data is not a text block, but it is a whole path.
+			want: `{"message":{"content":[{"text":"see /real/a","type":"text"},{"source":{"data":"/real/a"},"type":"image"}],"role":"user"},"type":"user"}`,
+		},
+		{
+			name: "tool_result string content",
+			in:   `{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":"wrote /sessions/a/out.txt"}]}}`,
+			want: `{"message":{"content":[{"content":"wrote /real/a/out.txt","tool_use_id":"t1","type":"tool_result"}],"role":"user"},"type":"user"}`,
+		},
+		{
+			name: "tool_result block content",
+			in:   `{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":[{"type":"text","text":"in /sessions/a/mnt/docs/x"}]}]}}`,
+			want: `{"message":{"content":[{"content":[{"text":"in /home/u/docs/x","type":"text"}],"tool_use_id":"t1","type":"tool_result"}],"role":"user"},"type":"user"}`,
+		},
+		{
+			name: "path-valued field outside a user message",
+			in:   `{"type":"control_response","response":{"file_path":"/sessions/a/mnt/docs/r.pdf","note":"not /sessions/a/x"}}`,
+			want: `{"response":{"file_path":"/home/u/docs/r.pdf","note":"not /sessions/a/x"},"type":"control_response"}`,
+		},
+		{
+			name: "prefix of a longer component",
+			in:   `{"type":"user","message":{"role":"user","content":"/sessions/ab and /sessions/a-b stay, /sessions/a/ moves"}}`,
+			want: `{"message":{"content":"/sessions/ab and /sessions/a-b stay, /real/a/ moves","role":"user"},"type":"user"}`,
+		},
+		{
+			name: "pasted content key is not a field",
+			in:   `{"type":"user","message":{"role":"user","content":"fix {\"content\":\"/x:y\"} please"}}`,
+			want: `{"type":"user","message":{"role":"user","content":"fix {\"content\":\"/x:y\"} please"}}`,
+		},
+		{
+			name: "pasted content key inside a tool_result",
+			in:   `{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":"{\"content\":\"/x:\"}"}]}}`,
+			want: `{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":"{\"content\":\"/x:\"}"}]}}`,
+		},
+		{
+			name: "escaped JSON",
+			in:   `{"type":"user","message":{"role":"user","content":"\u0022q\u0022 in \/sessions\/a\/q <b> & \u00e9"}}`,
+			want: `{"message":{"content":"\"q\" in /real/a/q <b> & é","role":"user"},"type":"user"}`,
+		},
+		{
+			name: "large numbers survive re-encoding",
+			in:   `{"type":"user","seq":12345678901234567890,"message":{"role":"user","content":"/sessions/a"}}`,
+			want: `{"message":{"content":"/real/a","role":"user"},"seq":12345678901234567890,"type":"user"}`,
+		},
+		{
+			name: "unchanged line passes through byte for byte",
+			in:   `{ "type": "user",  "message": {"role":"user","content":"hello"} }` + "\r\n",
+			want: `{ "type": "user",  "message": {"role":"user","content":"hello"} }` + "\r\n",
+		},
+		{
+			name: "non-JSON falls back to raw replacement",
+			in:   "cat /sessions/a/mnt/docs/x /sessions/ab\n",
+			want: "cat /home/u/docs/x /sessions/ab\n",
+		},
+		{
+			name: "truncated JSON falls back to raw replacement",
+			in:   `{"type":"user","message":{"content":"/sessions/a`,
+			want: `{"type":"user","message":{"content":"/real/a`,
+		},
+		{
+			name: "blank line",
+			in:   "  \n",
+			want: "  \n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := testRewriter(nil)
+			if got := string(rw.rewrite([]byte(tt.in))); got != tt.want {
+				t.Errorf("rewrite(%s)\n got %s\nwant %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// Rewritten lines are re-encoded from a decoded map, so their keys come out
+// sorted. That is fine for the CLI, which parses each line as JSON; lines
+// that need no change keep their exact bytes (see above).
+func TestStdinRewriterSortsKeysOfRewrittenLines(t *testing.T) {
+	in := `{"type":"user","session_id":"s","message":{"role":"user","content":"/sessions/a"},"parent_tool_use_id":null}`
+	want := `{"message":{"content":"/real/a","role":"user"},"parent_tool_use_id":null,"session_id":"s","type":"user"}`
+	if got := string(testRewriter(nil).rewrite([]byte(in))); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestStdinRewriterSkills(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		want     string
+		resolved string // reported to onSkill; "-" if not called
+	}{
+		{
+			name:     "marketplace alias",
+			in:       `{"type":"user","message":{"role":"user","content":"/document-skills:docx make a report"}}`,
+			want:     `{"message":{"content":"/doc-tools:docx make a report","role":"user"},"type":"user"}`,
+			resolved: "doc-tools:docx",
+		},
+		{
+			name:     "CLI name is kept",
+			in:       `{"type":"user","message":{"role":"user","content":"/office:pdf"}}`,
+			want:     `{"type":"user","message":{"role":"user","content":"/office:pdf"}}`,
+			resolved: "office:pdf",
+		},
+		{
+			name:     "unknown plugin with a unique skill",
+			in:       `{"type":"user","message":{"role":"user","content":[{"type":"text","text":"/sheets:xlsx /sessions/a/t.xlsx"}]}}`,
+			want:     `{"message":{"content":[{"text":"/office:xlsx /real/a/t.xlsx","type":"text"}],"role":"user"},"type":"user"}`,
+			resolved: "office:xlsx",
+		},
+		{
+			name:     "unknown plugin with an ambiguous skill falls back to the bare name",
+			in:       `{"type":"user","message":{"role":"user","content":"/other:pdf"}}`,
+			want:     `{"message":{"content":"/pdf","role":"user"},"type":"user"}`,
+			resolved: "",
+		},
+		{
+			name:     "skill nobody provides",
+			in:       `{"type":"user","message":{"role":"user","content":"/doc-tools:pptx make slides"}}`,
+			want:     `{"message":{"content":"/pptx make slides","role":"user"},"type":"user"}`,
+			resolved: "",
+		},
+		{
+			name:     "only the opening text block is a command",
+			in:       `{"type":"user","message":{"role":"user","content":[{"type":"text","text":"hi"},{"type":"text","text":"/document-skills:docx"}]}}`,
+			want:     `{"type":"user","message":{"role":"user","content":[{"type":"text","text":"hi"},{"type":"text","text":"/document-skills:docx"}]}}`,
+			resolved: "-",
+		},
+		{
+			name:     "not a user message",
+			in:       `{"type":"assistant","message":{"role":"assistant","content":"/document-skills:docx"}}`,
+			want:     `{"type":"assistant","message":{"role":"assistant","content":"/document-skills:docx"}}`,
+			resolved: "-",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved := "-"
+			rw := testRewriter(func(id string, r string) { resolved = r })
+			if got := string(rw.rewrite([]byte(tt.in))); got != tt.want {
+				t.Errorf("rewrite(%s)\n got %s\nwant %s", tt.in, got, tt.want)
+			}
+			if resolved != tt.resolved {
+				t.Errorf("onSkill got %q, want %q", resolved, tt.resolved)
+			}
+		})
+	}
+}
+
+func TestReplacePathPrefix(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"/sessions/a", "/real/a"},
+		{"/sessions/a/", "/real/a/"},
+		{"/sessions/ab", "/sessions/ab"},
+		{"/sessions/a.b /sessions/a_b", "/sessions/a.b /sessions/a_b"},
+		{"x=/sessions/a:/sessions/a/y", "x=/real/a:/real/a/y"},
+		{`"/sessions/a"`, `"/real/a"`},
+	}
+	for _, tt := range tests {
+		if got := replacePathPrefix(tt.s, "/sessions/a", "/real/a"); got != tt.want {
+			t.Errorf("replacePathPrefix(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package native
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// oauthTokenEnv is the variable the CLI reads an OAuth token from.
+const oauthTokenEnv = "CLAUDE_CODE_OAUTH_TOKEN"
+
+// credentialEnvs are the variables through which a client can pass its own
+// credentials. A stored token is only injected when none of them is set.
+var credentialEnvs = []string{oauthTokenEnv, "ANTHROPIC_API_KEY", "ANTHROPIC_AUTH_TOKEN"}
+
+// hasCredentials reports whether env already carries credentials.
+func hasCredentials(env map[string]string) bool {
+	for _, k := range credentialEnvs {
+		if env[k] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenStorage selects where approved OAuth tokens are kept besides memory.
+type TokenStorage int
+
+const (
+	// TokenStorageMemory keeps tokens in memory only; they are lost when
+	// the daemon restarts.
+	TokenStorageMemory TokenStorage = iota
+	// TokenStorageFile also writes them to a 0600 file in the data directory.
+	TokenStorageFile
+	// TokenStorageKeyring also stores them in the Secret Service keyring
+	// (via secret-tool from libsecret).
+	TokenStorageKeyring
+)
+
+// ParseTokenStorage parses "memory", "file" or "keyring".
+func ParseTokenStorage(s string) (TokenStorage, error) {
+	switch strings.ToLower(s) {
+	case "", "memory":
+		return TokenStorageMemory, nil
+	case "file":
+		return TokenStorageFile, nil
+	case "keyring":
+		return TokenStorageKeyring, nil
+	default:
+		return TokenStorageMemory, fmt.Errorf("unknown token storage %q (want memory, file or keyring)", s)
+	}
+}
+
+func (t TokenStorage) String() string {
+	switch t {
+	case TokenStorageFile:
+		return "file"
+	case TokenStorageKeyring:
+		return "keyring"
+	default:
+		return "memory"
+	}
+}
+
+// tokenStore holds the OAuth token approved for each session. A new token
+// for a session replaces the old one; stopVM wipes it.
+type tokenStore struct {
+	tokens  map[string]string // session name → token
+	persist tokenPersister    // nil with TokenStorageMemory
+	mu      sync.Mutex
+}
+
+// tokenPersister stores tokens outside the daemon's memory.
+type tokenPersister interface {
+	lookup(session string) (string, error) // "" if none is stored
+	store(session string, token string) error
+	clear(session string) error
+}
+
+func newTokenStore() *tokenStore {
+	return &tokenStore{tokens: make(map[string]string)}
+}
+
+// setStorage selects the persistent storage. It fails if the storage can't
+// be used.
+func (ts *tokenStore) setStorage(storage TokenStorage) error {
+	var persist tokenPersister
+	switch storage {
+	case TokenStorageFile:
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		persist = &fileTokens{path: filepath.Join(home, ".local", "share", "claude-cowork", "oauth-tokens.json")}
+	case TokenStorageKeyring:
+		if _, err := exec.LookPath("secret-tool"); err != nil {
+			return fmt.Errorf("keyring token storage needs secret-tool (libsecret): %w", err)
+		}
+		persist = keyringTokens{}
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.persist = persist
+	return nil
+}
+
+// set stores the token for a session, replacing any previous one.
+func (ts *tokenStore) set(session string, token string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.tokens[session] = token
+	if ts.persist != nil {
+		if err := ts.persist.store(session, token); err != nil {
+			return fmt.Errorf("persisting OAuth token: %w", err)
+		}
+	}
+	return nil
+}
+
+// get returns the token for a session, or "" if there is none.
+func (ts *tokenStore) get(session string) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if token, ok := ts.tokens[session]; ok || ts.persist == nil {
+		return token, nil
+	}
+	token, err := ts.persist.lookup(session)
+	if err != nil {
+		return "", fmt.Errorf("reading stored OAuth token: %w", err)
+	}
+	if token != "" {
+		ts.tokens[session] = token
+	}
+	return token, nil
+}
+
+// clear forgets the token for a session, including any persisted copy.
+func (ts *tokenStore) clear(session string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.tokens, session)
+	if ts.persist != nil {
+		if err := ts.persist.clear(session); err != nil {
+			return fmt.Errorf("removing stored OAuth token: %w", err)
+		}
+	}
+	return nil
+}
+
+// fileTokens keeps all sessions' tokens in one JSON object, readable only by
+// the owner. Callers serialize access through tokenStore.mu.
+type fileTokens struct {
+	path string
+}
+
+func (f *fileTokens) read() (map[string]string, error) {
+	tokens := make(map[string]string)
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", f.path, err)
+	}
+	return tokens, nil
+}
+
+// write replaces the file atomically, so a crash never leaves it truncated
+// or with looser permissions.
+func (f *fileTokens) write(tokens map[string]string) error {
+	if len(tokens) == 0 {
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".oauth-tokens-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func (f *fileTokens) lookup(session string) (string, error) {
+	tokens, err := f.read()
+	if err != nil {
+		return "", err
+	}
+	return tokens[session], nil
+}
+
+func (f *fileTokens) store(session string, token string) error {
+	tokens, err := f.read()
+	if err != nil {
+		return err
+	}
+	tokens[session] = token
+	return f.write(tokens)
+}
+
+func (f *fileTokens) clear(session string) error {
+	tokens, err := f.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := tokens[session]; !ok {
+		return nil
+	}
+	delete(tokens, session)
+	return f.write(tokens)
+}
+
+// keyringTokens stores one Secret Service item per session through
+// secret-tool. The token is passed on stdin, never on the command line.
+type keyringTokens struct{}
+
+func (keyringTokens) lookup(session string) (string, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", "claude-cowork", "session", session).Output()
+	if err != nil {
+		// secret-tool exits 1 without output when nothing matches.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) == 0 {
+			return "", nil
+		}
+		return "", secretToolError(err)
+	}
+	return string(bytes.TrimSpace(out)), nil
+}
+
+func (keyringTokens) store(session string, token string) error {
+	c := exec.Command("secret-tool", "store", "--label=Claude Cowork OAuth token ("+session+")",
+		"service", "claude-cowork", "session", session)
+	c.Stdin = strings.NewReader(token)
+	if _, err := c.Output(); err != nil {
+		return secretToolError(err)
+	}
+	return nil
+}
+
+func (keyringTokens) clear(session string) error {
+	if _, err := exec.Command("secret-tool", "clear", "service", "claude-cowork", "session", session).Output(); err != nil {
+		return secretToolError(err)
+	}
+	return nil
+}
+
+// secretToolError adds secret-tool's stderr to err.
+func secretToolError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return fmt.Errorf("secret-tool: %s", bytes.TrimSpace(exitErr.Stderr))
+	}
+	return fmt.Errorf("secret-tool: %w", err)
+}
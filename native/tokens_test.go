@@ -0,0 +1,145 @@
+package native
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseTokenStorage(t *testing.T) {
+	tests := []struct {
+		in   string
+		want TokenStorage
+		ok   bool
+	}{
+		{"", TokenStorageMemory, true},
+		{"memory", TokenStorageMemory, true},
+		{"file", TokenStorageFile, true},
+		{"File", TokenStorageFile, true},
+		{"KEYRING", TokenStorageKeyring, true},
+		{"disk", TokenStorageMemory, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseTokenStorage(tt.in)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("ParseTokenStorage(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+		if tt.ok {
+			if back, _ := ParseTokenStorage(got.String()); back != got {
+				t.Errorf("%v doesn't round-trip through String", got)
+			}
+		}
+	}
+}
+
+func TestTokenStoreMemory(t *testing.T) {
+	ts := newTokenStore()
+	if token, err := ts.get("a"); token != "" || err != nil {
+		t.Errorf("get before set = %q, %v", token, err)
+	}
+	ts.set("a", "tok-1")
+	ts.set("a", "tok-2") // replaces
+	ts.set("b", "tok-b")
+	if token, _ := ts.get("a"); token != "tok-2" {
+		t.Errorf("get(a) = %q, want tok-2", token)
+	}
+
+	ts.clear("a")
+	if token, _ := ts.get("a"); token != "" {
+		t.Errorf("get(a) after clear = %q", token)
+	}
+	if token, _ := ts.get("b"); token != "tok-b" {
+		t.Errorf("clearing a removed b's token: %q", token)
+	}
+}
+
+// tokenFile returns where the file storage keeps tokens under $HOME.
+func tokenFile(t *testing.T) string {
+	t.Helper()
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(home, ".local", "share", "claude-cowork", "oauth-tokens.json")
+}
+
+// readTokenFile returns the tokens in the storage file.
+func readTokenFile(t *testing.T) map[string]string {
+	t.Helper()
+	data, err := os.ReadFile(tokenFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens map[string]string
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		t.Fatalf("parsing token file: %v", err)
+	}
+	return tokens
+}
+
+func TestTokenStoreFile(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ts := newTokenStore()
+	if err := ts.setStorage(TokenStorageFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.set("a", "tok-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.set("b", "tok-b"); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := os.Stat(tokenFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := st.Mode().Perm(); perm != 0600 {
+		t.Errorf("token file mode = %v, want 0600", perm)
+	}
+	if got := readTokenFile(t); !reflect.DeepEqual(got, map[string]string{"a": "tok-a", "b": "tok-b"}) {
+		t.Errorf("token file = %v", got)
+	}
+
+	// A restarted daemon finds the tokens again.
+	reloaded := newTokenStore()
+	reloaded.setStorage(TokenStorageFile)
+	if token, err := reloaded.get("a"); token != "tok-a" || err != nil {
+		t.Errorf("get(a) after reload = %q, %v", token, err)
+	}
+
+	ts.clear("a")
+	if got := readTokenFile(t); !reflect.DeepEqual(got, map[string]string{"b": "tok-b"}) {
+		t.Errorf("token file after clearing a = %v", got)
+	}
+	ts.clear("b")
+	if _, err := os.Stat(tokenFile(t)); !os.IsNotExist(err) {
+		t.Errorf("token file left behind without tokens: %v", err)
+	}
+}
+
+func TestStopVMWipesSessionToken(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	b := NewBackend(false)
+	defer b.Shutdown()
+	if err := b.SetTokenStorage(TokenStorageFile); err != nil {
+		t.Fatal(err)
+	}
+	b.AddApprovedOauthToken("a", "tok-a")
+	b.AddApprovedOauthToken("b", "tok-b")
+
+	if err := b.StopVM("a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTokenFile(t); !reflect.DeepEqual(got, map[string]string{"b": "tok-b"}) {
+		t.Errorf("token file after stopVM a = %v", got)
+	}
+	if token, _ := b.tokens.get("a"); token != "" {
+		t.Errorf("session a still has token %q", token)
+	}
+	if token, _ := b.tokens.get("b"); token != "tok-b" {
+		t.Errorf("session b lost its token: %q", token)
+	}
+}
@@ -24,6 +24,8 @@ in
         ExecStart = "${cfg.package}/bin/cowork-svc-linux";
         Restart = "on-failure";
         RestartSec = 5;
+        # Let the service manage its own cgroup subtree for per-session limits
+        Delegate = true;
       };
     };
 
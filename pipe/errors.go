@@ -0,0 +1,98 @@
+package pipe
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+
+	"github.com/patrickjaja/claude-cowork-service/process"
+)
+
+// Error codes sent in Response.Code. The -327xx/-326xx values follow
+// JSON-RPC; the -320xx range is application-specific.
+const (
+	CodeParseError         = -32700
+	CodeMethodNotFound     = -32601
+	CodeInvalidParams      = -32602
+	CodeInternal           = -32000
+	CodeProcessNotFound    = -32001
+	CodeProcessExited      = -32002
+	CodeStdinTimeout       = -32003
+	CodeBackendUnavailable = -32004
+	CodePermissionDenied   = -32005
+	CodeFileNotFound       = -32006
+	CodeTooManyProcesses   = -32007
+)
+
+// ErrorCode maps a backend error to its wire code.
+func ErrorCode(err error) int {
+	switch {
+	case errors.Is(err, process.ErrProcessNotFound):
+		return CodeProcessNotFound
+	case errors.Is(err, process.ErrProcessExited):
+		return CodeProcessExited
+	case errors.Is(err, process.ErrStdinTimeout):
+		return CodeStdinTimeout
+	case errors.Is(err, process.ErrInvalidParams):
+		return CodeInvalidParams
+	case errors.Is(err, process.ErrBackendUnavailable):
+		return CodeBackendUnavailable
+	case errors.Is(err, process.ErrPermissionDenied), errors.Is(err, fs.ErrPermission):
+		return CodePermissionDenied
+	case errors.Is(err, fs.ErrNotExist):
+		return CodeFileNotFound
+	case errors.Is(err, process.ErrTooManyProcesses):
+		return CodeTooManyProcesses
+	default:
+		return CodeInternal
+	}
+}
+
+// CodeError turns a wire code and message back into an error wrapping the
+// matching sentinel, so errors relayed from another daemon (e.g. the guest
+// agent) keep their code.
+func CodeError(code int, message string) error {
+	var sentinel error
+	switch code {
+	case CodeProcessNotFound:
+		sentinel = process.ErrProcessNotFound
+	case CodeProcessExited:
+		sentinel = process.ErrProcessExited
+	case CodeStdinTimeout:
+		sentinel = process.ErrStdinTimeout
+	case CodeInvalidParams:
+		sentinel = process.ErrInvalidParams
+	case CodeBackendUnavailable:
+		sentinel = process.ErrBackendUnavailable
+	case CodePermissionDenied:
+		sentinel = process.ErrPermissionDenied
+	case CodeFileNotFound:
+		sentinel = fs.ErrNotExist
+	case CodeTooManyProcesses:
+		sentinel = process.ErrTooManyProcesses
+	default:
+		return errors.New(message)
+	}
+	return &codedError{message: message, sentinel: sentinel}
+}
+
+// codedError keeps a relayed message verbatim while matching its sentinel.
+type codedError struct {
+	message  string
+	sentinel error
+}
+
+func (e *codedError) Error() string { return e.message }
+
+func (e *codedError) Unwrap() error { return e.sentinel }
+
+// WriteBackendError sends an error response for a backend error, with the
+// code derived from its sentinel and any process.DataError details attached.
+func WriteBackendError(conn net.Conn, id interface{}, err error) error {
+	var data interface{}
+	var de *process.DataError
+	if errors.As(err, &de) {
+		data = de.Data
+	}
+	return WriteErrorData(conn, id, ErrorCode(err), err.Error(), data)
+}
@@ -2,17 +2,71 @@ package pipe
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net"
+	"os"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/patrickjaja/claude-cowork-service/process"
 )
 
+// ProtocolRevision is reported by hello/getCapabilities. Bump it when the
+// wire format changes in a way clients may need to detect.
+const ProtocolRevision = 1
+
+// eventWriteTimeout bounds writing one event to a subscriber. A client that
+// stops reading for longer loses its subscription and connection, so it
+// can't hold up event delivery through its queue.
+const eventWriteTimeout = 10 * time.Second
+
+// supportedMethods lists every method handled by Handle.
+// Keep in sync with the switch below.
+var supportedMethods = []string{
+	"hello",
+	"getCapabilities",
+	"configure",
+	"createVM",
+	"startVM",
+	"stopVM",
+	"isRunning",
+	"isGuestConnected",
+	"spawn",
+	"kill",
+	"resizeTerminal",
+	"writeStdin",
+	"sendMcpMessage",
+	"isProcessRunning",
+	"listProcesses",
+	"getProcessInfo",
+	"mountPath",
+	"readFile",
+	"installSdk",
+	"addApprovedOauthToken",
+	"setDebugLogging",
+	"subscribeEvents",
+	"getDownloadStatus",
+}
+
+// ServerInfo describes the daemon to clients via hello/getCapabilities.
+type ServerInfo struct {
+	Version string // daemon version, e.g. "1.0.8"
+	Backend string // "native" or "vm"
+}
+
 // Handler dispatches RPC methods to the VM backend.
+// One Handler serves one connection; Handle may be called concurrently.
 type Handler struct {
 	backend VMBackend
 	debug   bool
+	info    ServerInfo
+
+	strict  bool     // reject unknown methods instead of returning success
+	cancels []func() // event subscriptions to cancel when the connection closes
+	mu      sync.Mutex
 }
 
 // NewHandler creates a new RPC handler.
@@ -20,14 +74,27 @@ func NewHandler(backend VMBackend, debug bool) *Handler {
 	return &Handler{backend: backend, debug: debug}
 }
 
+// Close releases per-connection state such as event subscriptions.
+func (h *Handler) Close() {
+	h.mu.Lock()
+	cancels := h.cancels
+	h.cancels = nil
+	h.mu.Unlock()
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
+
 // Handle parses and dispatches an RPC request.
+// The response echoes the request ID so pipelined calls can be matched up.
 func (h *Handler) Handle(conn net.Conn, payload []byte) {
 	var req Request
 	if err := json.Unmarshal(payload, &req); err != nil {
 		if h.debug {
 			log.Printf("Invalid JSON: %v", err)
 		}
-		WriteError(conn, nil, -32700, "Parse error")
+		WriteError(conn, nil, CodeParseError, "Parse error")
 		return
 	}
 
@@ -36,6 +103,8 @@ func (h *Handler) Handle(conn net.Conn, payload []byte) {
 	}
 
 	switch req.Method {
+	case "hello", "getCapabilities":
+		h.handleHello(conn, req)
 	case "configure":
 		h.handleConfigure(conn, req)
 	case "createVM":
@@ -52,10 +121,18 @@ func (h *Handler) Handle(conn net.Conn, payload []byte) {
 		h.handleSpawn(conn, req)
 	case "kill":
 		h.handleKill(conn, req)
+	case "resizeTerminal":
+		h.handleResizeTerminal(conn, req)
 	case "writeStdin":
 		h.handleWriteStdin(conn, req)
+	case "sendMcpMessage":
+		h.handleSendMcpMessage(conn, req)
 	case "isProcessRunning":
 		h.handleIsProcessRunning(conn, req)
+	case "listProcesses":
+		h.handleListProcesses(conn, req)
+	case "getProcessInfo":
+		h.handleGetProcessInfo(conn, req)
 	case "mountPath":
 		h.handleMountPath(conn, req)
 	case "readFile":
@@ -71,15 +148,31 @@ func (h *Handler) Handle(conn net.Conn, payload []byte) {
 	case "getDownloadStatus":
 		h.handleGetDownloadStatus(conn, req)
 	default:
+		h.mu.Lock()
+		strict := h.strict
+		h.mu.Unlock()
+		if strict {
+			if h.debug {
+				log.Printf("RPC: unknown method %q — rejecting (strict mode)", req.Method)
+			}
+			WriteError(conn, req.ID, CodeMethodNotFound, "Method not found: "+req.Method)
+			return
+		}
 		if h.debug {
 			log.Printf("RPC: unknown method %q — returning success (passthrough)", req.Method)
 		}
-		WriteResponse(conn, nil)
+		WriteResponse(conn, req.ID, nil)
 	}
 }
 
 // Parameter types for RPC methods
 
+type helloParams struct {
+	// Strict, when set, makes unknown methods on this connection fail with
+	// CodeMethodNotFound. Omitted keeps the daemon's default.
+	Strict *bool `json:"strict"`
+}
+
 type configureParams struct {
 	MemoryMB int `json:"memoryMB"`
 	CPUCount int `json:"cpuCount"`
@@ -89,6 +182,13 @@ type vmNameParams struct {
 	Name string `json:"name"`
 }
 
+type subscribeEventsParams struct {
+	Name       string   `json:"name"`
+	SinceSeq   uint64   `json:"sinceSeq"`
+	EventTypes []string `json:"eventTypes"`
+	ProcessIDs []string `json:"processIds"`
+}
+
 type createVMParams struct {
 	Name       string `json:"name"`
 	BundlePath string `json:"bundlePath"`
@@ -107,13 +207,18 @@ type killParams struct {
 }
 
 type spawnParams struct {
-	Name             string                       `json:"name"`
-	ID               string                       `json:"id"`
-	Cmd              string                       `json:"command"`
-	Args             []string                     `json:"args"`
-	Env              map[string]string             `json:"env"`
-	Cwd              string                       `json:"cwd"`
-	AdditionalMounts map[string]additionalMount    `json:"additionalMounts"`
+	Name             string                     `json:"name"`
+	ID               string                     `json:"id"`
+	Cmd              string                     `json:"command"`
+	Args             []string                   `json:"args"`
+	Env              map[string]string          `json:"env"`
+	Cwd              string                     `json:"cwd"`
+	AdditionalMounts map[string]additionalMount `json:"additionalMounts"`
+	PTY              bool                       `json:"pty"`
+	Rows             int                        `json:"rows"`
+	Cols             int                        `json:"cols"`
+	Stderr           string                     `json:"stderr"`
+	OutputEncoding   string                     `json:"outputEncoding"`
 }
 
 type additionalMount struct {
@@ -121,6 +226,16 @@ type additionalMount struct {
 	Mode string `json:"mode"`
 }
 
+type resizeTerminalParams struct {
+	ProcessID string `json:"id"`
+	Rows      int    `json:"rows"`
+	Cols      int    `json:"cols"`
+}
+
+type listProcessesParams struct {
+	Name string `json:"name"` // session name; empty or "*" lists every session
+}
+
 type processIDParams struct {
 	ProcessID string `json:"id"`
 }
@@ -130,10 +245,17 @@ type writeStdinParams struct {
 	Data      string `json:"data"`
 }
 
+type sendMcpMessageParams struct {
+	ProcessID string          `json:"id"`
+	Server    string          `json:"server"`
+	Message   json.RawMessage `json:"message"`
+}
+
 type mountPathParams struct {
 	Name      string `json:"name"`
 	HostPath  string `json:"hostPath"`
 	GuestPath string `json:"guestPath"`
+	Mode      string `json:"mode"` // "ro" or "rw" (default)
 }
 
 type readFileParams struct {
@@ -150,23 +272,49 @@ type debugLoggingParams struct {
 	Enabled bool `json:"enabled"`
 }
 
+func (h *Handler) handleHello(conn net.Conn, req Request) {
+	var p helloParams
+	if req.Params != nil {
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
+			return
+		}
+	}
+
+	h.mu.Lock()
+	if p.Strict != nil {
+		h.strict = *p.Strict
+	}
+	strict := h.strict
+	h.mu.Unlock()
+
+	WriteResponse(conn, req.ID, map[string]interface{}{
+		"version":          h.info.Version,
+		"backend":          h.info.Backend,
+		"protocolRevision": ProtocolRevision,
+		"methods":          supportedMethods,
+		"eventTypes":       process.EventTypes,
+		"strict":           strict,
+	})
+}
+
 func (h *Handler) handleConfigure(conn net.Conn, req Request) {
 	var p configureParams
 	if err := json.Unmarshal(req.Params, &p); err != nil {
-		WriteError(conn, req.ID, -32602, "Invalid params: "+err.Error())
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
 		return
 	}
 	if err := h.backend.Configure(p.MemoryMB, p.CPUCount); err != nil {
-		WriteError(conn, req.ID, -32000, err.Error())
+		WriteBackendError(conn, req.ID, err)
 		return
 	}
-	WriteResponse(conn, nil)
+	WriteResponse(conn, req.ID, nil)
 }
 
 func (h *Handler) handleCreateVM(conn net.Conn, req Request) {
 	var p createVMParams
 	if err := json.Unmarshal(req.Params, &p); err != nil {
-		WriteError(conn, req.ID, -32602, "Invalid params: "+err.Error())
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
 		return
 	}
 	// Extract VM name from bundlePath if name is empty
@@ -175,16 +323,16 @@ func (h *Handler) handleCreateVM(conn net.Conn, req Request) {
 		name = filepath.Base(p.BundlePath)
 	}
 	if err := h.backend.CreateVM(name); err != nil {
-		WriteError(conn, req.ID, -32000, err.Error())
+		WriteBackendError(conn, req.ID, err)
 		return
 	}
-	WriteResponse(conn, nil)
+	WriteResponse(conn, req.ID, nil)
 }
 
 func (h *Handler) handleStartVM(conn net.Conn, req Request) {
 	var p startVMParams
 	if err := json.Unmarshal(req.Params, &p); err != nil {
-		WriteError(conn, req.ID, -32602, "Invalid params: "+err.Error())
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
 		return
 	}
 	// Extract VM name from bundlePath if name is empty
@@ -193,23 +341,23 @@ func (h *Handler) handleStartVM(conn net.Conn, req Request) {
 		name = filepath.Base(p.BundlePath)
 	}
 	if err := h.backend.StartVM(name); err != nil {
-		WriteError(conn, req.ID, -32000, err.Error())
+		WriteBackendError(conn, req.ID, err)
 		return
 	}
-	WriteResponse(conn, nil)
+	WriteResponse(conn, req.ID, nil)
 }
 
 func (h *Handler) handleStopVM(conn net.Conn, req Request) {
 	var p vmNameParams
 	if err := json.Unmarshal(req.Params, &p); err != nil {
-		WriteError(conn, req.ID, -32602, "Invalid params: "+err.Error())
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
 		return
 	}
 	if err := h.backend.StopVM(p.Name); err != nil {
-		WriteError(conn, req.ID, -32000, err.Error())
+		WriteBackendError(conn, req.ID, err)
 		return
 	}
-	WriteResponse(conn, nil)
+	WriteResponse(conn, req.ID, nil)
 }
 
 func (h *Handler) handleIsRunning(conn net.Conn, req Request) {
@@ -219,10 +367,10 @@ func (h *Handler) handleIsRunning(conn net.Conn, req Request) {
 	}
 	running, err := h.backend.IsRunning(p.Name)
 	if err != nil {
-		WriteError(conn, req.ID, -32000, err.Error())
+		WriteBackendError(conn, req.ID, err)
 		return
 	}
-	WriteResponse(conn, map[string]bool{"running": running})
+	WriteResponse(conn, req.ID, map[string]bool{"running": running})
 }
 
 func (h *Handler) handleIsGuestConnected(conn net.Conn, req Request) {
@@ -232,10 +380,10 @@ func (h *Handler) handleIsGuestConnected(conn net.Conn, req Request) {
 	}
 	connected, err := h.backend.IsGuestConnected(p.Name)
 	if err != nil {
-		WriteError(conn, req.ID, -32000, err.Error())
+		WriteBackendError(conn, req.ID, err)
 		return
 	}
-	WriteResponse(conn, map[string]bool{"connected": connected})
+	WriteResponse(conn, req.ID, map[string]bool{"connected": connected})
 }
 
 func (h *Handler) handleSpawn(conn net.Conn, req Request) {
@@ -244,36 +392,67 @@ func (h *Handler) handleSpawn(conn net.Conn, req Request) {
 	}
 	var p spawnParams
 	if err := json.Unmarshal(req.Params, &p); err != nil {
-		WriteError(conn, req.ID, -32602, "Invalid params: "+err.Error())
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
 		return
 	}
 	if h.debug {
 		log.Printf("spawn parsed: name=%q cmd=%q args=%v cwd=%q env=%v", p.Name, p.Cmd, p.Args, p.Cwd, p.Env)
 	}
-	// Convert additionalMounts to map[string]string for the backend
-	mounts := make(map[string]string, len(p.AdditionalMounts))
+	mounts := make(map[string]process.Mount, len(p.AdditionalMounts))
 	for mountName, mount := range p.AdditionalMounts {
-		mounts[mountName] = mount.Path
+		mounts[mountName] = process.Mount{Path: mount.Path, Mode: mount.Mode}
+	}
+	if p.Rows > 0xffff || p.Cols > 0xffff {
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: rows and cols must be at most 65535")
+		return
+	}
+	stderrMode, err := process.ParseStderrMode(p.Stderr)
+	if err != nil {
+		WriteBackendError(conn, req.ID, err)
+		return
 	}
-	processID, err := h.backend.Spawn(p.Name, p.ID, p.Cmd, p.Args, p.Env, p.Cwd, mounts)
+	encoding, err := process.ParseOutputEncoding(p.OutputEncoding)
 	if err != nil {
-		WriteError(conn, req.ID, -32000, err.Error())
+		WriteBackendError(conn, req.ID, err)
 		return
 	}
-	WriteResponse(conn, map[string]string{"id": processID})
+	opts := process.SpawnOptions{PTY: p.PTY, Rows: p.Rows, Cols: p.Cols, Stderr: stderrMode, OutputEncoding: encoding}
+	result, err := h.backend.Spawn(p.Name, p.ID, p.Cmd, p.Args, p.Env, p.Cwd, mounts, opts)
+	if err != nil {
+		WriteBackendError(conn, req.ID, err)
+		return
+	}
+	WriteResponse(conn, req.ID, result)
 }
 
 func (h *Handler) handleKill(conn net.Conn, req Request) {
 	var p killParams
 	if err := json.Unmarshal(req.Params, &p); err != nil {
-		WriteError(conn, req.ID, -32602, "Invalid params: "+err.Error())
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
 		return
 	}
 	if err := h.backend.Kill(p.ProcessID, p.Signal); err != nil {
-		WriteError(conn, req.ID, -32000, err.Error())
+		WriteBackendError(conn, req.ID, err)
+		return
+	}
+	WriteResponse(conn, req.ID, nil)
+}
+
+func (h *Handler) handleResizeTerminal(conn net.Conn, req Request) {
+	var p resizeTerminalParams
+	if err := json.Unmarshal(req.Params, &p); err != nil {
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
+		return
+	}
+	if p.Rows <= 0 || p.Cols <= 0 || p.Rows > 0xffff || p.Cols > 0xffff {
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: rows and cols must be between 1 and 65535")
 		return
 	}
-	WriteResponse(conn, nil)
+	if err := h.backend.ResizeTerminal(p.ProcessID, p.Rows, p.Cols); err != nil {
+		WriteBackendError(conn, req.ID, err)
+		return
+	}
+	WriteResponse(conn, req.ID, nil)
 }
 
 func (h *Handler) handleWriteStdin(conn net.Conn, req Request) {
@@ -282,7 +461,7 @@ func (h *Handler) handleWriteStdin(conn net.Conn, req Request) {
 	}
 	var p writeStdinParams
 	if err := json.Unmarshal(req.Params, &p); err != nil {
-		WriteError(conn, req.ID, -32602, "Invalid params: "+err.Error())
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
 		return
 	}
 	if h.debug {
@@ -295,101 +474,160 @@ func (h *Handler) handleWriteStdin(conn net.Conn, req Request) {
 		}
 	}
 	if err := h.backend.WriteStdin(p.ProcessID, []byte(p.Data)); err != nil {
-		WriteError(conn, req.ID, -32000, err.Error())
+		WriteBackendError(conn, req.ID, err)
 		return
 	}
-	WriteResponse(conn, nil)
+	WriteResponse(conn, req.ID, nil)
+}
+
+func (h *Handler) handleSendMcpMessage(conn net.Conn, req Request) {
+	var p sendMcpMessageParams
+	if err := json.Unmarshal(req.Params, &p); err != nil {
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
+		return
+	}
+	if p.Server == "" || len(p.Message) == 0 {
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: server and message are required")
+		return
+	}
+	if err := h.backend.SendMcpMessage(p.ProcessID, p.Server, p.Message); err != nil {
+		WriteBackendError(conn, req.ID, err)
+		return
+	}
+	WriteResponse(conn, req.ID, nil)
 }
 
 func (h *Handler) handleIsProcessRunning(conn net.Conn, req Request) {
 	var p processIDParams
 	if err := json.Unmarshal(req.Params, &p); err != nil {
-		WriteError(conn, req.ID, -32602, "Invalid params: "+err.Error())
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
 		return
 	}
 	running, err := h.backend.IsProcessRunning(p.ProcessID)
 	if err != nil {
-		WriteError(conn, req.ID, -32000, err.Error())
+		WriteBackendError(conn, req.ID, err)
 		return
 	}
-	WriteResponse(conn, map[string]bool{"running": running})
+	WriteResponse(conn, req.ID, map[string]bool{"running": running})
+}
+
+func (h *Handler) handleListProcesses(conn net.Conn, req Request) {
+	var p listProcessesParams
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
+			return
+		}
+	}
+	processes, err := h.backend.ListProcesses(p.Name)
+	if err != nil {
+		WriteBackendError(conn, req.ID, err)
+		return
+	}
+	if processes == nil {
+		processes = []process.Info{}
+	}
+	WriteResponse(conn, req.ID, map[string]interface{}{"processes": processes})
+}
+
+func (h *Handler) handleGetProcessInfo(conn net.Conn, req Request) {
+	var p processIDParams
+	if err := json.Unmarshal(req.Params, &p); err != nil {
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
+		return
+	}
+	info, err := h.backend.GetProcessInfo(p.ProcessID)
+	if err != nil {
+		WriteBackendError(conn, req.ID, err)
+		return
+	}
+	WriteResponse(conn, req.ID, info)
 }
 
 func (h *Handler) handleMountPath(conn net.Conn, req Request) {
 	var p mountPathParams
 	if err := json.Unmarshal(req.Params, &p); err != nil {
-		WriteError(conn, req.ID, -32602, "Invalid params: "+err.Error())
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
 		return
 	}
-	if err := h.backend.MountPath(p.Name, p.HostPath, p.GuestPath); err != nil {
-		WriteError(conn, req.ID, -32000, err.Error())
+	mode, err := h.backend.MountPath(p.Name, p.HostPath, p.GuestPath, p.Mode)
+	if err != nil {
+		WriteBackendError(conn, req.ID, err)
 		return
 	}
-	WriteResponse(conn, nil)
+	WriteResponse(conn, req.ID, map[string]string{"mode": mode})
 }
 
 func (h *Handler) handleReadFile(conn net.Conn, req Request) {
 	var p readFileParams
 	if err := json.Unmarshal(req.Params, &p); err != nil {
-		WriteError(conn, req.ID, -32602, "Invalid params: "+err.Error())
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
 		return
 	}
 	data, err := h.backend.ReadFile(p.Name, p.Path)
 	if err != nil {
-		WriteError(conn, req.ID, -32000, err.Error())
+		WriteBackendError(conn, req.ID, err)
 		return
 	}
-	WriteResponse(conn, map[string]interface{}{"data": string(data)})
+	WriteResponse(conn, req.ID, map[string]interface{}{"data": string(data)})
 }
 
 func (h *Handler) handleInstallSdk(conn net.Conn, req Request) {
 	var p vmNameParams
 	if err := json.Unmarshal(req.Params, &p); err != nil {
-		WriteError(conn, req.ID, -32602, "Invalid params: "+err.Error())
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
 		return
 	}
 	if err := h.backend.InstallSdk(p.Name); err != nil {
-		WriteError(conn, req.ID, -32000, err.Error())
+		WriteBackendError(conn, req.ID, err)
 		return
 	}
-	WriteResponse(conn, nil)
+	WriteResponse(conn, req.ID, nil)
 }
 
 func (h *Handler) handleAddApprovedOauthToken(conn net.Conn, req Request) {
 	var p oauthTokenParams
 	if err := json.Unmarshal(req.Params, &p); err != nil {
-		WriteError(conn, req.ID, -32602, "Invalid params: "+err.Error())
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
 		return
 	}
 	if err := h.backend.AddApprovedOauthToken(p.Name, p.Token); err != nil {
-		WriteError(conn, req.ID, -32000, err.Error())
+		WriteBackendError(conn, req.ID, err)
 		return
 	}
-	WriteResponse(conn, nil)
+	WriteResponse(conn, req.ID, nil)
 }
 
 func (h *Handler) handleSetDebugLogging(conn net.Conn, req Request) {
 	var p debugLoggingParams
 	if err := json.Unmarshal(req.Params, &p); err != nil {
-		WriteError(conn, req.ID, -32602, "Invalid params: "+err.Error())
+		WriteError(conn, req.ID, CodeInvalidParams, "Invalid params: "+err.Error())
 		return
 	}
 	h.backend.SetDebugLogging(p.Enabled)
-	WriteResponse(conn, nil)
+	WriteResponse(conn, req.ID, nil)
 }
 
 func (h *Handler) handleSubscribeEvents(conn net.Conn, req Request) {
-	var p vmNameParams
+	var p subscribeEventsParams
 	if req.Params != nil {
 		json.Unmarshal(req.Params, &p)
 	}
+	opts := process.SubscribeOptions{
+		Name:       p.Name,
+		SinceSeq:   p.SinceSeq,
+		EventTypes: p.EventTypes,
+		ProcessIDs: p.ProcessIDs,
+	}
+
+	var cancelled int32 // atomic flag to stop callbacks after write failure
 
-	var (
-		cancelled int32     // atomic flag to stop callbacks after write failure
-		writeMu   sync.Mutex // serialize concurrent event writes on this connection
-	)
+	// Replayed and live events may be ready as soon as the subscription
+	// exists; hold them back until the client has the ack.
+	acked := make(chan struct{})
 
-	cancel, err := h.backend.SubscribeEvents(p.Name, func(event interface{}) {
+	cancel, err := h.backend.SubscribeEvents(opts, func(event interface{}) {
+		<-acked
 		if atomic.LoadInt32(&cancelled) != 0 {
 			return
 		}
@@ -407,35 +645,42 @@ func (h *Handler) handleSubscribeEvents(conn net.Conn, req Request) {
 			}
 			log.Printf("EVENT → client: %s", truncated)
 		}
-		writeMu.Lock()
-		werr := WriteMessage(conn, data)
-		writeMu.Unlock()
-		if werr != nil {
+		if werr := WriteMessageWithin(conn, data, eventWriteTimeout); werr != nil {
 			atomic.StoreInt32(&cancelled, 1)
-			if h.debug {
+			if errors.Is(werr, os.ErrDeadlineExceeded) {
+				log.Printf("Subscriber stopped reading events for %s, closing connection", eventWriteTimeout)
+				conn.Close()
+			} else if h.debug {
 				log.Printf("Event write failed, cancelling subscription: %v", werr)
 			}
+			return
+		}
+		// The backend gave up on this subscriber — close the connection so
+		// the client notices and resubscribes instead of waiting forever.
+		if _, ok := event.(process.SubscriptionDroppedEvent); ok {
+			atomic.StoreInt32(&cancelled, 1)
+			log.Printf("Subscription dropped by backend, closing connection")
+			conn.Close()
 		}
 	})
 	if err != nil {
-		WriteError(conn, req.ID, -32000, err.Error())
+		close(acked)
+		WriteBackendError(conn, req.ID, err)
 		return
 	}
 
-	// Send initial ack
-	WriteResponse(conn, map[string]bool{"subscribed": true})
+	// Events are pushed via the callback until the connection closes,
+	// at which point the server calls Close and the subscription ends.
+	h.mu.Lock()
+	h.cancels = append(h.cancels, cancel)
+	h.mu.Unlock()
 
-	// Block until connection closes (events are pushed via callback)
-	// When connection drops, ReadMessage will fail and we cancel
-	for {
-		if _, err := ReadMessage(conn); err != nil {
-			cancel()
-			return
-		}
-	}
+	// Send initial ack
+	WriteResponse(conn, req.ID, map[string]bool{"subscribed": true})
+	close(acked)
 }
 
 func (h *Handler) handleGetDownloadStatus(conn net.Conn, req Request) {
 	status := h.backend.GetDownloadStatus()
-	WriteResponse(conn, map[string]string{"status": status})
+	WriteResponse(conn, req.ID, map[string]string{"status": status})
 }
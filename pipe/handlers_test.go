@@ -0,0 +1,90 @@
+package pipe
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patrickjaja/claude-cowork-service/eventbus"
+	"github.com/patrickjaja/claude-cowork-service/process"
+)
+
+// busBackend serves subscribeEvents from an event bus. Other methods are
+// not implemented.
+type busBackend struct {
+	VMBackend
+	bus *eventbus.Bus
+}
+
+// SubscribeEvents returns only once delivery has begun, so a handler that
+// didn't hold events back until its ack would write one first.
+func (b *busBackend) SubscribeEvents(opts process.SubscribeOptions, callback func(event interface{})) (func(), error) {
+	started := make(chan struct{})
+	var once sync.Once
+	cancel := b.bus.Subscribe(opts, func(event interface{}) {
+		once.Do(func() { close(started) })
+		callback(event)
+	})
+	select {
+	case <-started:
+		time.Sleep(10 * time.Millisecond)
+	case <-time.After(time.Second):
+	}
+	return cancel, nil
+}
+
+func TestSubscribeAckPrecedesReplayAndLiveEvents(t *testing.T) {
+	bus := eventbus.New()
+	bus.SetPolicy(eventbus.OverflowBlock)
+	emit := func(n int) {
+		for i := 0; i < n; i++ {
+			bus.Emit("s", process.NewStdoutEvent("p1", "x"))
+		}
+	}
+	emit(100)
+
+	// Live events keep coming while the subscription is set up.
+	const live = 500
+	done := make(chan struct{})
+	go func() {
+		emit(live)
+		close(done)
+	}()
+
+	h := NewHandler(&busBackend{bus: bus}, false)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	defer h.Close()
+	go h.Handle(server, []byte(`{"id":7,"method":"subscribeEvents","params":{"name":"s","sinceSeq":50}}`))
+
+	var ack Response
+	data, err := ReadMessage(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &ack); err != nil || !ack.Success || ack.ID != float64(7) {
+		t.Fatalf("first frame is not the ack: %s", data)
+	}
+
+	// Then the replay from seq 51 and the live events, without a gap.
+	for want := uint64(51); want <= 100+live; want++ {
+		data, err := ReadMessage(client)
+		if err != nil {
+			t.Fatalf("reading event %d: %v", want, err)
+		}
+		var event struct {
+			Seq  uint64 `json:"seq"`
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(data, &event); err != nil || event.Type != "stdout" {
+			t.Fatalf("unexpected frame %s", data)
+		}
+		if event.Seq != want {
+			t.Fatalf("got seq %d, want %d", event.Seq, want)
+		}
+	}
+	<-done
+}
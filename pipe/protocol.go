@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"time"
 )
 
 // Request represents an incoming RPC request from Claude Desktop.
@@ -18,12 +19,20 @@ type Request struct {
 
 // Response represents an outgoing RPC response to Claude Desktop.
 // The TypeScript VM client (vZe) expects:
-//   Success: {"success": true, "result": {...}}
-//   Error:   {"success": false, "error": "message"}
+//
+//	Success: {"success": true, "result": {...}}
+//	Error:   {"success": false, "error": "message"}
+//
+// ID echoes Request.ID so clients can pipeline requests on one connection.
+// Errors additionally carry a numeric code (see errors.go) and optional
+// structured data; clients that only read "error" are unaffected.
 type Response struct {
+	ID      interface{} `json:"id,omitempty"`
 	Success bool        `json:"success"`
 	Result  interface{} `json:"result,omitempty"`
 	Error   string      `json:"error,omitempty"`
+	Code    int         `json:"code,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
 }
 
 // ReadMessage reads a length-prefixed JSON message from the connection.
@@ -55,16 +64,41 @@ func ReadMessage(conn net.Conn) ([]byte, error) {
 // WriteMessage writes a length-prefixed JSON message to the connection.
 // Uses a single Write call to prevent interleaving with concurrent writers.
 func WriteMessage(conn net.Conn, data []byte) error {
+	_, err := conn.Write(frame(data))
+	return err
+}
+
+// deadlineWriter is a connection that can apply a write deadline to a single
+// Write without racing other writers (see syncConn).
+type deadlineWriter interface {
+	WriteWithin(b []byte, timeout time.Duration) (int, error)
+}
+
+// WriteMessageWithin is WriteMessage with a write deadline: it fails once
+// timeout passes without the peer reading the message.
+func WriteMessageWithin(conn net.Conn, data []byte, timeout time.Duration) error {
+	if dw, ok := conn.(deadlineWriter); ok {
+		_, err := dw.WriteWithin(frame(data), timeout)
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	_, err := conn.Write(frame(data))
+	return err
+}
+
+// frame prefixes data with its length.
+func frame(data []byte) []byte {
 	buf := make([]byte, 4+len(data))
 	binary.BigEndian.PutUint32(buf[:4], uint32(len(data)))
 	copy(buf[4:], data)
-	_, err := conn.Write(buf)
-	return err
+	return buf
 }
 
-// WriteResponse serializes and sends a success Response.
-func WriteResponse(conn net.Conn, result interface{}) error {
+// WriteResponse serializes and sends a success Response for request id.
+func WriteResponse(conn net.Conn, id interface{}, result interface{}) error {
 	resp := Response{
+		ID:      id,
 		Success: true,
 		Result:  result,
 	}
@@ -77,9 +111,17 @@ func WriteResponse(conn net.Conn, result interface{}) error {
 
 // WriteError sends an error response.
 func WriteError(conn net.Conn, id interface{}, code int, message string) error {
+	return WriteErrorData(conn, id, code, message, nil)
+}
+
+// WriteErrorData sends an error response with structured data attached.
+func WriteErrorData(conn net.Conn, id interface{}, code int, message string, details interface{}) error {
 	resp := Response{
+		ID:      id,
 		Success: false,
 		Error:   message,
+		Code:    code,
+		Data:    details,
 	}
 	data, err := json.Marshal(resp)
 	if err != nil {
@@ -1,10 +1,14 @@
 package pipe
 
 import (
+	"encoding/json"
 	"log"
 	"net"
 	"os"
 	"sync"
+	"time"
+
+	"github.com/patrickjaja/claude-cowork-service/process"
 )
 
 // VMBackend defines the interface that the VM manager must implement.
@@ -16,24 +20,48 @@ type VMBackend interface {
 	StopVM(name string) error
 	IsRunning(name string) (bool, error)
 	IsGuestConnected(name string) (bool, error)
-	Spawn(name string, id string, cmd string, args []string, env map[string]string, cwd string, mounts map[string]string) (string, error)
+	Spawn(name string, id string, cmd string, args []string, env map[string]string, cwd string, mounts map[string]process.Mount, opts process.SpawnOptions) (process.SpawnResult, error)
 	Kill(processID string, signal string) error
+	ResizeTerminal(processID string, rows int, cols int) error
 	WriteStdin(processID string, data []byte) error
+	SendMcpMessage(processID string, server string, message []byte) error
 	IsProcessRunning(processID string) (bool, error)
-	MountPath(name string, hostPath string, guestPath string) error
+	ListProcesses(name string) ([]process.Info, error)
+	GetProcessInfo(processID string) (process.Info, error)
+	MountPath(name string, hostPath string, guestPath string, mode string) (string, error)
 	ReadFile(name string, path string) ([]byte, error)
 	InstallSdk(name string) error
 	AddApprovedOauthToken(name string, token string) error
 	SetDebugLogging(enabled bool)
-	SubscribeEvents(name string, callback func(event interface{})) (cancel func(), err error)
+	SubscribeEvents(opts process.SubscribeOptions, callback func(event interface{})) (cancel func(), err error)
 	GetDownloadStatus() string
 }
 
+// maxInFlight caps the number of requests dispatched concurrently on one
+// connection. Further requests are not read until a slot frees up.
+const maxInFlight = 32
+
+// processMethods are the methods that act on the process named by their "id"
+// param. Requests for the same process run one at a time in arrival order,
+// so e.g. two pipelined writeStdin calls can't swap their data and a kill
+// can't overtake the spawn it follows.
+var processMethods = map[string]bool{
+	"spawn":            true,
+	"kill":             true,
+	"resizeTerminal":   true,
+	"writeStdin":       true,
+	"sendMcpMessage":   true,
+	"isProcessRunning": true,
+	"getProcessInfo":   true,
+}
+
 // Server manages the Unix domain socket and client connections.
 type Server struct {
 	socketPath string
 	backend    VMBackend
 	debug      bool
+	info       ServerInfo
+	strict     bool
 	listener   net.Listener
 	wg         sync.WaitGroup
 	quit       chan struct{}
@@ -49,6 +77,17 @@ func NewServer(socketPath string, backend VMBackend, debug bool) *Server {
 	}
 }
 
+// SetInfo sets the version and backend type reported by hello.
+func (s *Server) SetInfo(info ServerInfo) {
+	s.info = info
+}
+
+// SetStrict makes unknown methods fail with CodeMethodNotFound by default
+// instead of returning success. Clients can override it per connection via hello.
+func (s *Server) SetStrict(strict bool) {
+	s.strict = strict
+}
+
 // Start begins listening on the Unix socket.
 func (s *Server) Start() error {
 	// Remove stale socket file if it exists
@@ -104,6 +143,11 @@ func (s *Server) acceptLoop() {
 	}
 }
 
+// handleConnection reads requests from a client and dispatches each one in
+// its own goroutine, so a slow call (e.g. a writeStdin waiting on a full pipe)
+// doesn't hold up calls for other processes. Calls for the same process keep
+// their order (see processMethods). Responses carry the request ID and may
+// arrive out of order; writes are serialized by syncConn.
 func (s *Server) handleConnection(conn net.Conn) {
 	defer s.wg.Done()
 	defer conn.Close()
@@ -112,7 +156,16 @@ func (s *Server) handleConnection(conn net.Conn) {
 		log.Printf("Client connected: %s", conn.RemoteAddr())
 	}
 
+	sc := &syncConn{Conn: conn}
 	handler := NewHandler(s.backend, s.debug)
+	handler.info = s.info
+	handler.strict = s.strict
+	defer handler.Close()
+
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
+	sem := make(chan struct{}, maxInFlight)
+	queues := &processQueues{pending: make(map[string][]func())}
 
 	for {
 		select {
@@ -129,6 +182,93 @@ func (s *Server) handleConnection(conn net.Conn) {
 			return
 		}
 
-		handler.Handle(conn, payload)
+		sem <- struct{}{}
+		inflight.Add(1)
+		handle := func() {
+			defer inflight.Done()
+			defer func() { <-sem }()
+			handler.Handle(sc, payload)
+		}
+		if id := processKey(payload); id != "" {
+			queues.run(id, handle)
+		} else {
+			go handle()
+		}
+	}
+}
+
+// processKey returns the process ID a request acts on, or "" if it isn't one
+// of the processMethods. Malformed requests are left to Handle to reject.
+func processKey(payload []byte) string {
+	var req struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if json.Unmarshal(payload, &req) != nil || !processMethods[req.Method] {
+		return ""
+	}
+	var p processIDParams
+	if json.Unmarshal(req.Params, &p) != nil {
+		return ""
 	}
+	return p.ProcessID
+}
+
+// processQueues runs the requests for each process one at a time, in the
+// order they were queued. Each busy process has one worker goroutine, which
+// exits once its queue is empty.
+type processQueues struct {
+	pending map[string][]func() // process ID → requests waiting for the worker
+	mu      sync.Mutex
+}
+
+// run queues fn behind the requests already pending for id.
+func (q *processQueues) run(id string, fn func()) {
+	q.mu.Lock()
+	if backlog, busy := q.pending[id]; busy {
+		q.pending[id] = append(backlog, fn)
+		q.mu.Unlock()
+		return
+	}
+	q.pending[id] = nil
+	q.mu.Unlock()
+
+	go func() {
+		for {
+			fn()
+			q.mu.Lock()
+			backlog := q.pending[id]
+			if len(backlog) == 0 {
+				delete(q.pending, id)
+				q.mu.Unlock()
+				return
+			}
+			fn = backlog[0]
+			q.pending[id] = backlog[1:]
+			q.mu.Unlock()
+		}
+	}()
+}
+
+// syncConn serializes writes so concurrent responses and events never
+// interleave on the wire.
+type syncConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+func (c *syncConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// WriteWithin writes b with a write deadline. Holding the lock keeps the
+// deadline from applying to, or being cleared by, other writes.
+func (c *syncConn) WriteWithin(b []byte, timeout time.Duration) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer c.Conn.SetWriteDeadline(time.Time{})
+	return c.Conn.Write(b)
 }
@@ -0,0 +1,42 @@
+package process
+
+import "errors"
+
+// Sentinel errors returned by backends. The pipe layer maps them to
+// structured error codes with errors.Is, so wrap them with %w when adding
+// context.
+var (
+	// ErrProcessNotFound means no tracked process has the given ID.
+	ErrProcessNotFound = errors.New("process not found")
+	// ErrProcessExited means the process has already exited.
+	ErrProcessExited = errors.New("process has exited")
+	// ErrStdinTimeout means a stdin write did not complete in time.
+	ErrStdinTimeout = errors.New("stdin write timeout")
+	// ErrInvalidParams means the request parameters were rejected by the backend.
+	ErrInvalidParams = errors.New("invalid params")
+	// ErrBackendUnavailable means the backend (e.g. the guest sdk-daemon) can't serve requests.
+	ErrBackendUnavailable = errors.New("backend unavailable")
+	// ErrPermissionDenied means the operation was refused by the OS or by policy.
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrTooManyProcesses means the backend's process limit has been reached.
+	ErrTooManyProcesses = errors.New("too many processes")
+)
+
+// DataError attaches structured details to an error. The pipe layer sends
+// Data to the client alongside the error code.
+type DataError struct {
+	Err  error
+	Data interface{}
+}
+
+func (e *DataError) Error() string { return e.Err.Error() }
+
+func (e *DataError) Unwrap() error { return e.Err }
+
+// WithData wraps err so that data is reported to the client with it.
+func WithData(err error, data interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return &DataError{Err: err, Data: data}
+}
@@ -1,13 +1,35 @@
 package process
 
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
 // Event types that match the Windows cowork-svc protocol.
 
+// EventTypes lists the "type" values of every event the daemon can emit.
+var EventTypes = []string{
+	"stdout",
+	"stderr",
+	"exit",
+	"error",
+	"apiReachability",
+	"vmStarted",
+	"vmStopped",
+	"guestPanicked",
+	"subscriptionDropped",
+	"mcpMessage",
+}
+
 // StdoutEvent is emitted when a process writes to stdout.
 // The client expects "id" (not "processId") per the Cowork protocol.
+// Encoding is EncodingBase64 when Data is base64, empty for plain text.
 type StdoutEvent struct {
 	Type      string `json:"type"`
 	ProcessID string `json:"id"`
 	Data      string `json:"data"`
+	Encoding  string `json:"encoding,omitempty"`
 }
 
 // StderrEvent is emitted when a process writes to stderr.
@@ -15,6 +37,7 @@ type StderrEvent struct {
 	Type      string `json:"type"`
 	ProcessID string `json:"id"`
 	Data      string `json:"data"`
+	Encoding  string `json:"encoding,omitempty"`
 }
 
 // ExitEvent is emitted when a process exits.
@@ -44,6 +67,177 @@ type ErrorEvent struct {
 	Fatal     bool   `json:"fatal"`
 }
 
+// MCPMessageEvent carries a JSON-RPC message from a proxied SDK MCP server
+// connection of a process to the client, which answers with sendMcpMessage.
+type MCPMessageEvent struct {
+	Type      string          `json:"type"`
+	ProcessID string          `json:"id"`
+	Server    string          `json:"server"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// SubscriptionDroppedEvent is the last event a subscriber receives when the
+// backend drops its subscription (e.g. its event queue overflowed).
+type SubscriptionDroppedEvent struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// SequencedEvent wraps an event with its position in the backend's event
+// stream. It marshals as the wrapped event with an extra "seq" field, so
+// clients that don't know about sequence numbers see the usual shape.
+type SequencedEvent struct {
+	Seq   uint64
+	Event interface{}
+}
+
+// MarshalJSON injects "seq" into the wrapped event's JSON object.
+func (e SequencedEvent) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(e.Event)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 || data[0] != '{' {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`{"seq":`)
+	buf.WriteString(strconv.FormatUint(e.Seq, 10))
+	if !bytes.Equal(data, []byte("{}")) {
+		buf.WriteByte(',')
+	}
+	buf.Write(data[1:])
+	return buf.Bytes(), nil
+}
+
+// AllSessions is the subscribeEvents name that explicitly receives events
+// from every session (for admin and debugging tools).
+const AllSessions = "*"
+
+// SubscribeOptions selects which events a subscribeEvents call receives.
+type SubscribeOptions struct {
+	// Name is the session (VM) name the subscriber is interested in.
+	// Empty or AllSessions receives events from every session.
+	Name string
+	// SinceSeq, when non-zero, replays buffered events with a higher
+	// sequence number before live delivery starts.
+	SinceSeq uint64
+	// EventTypes, if non-empty, limits delivery to these event types.
+	EventTypes []string
+	// ProcessIDs, if non-empty, limits process events to these IDs.
+	// Events not tied to a process (vmStarted, apiReachability) still pass.
+	ProcessIDs []string
+}
+
+// Matches reports whether an event emitted for session passes the filter.
+// Events without a session are delivered to every subscriber.
+func (o SubscribeOptions) Matches(session string, event interface{}) bool {
+	if o.Name != "" && o.Name != AllSessions && session != "" && session != o.Name {
+		return false
+	}
+	if len(o.EventTypes) == 0 && len(o.ProcessIDs) == 0 {
+		return true
+	}
+	eventType, processID := Describe(event)
+	if len(o.EventTypes) > 0 && !contains(o.EventTypes, eventType) {
+		return false
+	}
+	if len(o.ProcessIDs) > 0 && processID != "" && !contains(o.ProcessIDs, processID) {
+		return false
+	}
+	return true
+}
+
+// Describe returns an event's type and, for process events, its process ID.
+func Describe(event interface{}) (eventType string, processID string) {
+	switch e := event.(type) {
+	case SequencedEvent:
+		return Describe(e.Event)
+	case StdoutEvent:
+		return e.Type, e.ProcessID
+	case StderrEvent:
+		return e.Type, e.ProcessID
+	case ExitEvent:
+		return e.Type, e.ProcessID
+	case ErrorEvent:
+		return e.Type, e.ProcessID
+	case MCPMessageEvent:
+		return e.Type, e.ProcessID
+	case APIReachableEvent:
+		return e.Type, ""
+	case SubscriptionDroppedEvent:
+		return e.Type, ""
+	case map[string]string:
+		return e["type"], e["id"]
+	case map[string]interface{}:
+		eventType, _ = e["type"].(string)
+		processID, _ = e["id"].(string)
+		return eventType, processID
+	default:
+		return "", ""
+	}
+}
+
+// DecodeEvent parses an event received as JSON (e.g. from the guest agent)
+// into the matching event type, so it filters and marshals like a locally
+// emitted one. Unknown types decode to map[string]interface{}.
+func DecodeEvent(data []byte) (interface{}, error) {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, err
+	}
+	var event interface{}
+	switch head.Type {
+	case "stdout":
+		event = &StdoutEvent{}
+	case "stderr":
+		event = &StderrEvent{}
+	case "exit":
+		event = &ExitEvent{}
+	case "error":
+		event = &ErrorEvent{}
+	case "mcpMessage":
+		event = &MCPMessageEvent{}
+	case "apiReachability":
+		event = &APIReachableEvent{}
+	default:
+		var m map[string]interface{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	if err := json.Unmarshal(data, event); err != nil {
+		return nil, err
+	}
+	// Return the value, not the pointer, as the emitters do.
+	switch e := event.(type) {
+	case *StdoutEvent:
+		return *e, nil
+	case *StderrEvent:
+		return *e, nil
+	case *ExitEvent:
+		return *e, nil
+	case *ErrorEvent:
+		return *e, nil
+	case *MCPMessageEvent:
+		return *e, nil
+	default:
+		return *event.(*APIReachableEvent), nil
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 // NewStdoutEvent creates a stdout event.
 func NewStdoutEvent(processID, data string) StdoutEvent {
 	return StdoutEvent{Type: "stdout", ProcessID: processID, Data: data}
@@ -77,3 +271,13 @@ func NewAPIReachableEvent(reachable bool) APIReachableEvent {
 func NewErrorEvent(processID string, message string, fatal bool) ErrorEvent {
 	return ErrorEvent{Type: "error", ProcessID: processID, Message: message, Fatal: fatal}
 }
+
+// NewMCPMessageEvent creates an MCP message event.
+func NewMCPMessageEvent(processID string, server string, message json.RawMessage) MCPMessageEvent {
+	return MCPMessageEvent{Type: "mcpMessage", ProcessID: processID, Server: server, Message: message}
+}
+
+// NewSubscriptionDroppedEvent creates a subscription-dropped event.
+func NewSubscriptionDroppedEvent(reason string) SubscriptionDroppedEvent {
+	return SubscriptionDroppedEvent{Type: "subscriptionDropped", Reason: reason}
+}
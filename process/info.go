@@ -0,0 +1,194 @@
+package process
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Process states reported in Info.State.
+const (
+	StateRunning = "running"
+	StateStopped = "stopped" // suspended by SIGSTOP/SIGTSTP
+	StateExited  = "exited"
+)
+
+// Info describes a spawned process for listProcesses and
+// getProcessInfo. Resource usage covers the whole process group.
+type Info struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"` // session (VM) name
+	Command   string     `json:"command"`
+	Args      []string   `json:"args"` // with secrets redacted
+	Cwd       string     `json:"cwd,omitempty"`
+	PID       int        `json:"pid"`
+	PTY       bool       `json:"pty,omitempty"`
+	State     string     `json:"state"`
+	StartedAt time.Time  `json:"startedAt"`
+	ExitedAt  *time.Time `json:"exitedAt,omitempty"`
+	ExitCode  *int       `json:"exitCode,omitempty"`
+	Signal    string     `json:"signal,omitempty"`
+	// CPUSeconds is user plus system time. For exited processes it includes
+	// every waited-for descendant.
+	CPUSeconds float64 `json:"cpuSeconds"`
+	// MemoryBytes is the current resident set size while running, and the
+	// peak resident set size of the largest process once exited.
+	MemoryBytes uint64 `json:"memoryBytes"`
+}
+
+// redacted replaces secret values in RedactArgs.
+const redacted = "[REDACTED]"
+
+// secretWords are the words of an option name or JSON key that mark its
+// value as a credential. Names are split into words at punctuation and
+// camelCase boundaries, so --auth-token and accessToken match but --author
+// doesn't.
+var secretWords = map[string]bool{
+	"token":         true,
+	"tokens":        true,
+	"secret":        true,
+	"password":      true,
+	"passwd":        true,
+	"auth":          true,
+	"authorization": true,
+	"credential":    true,
+	"credentials":   true,
+	"apikey":        true,
+}
+
+// secretValue matches credentials recognizable by their shape alone.
+var secretValue = regexp.MustCompile(`sk-ant-[A-Za-z0-9_-]+|(?i:bearer\s+)[A-Za-z0-9._~+/=-]+`)
+
+// isSecretName reports whether an option name or JSON key names a credential.
+func isSecretName(name string) bool {
+	words := nameWords(name)
+	for i, w := range words {
+		if secretWords[w] || (w == "api" && i+1 < len(words) && words[i+1] == "key") {
+			return true
+		}
+	}
+	return false
+}
+
+// nameWords splits a name into lower-case words at anything that isn't a
+// letter or digit and at camelCase boundaries: "--x-APIKey" gives "x",
+// "api" and "key".
+func nameWords(name string) []string {
+	var words []string
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	runes := []rune(name)
+	for i, r := range runes {
+		switch {
+		case !unicode.IsLetter(r) && !unicode.IsDigit(r):
+			flush()
+			continue
+		case unicode.IsUpper(r) && i > 0:
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				flush()
+			}
+		}
+		word = append(word, r)
+	}
+	flush()
+	return words
+}
+
+// RedactArgs returns a copy of args with credentials replaced: values of
+// options such as --api-key or --token=..., values under keys like
+// "x-api-key" in JSON-valued args (e.g. an inline --mcp-config), and
+// anything shaped like an Anthropic API key or bearer token.
+func RedactArgs(args []string) []string {
+	out := make([]string, len(args))
+	redactNext := false
+	for i, a := range args {
+		switch {
+		case redactNext && !strings.HasPrefix(a, "-"):
+			out[i] = redacted
+		case strings.HasPrefix(a, "-") && strings.Contains(a, "="):
+			name, value, _ := strings.Cut(a, "=")
+			if isSecretName(name) {
+				out[i] = name + "=" + redacted
+			} else {
+				out[i] = name + "=" + redactValue(value)
+			}
+		default:
+			out[i] = redactValue(a)
+		}
+		redactNext = strings.HasPrefix(a, "-") && !strings.Contains(a, "=") && isSecretName(a)
+	}
+	return out
+}
+
+// redactValue redacts an argument that isn't itself a secret option value.
+func redactValue(s string) string {
+	if redactedJSON, ok := redactJSON(s); ok {
+		return redactedJSON
+	}
+	return secretValue.ReplaceAllString(s, redacted)
+}
+
+// redactJSON redacts a JSON object or array. It returns false if s isn't
+// one, and s unchanged if there was nothing to redact.
+func redactJSON(s string) (string, bool) {
+	trimmed := strings.TrimSpace(s)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return "", false
+	}
+	dec := json.NewDecoder(strings.NewReader(trimmed))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return "", false
+	}
+	v, changed := redactTree(v)
+	if !changed {
+		return s, true
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// redactTree redacts the values of secret keys and secret-shaped strings in
+// decoded JSON, reporting whether anything changed.
+func redactTree(v interface{}) (interface{}, bool) {
+	changed := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if _, nested := child.(map[string]interface{}); !nested && isSecretName(k) {
+				v[k] = redacted
+				changed = true
+				continue
+			}
+			var c bool
+			v[k], c = redactTree(child)
+			changed = changed || c
+		}
+		return v, changed
+	case []interface{}:
+		for i, child := range v {
+			var c bool
+			v[i], c = redactTree(child)
+			changed = changed || c
+		}
+		return v, changed
+	case string:
+		r := secretValue.ReplaceAllString(v, redacted)
+		return r, r != v
+	default:
+		return v, false
+	}
+}
@@ -0,0 +1,98 @@
+package process
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "separate value",
+			args: []string{"--api-key", "abc", "--model", "opus"},
+			want: []string{"--api-key", redacted, "--model", "opus"},
+		},
+		{
+			name: "inline value",
+			args: []string{"--auth-token=abc", "--verbose"},
+			want: []string{"--auth-token=" + redacted, "--verbose"},
+		},
+		{
+			name: "camelCase and upper-case flags",
+			args: []string{"--clientSecret", "abc", "--OAUTH_TOKEN=def", "--xAPIKey", "ghi"},
+			want: []string{"--clientSecret", redacted, "--OAUTH_TOKEN=" + redacted, "--xAPIKey", redacted},
+		},
+		{
+			name: "flags that only contain a secret word",
+			args: []string{"--author", "bob", "--authority=x", "--keyboard", "us", "--tokenizer", "bpe"},
+			want: []string{"--author", "bob", "--authority=x", "--keyboard", "us", "--tokenizer", "bpe"},
+		},
+		{
+			name: "flag followed by another flag",
+			args: []string{"--token", "--print"},
+			want: []string{"--token", "--print"},
+		},
+		{
+			name: "secret-shaped values",
+			args: []string{"-p", "use sk-ant-api03-abc_DEF-1 now", "--header=Authorization: Bearer eyJ.x-y"},
+			want: []string{"-p", "use " + redacted + " now", "--header=Authorization: " + redacted},
+		},
+		{
+			name: "JSON arg with secret keys",
+			args: []string{"--mcp-config", `{"mcpServers":{"web":{"type":"http","url":"https://x","headers":{"x-api-key":"abc","Authorization":"Bearer def","Accept":"*/*"}}}}`},
+			want: []string{"--mcp-config", `{"mcpServers":{"web":{"headers":{"Accept":"*/*","Authorization":"[REDACTED]","x-api-key":"[REDACTED]"},"type":"http","url":"https://x"}}}`},
+		},
+		{
+			name: "JSON arg after =",
+			args: []string{`--settings={"env":{"GITHUB_TOKEN":"abc","HOME":"/h"}}`},
+			want: []string{`--settings={"env":{"GITHUB_TOKEN":"[REDACTED]","HOME":"/h"}}`},
+		},
+		{
+			name: "nested secret object is searched, not replaced",
+			args: []string{`{"auth":{"type":"oauth","clientId":"id","refreshToken":"abc"}}`},
+			want: []string{`{"auth":{"clientId":"id","refreshToken":"[REDACTED]","type":"oauth"}}`},
+		},
+		{
+			name: "JSON array with secret-shaped string",
+			args: []string{`["a", "sk-ant-xyz"]`},
+			want: []string{`["a","[REDACTED]"]`},
+		},
+		{
+			name: "JSON without secrets is left as written",
+			args: []string{"--mcp-config", `{ "mcpServers": { "fs": { "command": "npx" } } }`},
+			want: []string{"--mcp-config", `{ "mcpServers": { "fs": { "command": "npx" } } }`},
+		},
+		{
+			name: "invalid JSON falls back to value patterns",
+			args: []string{`{"token": sk-ant-abc`},
+			want: []string{`{"token": ` + redacted},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := RedactArgs(tt.args)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RedactArgs(%q)\n got %q\nwant %q", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNameWords(t *testing.T) {
+	tests := map[string][]string{
+		"--api-key":      {"api", "key"},
+		"--xAPIKey":      {"x", "api", "key"},
+		"OAUTH_TOKEN":    {"oauth", "token"},
+		"refreshToken2":  {"refresh", "token2"},
+		"x-amz-security": {"x", "amz", "security"},
+	}
+	for name, want := range tests {
+		if got := nameWords(name); !reflect.DeepEqual(got, want) {
+			t.Errorf("nameWords(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package process
+
+import "strings"
+
+// Mount modes for additional mounts.
+const (
+	MountReadOnly  = "ro"
+	MountReadWrite = "rw"
+)
+
+// Mount is an additional host directory exposed to a spawned process,
+// as sent in spawn's additionalMounts.
+type Mount struct {
+	Path string // host path, relative to the user's home directory
+	Mode string // MountReadOnly or MountReadWrite
+}
+
+// ReadOnly reports whether the mount was requested read-only.
+func (m Mount) ReadOnly() bool {
+	return NormalizeMountMode(m.Mode) == MountReadOnly
+}
+
+// NormalizeMountMode maps the client's mode strings to MountReadOnly or
+// MountReadWrite. Anything not recognizably read-only is read-write, which
+// matches the behaviour before modes were honoured.
+func NormalizeMountMode(mode string) string {
+	switch strings.ToLower(mode) {
+	case "ro", "r", "read", "readonly", "read-only", "read_only":
+		return MountReadOnly
+	default:
+		return MountReadWrite
+	}
+}
+
+// SpawnResult is returned by a successful spawn.
+type SpawnResult struct {
+	ID string `json:"id"`
+	// Mounts reports the mode actually applied to each additional mount,
+	// which may be less strict than requested if the backend can't enforce it.
+	Mounts map[string]string `json:"mounts,omitempty"`
+	// Stderr is the stderr mode in effect (StderrMerge or StderrSeparate).
+	// Empty for PTY processes, whose stderr is the terminal.
+	Stderr string `json:"stderr,omitempty"`
+	// MCPServers names the SDK MCP servers proxied for the process; their
+	// traffic flows through mcpMessage events and sendMcpMessage.
+	MCPServers []string `json:"mcpServers,omitempty"`
+}
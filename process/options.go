@@ -0,0 +1,86 @@
+package process
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Stderr modes for SpawnOptions.Stderr.
+const (
+	// StderrAuto merges for the claude CLI and separates for anything else.
+	StderrAuto = "auto"
+	// StderrMerge emits stderr as stdout events. Claude Code writes its
+	// stream-json output to stderr, and clients only read stdout events.
+	StderrMerge = "merge"
+	// StderrSeparate emits stderr as stderr events.
+	StderrSeparate = "separate"
+)
+
+// Output encodings for SpawnOptions.OutputEncoding and the "encoding" field
+// of stdout/stderr events.
+const (
+	// EncodingText sends output as JSON strings. Invalid UTF-8 is replaced
+	// with U+FFFD.
+	EncodingText = "utf8"
+	// EncodingBase64 sends the raw bytes base64-encoded.
+	EncodingBase64 = "base64"
+)
+
+// SpawnOptions holds optional spawn behavior beyond the original VM protocol
+// parameters. The zero value spawns with plain pipes, as before.
+type SpawnOptions struct {
+	// PTY runs the process on a pseudo-terminal: stdin, stdout and stderr
+	// are all the terminal, and output arrives as stdout events.
+	PTY bool
+	// Rows and Cols set the initial terminal size (default 24x80).
+	Rows int
+	Cols int
+	// Stderr is StderrAuto (or empty), StderrMerge or StderrSeparate.
+	Stderr string
+	// OutputEncoding is EncodingText (or empty) or EncodingBase64.
+	OutputEncoding string
+}
+
+// ParseOutputEncoding validates a client-supplied output encoding. Empty
+// means text.
+func ParseOutputEncoding(encoding string) (string, error) {
+	switch encoding {
+	case "", EncodingText:
+		return EncodingText, nil
+	case EncodingBase64:
+		return encoding, nil
+	default:
+		return "", fmt.Errorf("%w: unknown output encoding %q (want utf8 or base64)", ErrInvalidParams, encoding)
+	}
+}
+
+// ParseStderrMode validates a client-supplied stderr mode. Empty means auto.
+func ParseStderrMode(mode string) (string, error) {
+	switch mode {
+	case "", StderrAuto:
+		return StderrAuto, nil
+	case StderrMerge, StderrSeparate:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("%w: unknown stderr mode %q (want auto, merge or separate)", ErrInvalidParams, mode)
+	}
+}
+
+// ResolveStderrMode turns StderrAuto into StderrMerge or StderrSeparate.
+// Auto merges when cmd is the claude CLI or is asked for stream-json
+// output, so the Cowork client keeps receiving it as stdout.
+func ResolveStderrMode(mode string, cmd string, args []string) string {
+	if mode == StderrMerge || mode == StderrSeparate {
+		return mode
+	}
+	if strings.HasPrefix(filepath.Base(cmd), "claude") {
+		return StderrMerge
+	}
+	for i, a := range args {
+		if a == "--output-format=stream-json" || (a == "--output-format" && i+1 < len(args) && args[i+1] == "stream-json") {
+			return StderrMerge
+		}
+	}
+	return StderrSeparate
+}
@@ -0,0 +1,268 @@
+// Package qmp is a minimal client for the QEMU Machine Protocol, the JSON
+// control channel the VM backend opens on each VM's qmp.sock.
+//
+// A Client negotiates capabilities on connect, runs commands concurrently
+// (matched to their replies by id) and delivers asynchronous events such as
+// SHUTDOWN and GUEST_PANICKED to a callback.
+package qmp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned for commands on a connection that has gone away,
+// typically because QEMU exited.
+var ErrClosed = errors.New("qmp: connection closed")
+
+// Event is an asynchronous notification from QEMU.
+type Event struct {
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+}
+
+// Time returns when QEMU emitted the event.
+func (e Event) Time() time.Time {
+	return time.Unix(e.Timestamp.Seconds, e.Timestamp.Microseconds*1000)
+}
+
+// Status is the result of query-status.
+type Status struct {
+	Running bool `json:"running"`
+	// Status is the run state, e.g. "running", "paused", "shutdown" or
+	// "guest-panicked".
+	Status string `json:"status"`
+}
+
+// Error is a command failure reported by QEMU.
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("qmp: %s: %s", e.Class, e.Desc)
+}
+
+// message is any frame QEMU sends: the greeting, a reply or an event.
+type message struct {
+	QMP    json.RawMessage `json:"QMP"`
+	ID     *uint64         `json:"id"`
+	Return json.RawMessage `json:"return"`
+	Error  *Error          `json:"error"`
+	Event
+}
+
+// reply is the outcome of one command.
+type reply struct {
+	result json.RawMessage
+	err    error
+}
+
+// Client is a connection to a QEMU monitor socket.
+type Client struct {
+	conn    net.Conn
+	onEvent func(Event)
+	nextID  uint64
+	pending map[uint64]chan reply
+	closed  bool
+	done    chan struct{}
+	writeMu sync.Mutex
+	mu      sync.Mutex
+}
+
+// Dial connects to the QMP socket at path and negotiates capabilities. It
+// retries until ctx is done, since QEMU creates the socket shortly after it
+// starts. onEvent, if non-nil, is called from the reader goroutine for every
+// event, in order; it must not block on commands of the same client.
+func Dial(ctx context.Context, path string, onEvent func(Event)) (*Client, error) {
+	var d net.Dialer
+	var conn net.Conn
+	for {
+		var err error
+		conn, err = d.DialContext(ctx, "unix", path)
+		if err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("qmp: connecting to %s: %w", path, err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return handshake(ctx, conn, onEvent)
+}
+
+// handshake reads QEMU's greeting on conn and negotiates capabilities. conn
+// is closed if that fails.
+func handshake(ctx context.Context, conn net.Conn, onEvent func(Event)) (*Client, error) {
+	c := &Client{
+		conn:    conn,
+		onEvent: onEvent,
+		pending: make(map[uint64]chan reply),
+		done:    make(chan struct{}),
+	}
+	r := bufio.NewReader(conn)
+
+	// QEMU greets first and only accepts commands after qmp_capabilities.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("qmp: reading greeting: %w", err)
+	}
+	var greeting message
+	if err := json.Unmarshal(line, &greeting); err != nil || greeting.QMP == nil {
+		conn.Close()
+		return nil, fmt.Errorf("qmp: unexpected greeting: %s", line)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	go c.readLoop(r)
+	if _, err := c.Execute(ctx, "qmp_capabilities", nil); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Execute runs a command and returns its "return" value. args may be nil.
+func (c *Client) Execute(ctx context.Context, command string, args interface{}) (json.RawMessage, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	c.nextID++
+	id := c.nextID
+	ch := make(chan reply, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	cmd := map[string]interface{}{"execute": command, "id": id}
+	if args != nil {
+		cmd["arguments"] = args
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		c.forget(id)
+		return nil, err
+	}
+
+	c.writeMu.Lock()
+	_, err = c.conn.Write(append(data, '\n'))
+	c.writeMu.Unlock()
+	if err != nil {
+		c.forget(id)
+		return nil, fmt.Errorf("qmp: sending %s: %w", command, err)
+	}
+
+	select {
+	case r := <-ch:
+		return r.result, r.err
+	case <-ctx.Done():
+		c.forget(id)
+		return nil, fmt.Errorf("qmp: %s: %w", command, ctx.Err())
+	}
+}
+
+// SystemPowerdown asks the guest to power off via an ACPI power button
+// press. It returns once QEMU has injected the request, not when the guest
+// has shut down; wait for the SHUTDOWN event or for QEMU to exit.
+func (c *Client) SystemPowerdown(ctx context.Context) error {
+	_, err := c.Execute(ctx, "system_powerdown", nil)
+	return err
+}
+
+// QueryStatus returns the VM's run state.
+func (c *Client) QueryStatus(ctx context.Context) (Status, error) {
+	var status Status
+	result, err := c.Execute(ctx, "query-status", nil)
+	if err != nil {
+		return status, err
+	}
+	if err := json.Unmarshal(result, &status); err != nil {
+		return status, fmt.Errorf("qmp: parsing query-status: %w", err)
+	}
+	return status, nil
+}
+
+// Done is closed when the connection is lost or closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close closes the connection. Pending commands fail with ErrClosed.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	c.shutdown()
+	return err
+}
+
+// readLoop delivers replies and events until the connection fails.
+func (c *Client) readLoop(r *bufio.Reader) {
+	defer c.shutdown()
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var msg message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			continue
+		}
+
+		if msg.ID == nil {
+			if msg.Event.Event != "" && c.onEvent != nil {
+				c.onEvent(msg.Event)
+			}
+			continue
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[*msg.ID]
+		delete(c.pending, *msg.ID)
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if msg.Error != nil {
+			ch <- reply{err: msg.Error}
+		} else {
+			ch <- reply{result: msg.Return}
+		}
+	}
+}
+
+// forget stops waiting for a reply; a late one is dropped.
+func (c *Client) forget(id uint64) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// shutdown marks the client closed and fails pending commands.
+func (c *Client) shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for id, ch := range c.pending {
+		ch <- reply{err: ErrClosed}
+		delete(c.pending, id)
+	}
+	close(c.done)
+}
@@ -0,0 +1,258 @@
+package qmp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const greeting = `{"QMP": {"version": {"qemu": {"micro": 0, "minor": 2, "major": 8}}, "capabilities": ["oob"]}}`
+
+// fakeQEMU is the monitor end of a net.Pipe.
+type fakeQEMU struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newFakeQEMU(t *testing.T) (*fakeQEMU, net.Conn) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return &fakeQEMU{t: t, conn: server, r: bufio.NewReader(server)}, client
+}
+
+// readCommand reads one command and returns its name and id.
+func (f *fakeQEMU) readCommand() (string, uint64) {
+	f.t.Helper()
+	line, err := f.r.ReadBytes('\n')
+	if err != nil {
+		f.t.Fatalf("reading command: %v", err)
+	}
+	var cmd struct {
+		Execute string `json:"execute"`
+		ID      uint64 `json:"id"`
+	}
+	if err := json.Unmarshal(line, &cmd); err != nil {
+		f.t.Fatalf("decoding command %s: %v", line, err)
+	}
+	return cmd.Execute, cmd.ID
+}
+
+// send writes one line to the client.
+func (f *fakeQEMU) send(line string) {
+	f.t.Helper()
+	if _, err := f.conn.Write([]byte(line + "\n")); err != nil {
+		f.t.Fatalf("writing %s: %v", line, err)
+	}
+}
+
+type handshakeResult struct {
+	client *Client
+	err    error
+}
+
+// startHandshake runs handshake on conn in the background.
+func startHandshake(ctx context.Context, conn net.Conn, onEvent func(Event)) <-chan handshakeResult {
+	done := make(chan handshakeResult, 1)
+	go func() {
+		c, err := handshake(ctx, conn, onEvent)
+		done <- handshakeResult{c, err}
+	}()
+	return done
+}
+
+// connect returns a client that has completed the handshake with f.
+func connect(t *testing.T, onEvent func(Event)) (*Client, *fakeQEMU) {
+	t.Helper()
+	f, conn := newFakeQEMU(t)
+	done := startHandshake(context.Background(), conn, onEvent)
+	f.send(greeting)
+	cmd, id := f.readCommand()
+	if cmd != "qmp_capabilities" {
+		t.Fatalf("first command = %q, want qmp_capabilities", cmd)
+	}
+	f.send(`{"return": {}, "id": ` + itoa(id) + `}`)
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("handshake: %v", r.err)
+	}
+	t.Cleanup(func() { r.client.Close() })
+	return r.client, f
+}
+
+func itoa(id uint64) string {
+	return strconv.FormatUint(id, 10)
+}
+
+type executeResult struct {
+	result json.RawMessage
+	err    error
+}
+
+// execute runs Execute in the background.
+func execute(c *Client, ctx context.Context, command string) <-chan executeResult {
+	done := make(chan executeResult, 1)
+	go func() {
+		result, err := c.Execute(ctx, command, nil)
+		done <- executeResult{result, err}
+	}()
+	return done
+}
+
+func TestHandshake(t *testing.T) {
+	connect(t, nil)
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	t.Run("not a greeting", func(t *testing.T) {
+		f, conn := newFakeQEMU(t)
+		done := startHandshake(context.Background(), conn, nil)
+		f.send(`{"return": {}}`)
+		if r := <-done; r.err == nil || !strings.Contains(r.err.Error(), "unexpected greeting") {
+			t.Errorf("error = %v, want unexpected greeting", r.err)
+		}
+	})
+
+	t.Run("no greeting", func(t *testing.T) {
+		_, conn := newFakeQEMU(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if r := <-startHandshake(ctx, conn, nil); r.err == nil || !strings.Contains(r.err.Error(), "reading greeting") {
+			t.Errorf("error = %v, want a greeting timeout", r.err)
+		}
+	})
+
+	t.Run("capabilities rejected", func(t *testing.T) {
+		f, conn := newFakeQEMU(t)
+		done := startHandshake(context.Background(), conn, nil)
+		f.send(greeting)
+		_, id := f.readCommand()
+		f.send(`{"error": {"class": "CommandNotFound", "desc": "nope"}, "id": ` + itoa(id) + `}`)
+		var qerr *Error
+		if r := <-done; !errors.As(r.err, &qerr) || qerr.Class != "CommandNotFound" {
+			t.Errorf("error = %v, want CommandNotFound", r.err)
+		}
+	})
+
+	t.Run("disconnect before capabilities", func(t *testing.T) {
+		f, conn := newFakeQEMU(t)
+		done := startHandshake(context.Background(), conn, nil)
+		f.send(greeting)
+		f.readCommand()
+		f.conn.Close()
+		if r := <-done; !errors.Is(r.err, ErrClosed) {
+			t.Errorf("error = %v, want ErrClosed", r.err)
+		}
+	})
+}
+
+func TestExecuteMatchesReplies(t *testing.T) {
+	events := make(chan Event, 2)
+	c, f := connect(t, func(e Event) { events <- e })
+
+	ctx := context.Background()
+	first := execute(c, ctx, "query-status")
+	cmd1, id1 := f.readCommand()
+	second := execute(c, ctx, "device_del")
+	cmd2, id2 := f.readCommand()
+	if cmd1 != "query-status" || cmd2 != "device_del" || id1 == id2 {
+		t.Fatalf("commands %s/%d and %s/%d", cmd1, id1, cmd2, id2)
+	}
+
+	// Replies out of order, with events and a reply to an unknown id in
+	// between.
+	f.send(`{"event": "SHUTDOWN", "data": {"guest": true, "reason": "guest-shutdown"}, "timestamp": {"seconds": 1700000000, "microseconds": 5}}`)
+	f.send(`{"error": {"class": "DeviceNotFound", "desc": "Device 'fs0' not found"}, "id": ` + itoa(id2) + `}`)
+	f.send(`{"return": {}, "id": 999}`)
+	f.send(`{"event": "STOP", "timestamp": {"seconds": 1700000001, "microseconds": 0}}`)
+	f.send(`{"return": {"running": false, "status": "shutdown"}, "id": ` + itoa(id1) + `}`)
+
+	var qerr *Error
+	if r := <-second; !errors.As(r.err, &qerr) || qerr.Class != "DeviceNotFound" {
+		t.Errorf("device_del error = %v, want DeviceNotFound", r.err)
+	}
+	if r := <-first; r.err != nil || string(r.result) != `{"running": false, "status": "shutdown"}` {
+		t.Errorf("query-status = %s, %v", r.result, r.err)
+	}
+
+	e := <-events
+	if e.Event != "SHUTDOWN" || string(e.Data) != `{"guest": true, "reason": "guest-shutdown"}` {
+		t.Errorf("first event = %+v", e)
+	}
+	if want := time.Unix(1700000000, 5000); !e.Time().Equal(want) {
+		t.Errorf("event time = %v, want %v", e.Time(), want)
+	}
+	if e := <-events; e.Event != "STOP" {
+		t.Errorf("second event = %+v, want STOP", e)
+	}
+}
+
+func TestQueryStatus(t *testing.T) {
+	c, f := connect(t, nil)
+	done := make(chan error, 1)
+	var status Status
+	go func() {
+		var err error
+		status, err = c.QueryStatus(context.Background())
+		done <- err
+	}()
+	_, id := f.readCommand()
+	f.send(`{"return": {"running": false, "singlestep": false, "status": "guest-panicked"}, "id": ` + itoa(id) + `}`)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if status.Running || status.Status != "guest-panicked" {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	c, f := connect(t, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	late := execute(c, ctx, "system_powerdown")
+	_, lateID := f.readCommand()
+	if r := <-late; !errors.Is(r.err, context.DeadlineExceeded) {
+		t.Fatalf("error = %v, want deadline exceeded", r.err)
+	}
+
+	// The late reply is dropped, and the client keeps working.
+	next := execute(c, context.Background(), "query-status")
+	_, id := f.readCommand()
+	f.send(`{"return": {"late": true}, "id": ` + itoa(lateID) + `}`)
+	f.send(`{"return": {"running": true, "status": "running"}, "id": ` + itoa(id) + `}`)
+	if r := <-next; r.err != nil || string(r.result) != `{"running": true, "status": "running"}` {
+		t.Errorf("query-status = %s, %v", r.result, r.err)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	c, f := connect(t, nil)
+
+	pending := execute(c, context.Background(), "system_powerdown")
+	f.readCommand()
+	f.conn.Close() // QEMU exited
+
+	if r := <-pending; !errors.Is(r.err, ErrClosed) {
+		t.Errorf("pending error = %v, want ErrClosed", r.err)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done not closed after disconnect")
+	}
+	if _, err := c.Execute(context.Background(), "query-status", nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("error after disconnect = %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,300 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+// statfs flags (ST_*) that become locked on mounts inherited into a user
+// namespace and must be preserved when remounting.
+const (
+	stNosuid     = 0x2
+	stNodev      = 0x4
+	stNoexec     = 0x8
+	stNoatime    = 0x400
+	stNodiratime = 0x800
+	stRelatime   = 0x1000
+)
+
+// prctl(2) options for clearing ambient capabilities.
+const (
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+)
+
+// Init is the entry point of the in-namespace helper. It is invoked as
+// "<daemon> __sandbox-init <dir> -- <cmd> <args...>", sets up the sandbox
+// filesystem, runs cmd and exits with its status. It never returns.
+func Init(args []string) {
+	// Capabilities are per thread: clear them and start cmd on the same one.
+	runtime.LockOSThread()
+	code, err := run(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cowork sandbox: %v\n", err)
+		os.Exit(126)
+	}
+	os.Exit(code)
+}
+
+func run(args []string) (int, error) {
+	if len(args) < 3 || args[1] != "--" {
+		return 0, fmt.Errorf("usage: %s <dir> -- <cmd> [args...]", InitArg)
+	}
+	dir, argv := args[0], args[2:]
+
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return 0, fmt.Errorf("reading config: %w", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return 0, fmt.Errorf("parsing config: %w", err)
+	}
+
+	// The daemon resolved the command on the host; its directory is bound
+	// at the same path, so it stays valid after the pivot.
+	path := argv[0]
+	if !filepath.IsAbs(path) {
+		return 0, fmt.Errorf("command must be an absolute path: %s", path)
+	}
+
+	// Opened now, since the pivot hides the sandbox directory.
+	status, err := os.OpenFile(filepath.Join(dir, statusFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("creating status file: %w", err)
+	}
+	defer status.Close()
+
+	root := filepath.Join(dir, "root")
+	if err := buildRoot(root, cfg); err != nil {
+		return 0, err
+	}
+	if err := pivot(root); err != nil {
+		return 0, err
+	}
+
+	cwd := cfg.Cwd
+	if cwd == "" {
+		cwd = SessionPath(cfg.Session)
+	}
+	if err := os.Chdir(cwd); err != nil {
+		return 0, fmt.Errorf("chdir %s: %w", cwd, err)
+	}
+
+	// Drop the ambient CAP_SYS_ADMIN so the command runs unprivileged.
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0); errno != 0 {
+		return 0, fmt.Errorf("clearing ambient capabilities: %w", errno)
+	}
+	return supervise(path, argv, status)
+}
+
+// supervise runs the command as the helper's only child and returns its
+// exit code once it exits, reaping the processes orphaned in the namespace
+// meanwhile. Whatever is left dies with the namespace when the helper exits.
+func supervise(path string, argv []string, status *os.File) (int, error) {
+	// As the namespace's init, the helper only receives signals it handles.
+	// Take them all, so that the Go runtime doesn't exit on SIGTERM or
+	// SIGINT; the command gets them itself, as it shares the helper's
+	// process group.
+	signal.Notify(make(chan os.Signal, 1))
+
+	p, err := os.StartProcess(path, argv, &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("exec %s: %w", path, err)
+	}
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("waiting for %s: %w", path, err)
+		}
+		if pid != p.Pid {
+			continue
+		}
+		if ws.Signaled() {
+			fmt.Fprintf(status, "%d\n", int(ws.Signal()))
+			return 128 + int(ws.Signal()), nil
+		}
+		return ws.ExitStatus(), nil
+	}
+}
+
+// buildRoot populates a fresh tmpfs at root with the sandbox's view.
+func buildRoot(root string, cfg Config) error {
+	// Keep our mounts from propagating back to the host namespace.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making / private: %w", err)
+	}
+	if err := syscall.Mount("tmpfs", root, "tmpfs", 0, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting sandbox root: %w", err)
+	}
+
+	for _, d := range systemDirs {
+		if err := bindSystemDir(root, d); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "proc"), 0555); err != nil {
+		return fmt.Errorf("creating /proc: %w", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "tmp"), 01777); err != nil {
+		return fmt.Errorf("creating /tmp: %w", err)
+	}
+	os.Chmod(filepath.Join(root, "tmp"), 01777)
+
+	// Hide the user's home and runtime dirs if a system bind exposed them
+	// (e.g. /var/home on Fedora Atomic).
+	masked := append([]string{}, maskedDirs...)
+	if cfg.Home != "" {
+		masked = append(masked, cfg.Home)
+	}
+	for _, d := range masked {
+		target := filepath.Join(root, d)
+		if _, err := os.Stat(target); err != nil {
+			continue
+		}
+		if err := syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+			return fmt.Errorf("masking %s: %w", d, err)
+		}
+	}
+
+	for _, p := range cfg.ReadOnlyPaths {
+		if err := bind(root, p, p, true); err != nil {
+			return err
+		}
+	}
+
+	sessionPath := SessionPath(cfg.Session)
+	if err := bind(root, cfg.SessionDir, sessionPath, false); err != nil {
+		return err
+	}
+	for _, m := range cfg.Mounts {
+		if err := bind(root, m.Source, m.Target, m.ReadOnly); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindSystemDir recursively binds a top-level host directory, or recreates
+// it as a symlink (e.g. /bin → usr/bin on merged-/usr systems).
+func bindSystemDir(root, dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return nil
+	}
+	target := filepath.Join(root, dir)
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(dir)
+		if err != nil {
+			return fmt.Errorf("reading link %s: %w", dir, err)
+		}
+		return os.Symlink(link, target)
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	if err := os.Mkdir(target, 0755); err != nil {
+		return fmt.Errorf("creating %s: %w", dir, err)
+	}
+	if err := syscall.Mount(dir, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("binding %s: %w", dir, err)
+	}
+	return nil
+}
+
+// bind mounts host path src at dst inside root, creating the mount point.
+func bind(root, src, dst string, readOnly bool) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("bind source %s: %w", src, err)
+	}
+	target := filepath.Join(root, dst)
+	if info.IsDir() {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("creating mount point %s: %w", dst, err)
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("creating mount point %s: %w", dst, err)
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("creating mount point %s: %w", dst, err)
+		}
+		f.Close()
+	}
+
+	if err := syscall.Mount(src, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("binding %s → %s: %w", src, dst, err)
+	}
+	if readOnly {
+		if err := remountReadOnly(target); err != nil {
+			return fmt.Errorf("making %s read-only: %w", dst, err)
+		}
+	}
+	return nil
+}
+
+// remountReadOnly makes a bind mount read-only, carrying over the flags the
+// kernel locks for mounts inherited from the parent namespace.
+func remountReadOnly(target string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(target, &st); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for _, f := range []struct {
+		st int64
+		ms uintptr
+	}{
+		{stNosuid, syscall.MS_NOSUID},
+		{stNodev, syscall.MS_NODEV},
+		{stNoexec, syscall.MS_NOEXEC},
+		{stNoatime, syscall.MS_NOATIME},
+		{stNodiratime, syscall.MS_NODIRATIME},
+		{stRelatime, syscall.MS_RELATIME},
+	} {
+		if st.Flags&f.st != 0 {
+			flags |= f.ms
+		}
+	}
+	return syscall.Mount("", target, "", flags, "")
+}
+
+// pivot makes root the new / and detaches the host filesystem.
+func pivot(root string) error {
+	old := filepath.Join(root, ".oldroot")
+	if err := os.Mkdir(old, 0700); err != nil {
+		return fmt.Errorf("creating old root: %w", err)
+	}
+	if err := syscall.PivotRoot(root, old); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return fmt.Errorf("chdir /: %w", err)
+	}
+	// A fresh proc only shows the sandbox's PID namespace. The kernel allows
+	// mounting it while the host's /proc is visible in this mount namespace,
+	// so it has to happen before the old root is detached.
+	if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting /proc: %w", err)
+	}
+	if err := syscall.Unmount("/.oldroot", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching old root: %w", err)
+	}
+	os.Remove("/.oldroot")
+	return nil
+}
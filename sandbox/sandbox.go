@@ -0,0 +1,190 @@
+// Package sandbox runs natively spawned processes inside unprivileged Linux
+// user, mount and PID namespaces.
+//
+// The daemon re-executes itself with InitArg as the first argument inside
+// the new namespaces. That helper (see Init) builds a minimal root filesystem
+// — system directories, a /proc of the new PID namespace, the session
+// directory at /sessions/<name>, and the session's mounts at
+// /sessions/<name>/mnt/<mount> — pivots into it and runs the real command as
+// its only child. The user's home directory is not visible, and neither are
+// processes outside the sandbox, whose /proc/<pid>/root would lead back to
+// the host filesystem.
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// InitArg is the first argument that makes the daemon binary act as the
+// in-namespace setup helper instead of starting the service.
+const InitArg = "__sandbox-init"
+
+// statusFile, in the sandbox directory, holds the number of the signal that
+// killed the command (see ExitSignal).
+const statusFile = "status"
+
+// Mount is a host directory made visible inside the sandbox.
+type Mount struct {
+	Source   string `json:"source"`   // host path
+	Target   string `json:"target"`   // path inside the sandbox
+	ReadOnly bool   `json:"readOnly"` // bind read-only
+}
+
+// Config describes the filesystem view of one sandboxed process.
+type Config struct {
+	// Session is the session name; its directory appears at /sessions/<Session>.
+	Session string `json:"session"`
+	// SessionDir is the host directory backing /sessions/<Session>.
+	SessionDir string `json:"sessionDir"`
+	// Mounts are bound in order after the session directory.
+	Mounts []Mount `json:"mounts"`
+	// ReadOnlyPaths are host paths bound read-only at the same location,
+	// e.g. the directory holding the resolved claude binary.
+	ReadOnlyPaths []string `json:"readOnlyPaths"`
+	// Home is the user's home directory, hidden inside the sandbox.
+	Home string `json:"home"`
+	// Cwd is the working directory inside the sandbox.
+	Cwd string `json:"cwd"`
+}
+
+// SessionPath returns the in-sandbox path of a session directory.
+func SessionPath(session string) string {
+	return filepath.Join("/sessions", session)
+}
+
+// HostPath returns the host path backing path inside the sandbox. Paths
+// outside the session directory and its mounts are returned unchanged, as
+// are paths under system directories, which keep their location.
+func (cfg *Config) HostPath(path string) string {
+	path = filepath.Clean(path)
+	// Later mounts shadow earlier ones and all shadow the session directory.
+	for i := len(cfg.Mounts) - 1; i >= 0; i-- {
+		if rest, ok := cutPathPrefix(path, cfg.Mounts[i].Target); ok {
+			return cfg.Mounts[i].Source + rest
+		}
+	}
+	if rest, ok := cutPathPrefix(path, SessionPath(cfg.Session)); ok {
+		return cfg.SessionDir + rest
+	}
+	return path
+}
+
+// cutPathPrefix reports whether path is dir or lies under it, and returns
+// the remainder including its leading slash.
+func cutPathPrefix(path string, dir string) (string, bool) {
+	if path == dir {
+		return "", true
+	}
+	if len(path) > len(dir) && path[:len(dir)] == dir && path[len(dir)] == '/' {
+		return path[len(dir):], true
+	}
+	return "", false
+}
+
+// systemDirs are bound recursively from the host when they exist.
+var systemDirs = []string{
+	"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/libx32",
+	"/etc", "/opt", "/nix", "/snap", "/var", "/run", "/dev", "/sys",
+}
+
+// maskedDirs are covered with an empty tmpfs after the system binds.
+// /run/user holds the daemon's own socket and the user's session bus.
+var maskedDirs = []string{"/run/user"}
+
+// capSysAdmin is CAP_SYS_ADMIN, needed by the helper for mount and pivot_root.
+const capSysAdmin = 21
+
+// cloneAttr maps the caller's uid/gid to themselves inside a new user
+// namespace. The helper keeps CAP_SYS_ADMIN across exec as an ambient
+// capability (a non-root uid would otherwise lose it) and clears it again
+// before starting the real command. It is the init of the new PID namespace.
+func cloneAttr() *syscall.SysProcAttr {
+	uid, gid := os.Getuid(), os.Getgid()
+	return &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID,
+		AmbientCaps: []uintptr{capSysAdmin},
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: uid, HostID: uid, Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: gid, HostID: gid, Size: 1},
+		},
+		GidMappingsEnableSetgroups: false,
+		Setpgid:                    true,
+	}
+}
+
+// Available reports whether unprivileged user namespaces can be created.
+func Available() error {
+	c := exec.Command("/bin/true")
+	c.SysProcAttr = cloneAttr()
+	c.SysProcAttr.AmbientCaps = nil
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("cannot create user namespace: %w "+
+			"(check sysctl user.max_user_namespaces, kernel.unprivileged_userns_clone "+
+			"and kernel.apparmor_restrict_unprivileged_userns)", err)
+	}
+	return nil
+}
+
+// Command returns an exec.Cmd that runs cmd with args inside a sandbox
+// described by cfg. The caller sets Env, stdio and starts it as usual, and
+// must call cleanup once the process has exited.
+func Command(cfg Config, cmd string, args []string) (c *exec.Cmd, cleanup func(), err error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, fmt.Errorf("locating daemon binary: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "cowork-sandbox-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating sandbox dir: %w", err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	if err := os.Mkdir(filepath.Join(dir, "root"), 0700); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("creating sandbox root: %w", err)
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("marshaling sandbox config: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), data, 0600); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("writing sandbox config: %w", err)
+	}
+
+	initArgs := append([]string{InitArg, dir, "--", cmd}, args...)
+	c = exec.Command(self, initArgs...)
+	c.SysProcAttr = cloneAttr()
+	return c, cleanup, nil
+}
+
+// ExitSignal returns the signal that killed the command of c, a Cmd made by
+// Command that has been waited for, or 0 if it exited normally. The helper
+// can't die from the same signal, as the init of its PID namespace ignores
+// it, so it exits with 128+signal and records the signal in the sandbox
+// directory. Call it before cleanup.
+func ExitSignal(c *exec.Cmd) syscall.Signal {
+	if len(c.Args) < 3 || c.Args[1] != InitArg {
+		return 0
+	}
+	data, err := os.ReadFile(filepath.Join(c.Args[2], statusFile))
+	if err != nil {
+		return 0
+	}
+	sig, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return syscall.Signal(sig)
+}
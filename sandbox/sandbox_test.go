@@ -0,0 +1,81 @@
+package sandbox
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestMain lets the test binary act as the sandbox helper, as the daemon
+// binary does.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == InitArg {
+		Init(os.Args[2:])
+	}
+	os.Exit(m.Run())
+}
+
+// runSandboxed runs a shell script in a sandbox whose hidden home directory
+// holds a file named secret, and returns the Cmd after it has exited.
+func runSandboxed(t *testing.T, script string) (*exec.Cmd, string) {
+	t.Helper()
+	if err := Available(); err != nil {
+		t.Skip(err)
+	}
+	home := t.TempDir()
+	if err := os.WriteFile(filepath.Join(home, "secret"), []byte("s3cret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Session: "test", SessionDir: t.TempDir(), Home: home}
+	c, cleanup, err := Command(cfg, "/bin/sh", []string{"-c", script})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	c.Env = append(os.Environ(), "HOST_HOME="+home, "DAEMON_PID="+strconv.Itoa(os.Getpid()))
+	var out bytes.Buffer
+	c.Stdout, c.Stderr = &out, &out
+	c.Run()
+	return c, out.String()
+}
+
+func TestSandboxHidesHostProcesses(t *testing.T) {
+	script := `
+for p in /proc/1/root /proc/$DAEMON_PID/root /proc/$PPID/root; do
+	if cat "$p$HOST_HOME/secret" 2>/dev/null; then echo "reached home via $p"; fi
+done
+test -e /proc/$DAEMON_PID && echo "daemon pid $DAEMON_PID visible"
+echo "ppid=$PPID"
+`
+	c, out := runSandboxed(t, script)
+	if c.ProcessState.ExitCode() != 0 {
+		t.Fatalf("sandboxed script failed (%v): %s", c.ProcessState, out)
+	}
+	if strings.Contains(out, "s3cret") || strings.Contains(out, "reached") || strings.Contains(out, "visible") {
+		t.Errorf("sandbox leaks the host:\n%s", out)
+	}
+	// The command is a child of the namespace's init.
+	if !strings.Contains(out, "ppid=1\n") {
+		t.Errorf("command's parent is not pid 1 in its namespace:\n%s", out)
+	}
+}
+
+func TestSandboxExitStatus(t *testing.T) {
+	c, out := runSandboxed(t, "exit 7")
+	if code := c.ProcessState.ExitCode(); code != 7 {
+		t.Errorf("exit code = %d, want 7 (%s)", code, out)
+	}
+	if sig := ExitSignal(c); sig != 0 {
+		t.Errorf("ExitSignal = %v after a normal exit", sig)
+	}
+
+	c, out = runSandboxed(t, "kill -TERM $$")
+	if sig := ExitSignal(c); sig != syscall.SIGTERM {
+		t.Errorf("ExitSignal = %v, want SIGTERM (%v: %s)", sig, c.ProcessState, out)
+	}
+}
@@ -191,6 +191,8 @@ After=default.target
 ExecStart=$BINARY_PATH
 Restart=on-failure
 RestartSec=5
+# Let the service manage its own cgroup subtree for per-session limits
+Delegate=yes
 
 [Install]
 WantedBy=default.target
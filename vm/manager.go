@@ -1,12 +1,29 @@
 package vm
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"sync"
+	"time"
+
+	"github.com/patrickjaja/claude-cowork-service/eventbus"
+	"github.com/patrickjaja/claude-cowork-service/process"
+	"github.com/patrickjaja/claude-cowork-service/qmp"
+)
+
+// guestCallTimeout bounds a command to the sdk-daemon. installSdk downloads
+// and unpacks the SDK, so it gets installSdkTimeout instead.
+const (
+	guestCallTimeout  = 30 * time.Second
+	installSdkTimeout = 10 * time.Minute
 )
 
 // Manager coordinates VM lifecycle, bundles, and guest communication.
@@ -18,13 +35,19 @@ type Manager struct {
 	memory     int // MB, default 4096
 	cpus       int // default 2
 	cid        uint32
+	home9p     bool // export $HOME over 9p when virtiofsd is missing
 
 	bundles  *BundleManager
 	instance *QEMUInstance
 	vsock    *VsockListener
+	shares   *shareManager
 
-	subscribers []func(event interface{})
-	mu          sync.RWMutex
+	events *eventbus.Bus
+	mu     sync.RWMutex
+
+	// lifecycle serializes StartVM and StopVM, so a VM still powering down
+	// without mu held isn't started over.
+	lifecycle sync.Mutex
 }
 
 // NewManager creates a new VM manager.
@@ -39,7 +62,65 @@ func NewManager(dataDir string, bundlesDir string, debug bool) *Manager {
 		cpus:       2,
 		cid:        3, // Default guest CID
 		bundles:    NewBundleManager(dataDir, debug),
+		events:     eventbus.New(),
+	}
+}
+
+// DefaultBundlesDir returns where Claude Desktop stores downloaded VM
+// bundles, ~/.config/Claude/vm_bundles.
+func DefaultBundlesDir() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		home, _ := os.UserHomeDir()
+		configDir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configDir, "Claude", "vm_bundles")
+}
+
+// Available reports why the VM backend can't run, or nil if it can: it needs
+// read-write access to /dev/kvm, qemu-system-x86_64 and a bundle in
+// bundlesDir that has already been prepared (decompressed and converted to
+// qcow2), so that startVM doesn't stall on a conversion.
+func Available(bundlesDir string) error {
+	kvm, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("KVM unavailable: %w", err)
+	}
+	kvm.Close()
+	if _, err := exec.LookPath("qemu-system-x86_64"); err != nil {
+		return fmt.Errorf("QEMU not installed: %w", err)
+	}
+
+	entries, err := os.ReadDir(bundlesDir)
+	if err != nil {
+		return fmt.Errorf("reading bundles dir: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && bundlePrepared(filepath.Join(bundlesDir, entry.Name())) {
+			return nil
+		}
 	}
+	return fmt.Errorf("no prepared VM bundle in %s", bundlesDir)
+}
+
+// bundlePrepared reports whether dir holds everything QEMU boots from.
+func bundlePrepared(dir string) bool {
+	for _, f := range []string{"vmlinuz", "initrd", "rootfs.qcow2"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// SetHomeShare9p lets folders be shared without virtiofsd by exporting the
+// whole home directory over 9p at boot. It is off by default: the export is
+// read-write for the guest whatever mode a folder is shared with, and
+// security_model=none applies no ownership or permission mapping.
+func (m *Manager) SetHomeShare9p(enabled bool) {
+	m.mu.Lock()
+	m.home9p = enabled
+	m.mu.Unlock()
 }
 
 func (m *Manager) Configure(memory int, cpus int) error {
@@ -74,6 +155,8 @@ func (m *Manager) CreateVM(name string) error {
 }
 
 func (m *Manager) StartVM(name string) error {
+	m.lifecycle.Lock()
+	defer m.lifecycle.Unlock()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -93,53 +176,118 @@ func (m *Manager) StartVM(name string) error {
 	}
 
 	// Create and start QEMU instance
+	home, _ := os.UserHomeDir()
+	shares := newShareManager(filepath.Join(m.dataDir, "state", name), home, m.home9p, m.debug)
 	m.instance = NewQEMUInstance(name, m.dataDir, bundleDir, m.memory, m.cpus, m.cid)
+	if shares.virtiofsd != "" {
+		m.instance.SharedMemory = true
+	} else if shares.home9p {
+		m.instance.HomeShare = home
+	}
+	m.instance.OnEvent = func(e qmp.Event) {
+		m.handleQMPEvent(name, shares, e)
+	}
 	if err := m.instance.Start(); err != nil {
 		m.instance = nil
 		return fmt.Errorf("starting VM: %w", err)
 	}
+	shares.qmp = m.instance.QMP
+	shares.guest = m.call
+	m.shares = shares
 
-	// Start vsock listener for sdk-daemon communication
-	m.vsock = NewVsockListener(vsockPort, m.debug)
+	// Start vsock listener for sdk-daemon communication, replacing a guest
+	// attached before the VM started.
+	if m.vsock != nil {
+		m.vsock.Close()
+	}
+	m.vsock = m.newVsock(name)
 	if err := m.vsock.Listen(); err != nil {
 		log.Printf("Warning: vsock listener failed: %v (sdk-daemon communication unavailable)", err)
 		// Don't fail - VM can still run, just no guest communication
 	}
 
-	m.emitEvent(map[string]string{"type": "vmStarted", "name": name})
+	m.emitEvent(name, map[string]string{"type": "vmStarted", "name": name})
 	return nil
 }
 
-func (m *Manager) StopVM(name string) error {
+// newVsock creates the listener for the sdk-daemon of session name, which
+// publishes the guest's events on the event bus.
+func (m *Manager) newVsock(name string) *VsockListener {
+	v := NewVsockListener(vsockPort, m.debug)
+	v.OnConnect = func() {
+		m.emitEvent(name, process.NewAPIReachableEvent(true))
+	}
+	v.OnEvent = func(frame json.RawMessage) {
+		event, err := process.DecodeEvent(frame)
+		if err != nil {
+			log.Printf("Ignoring malformed event from sdk-daemon: %v", err)
+			return
+		}
+		m.emitEvent(name, event)
+	}
+	return v
+}
+
+// AttachGuest serves session name through a guest already connected on conn,
+// without starting a VM: an sdk-daemon or guest agent reached over a Unix
+// socket, or over net.Pipe in tests. Folder sharing needs a VM and is not
+// available. StopVM detaches the guest.
+func (m *Manager) AttachGuest(name string, conn net.Conn) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-
-	if m.vsock != nil {
-		m.vsock.Close()
-		m.vsock = nil
+	if m.vsock == nil {
+		m.vsock = m.newVsock(name)
 	}
+	m.vsock.Attach(conn)
+}
 
-	if m.instance == nil {
-		return nil
-	}
+func (m *Manager) StopVM(name string) error {
+	m.lifecycle.Lock()
+	defer m.lifecycle.Unlock()
 
-	if err := m.instance.Stop(); err != nil {
-		return err
+	// Detach everything first: the powerdown can take up to
+	// powerdownTimeout, and IsRunning and IsGuestConnected must not wait
+	// for it.
+	m.mu.Lock()
+	vsock, instance, shares := m.vsock, m.instance, m.shares
+	m.vsock, m.instance, m.shares = nil, nil, nil
+	m.mu.Unlock()
+
+	if vsock != nil {
+		vsock.Close()
+	}
+	// A session served through AttachGuest has no instance, but its
+	// subscribers still learn that it stopped.
+	var err error
+	if instance != nil {
+		if err = instance.Stop(); err != nil {
+			err = fmt.Errorf("stopping VM: %w", err)
+		}
+	}
+	if shares != nil {
+		shares.close()
 	}
-	m.instance = nil
 
-	m.emitEvent(map[string]string{"type": "vmStopped", "name": name})
-	return nil
+	m.emitEvent(name, map[string]string{"type": "vmStopped", "name": name})
+	m.events.DropHistory(name)
+	return err
 }
 
 func (m *Manager) IsRunning(name string) (bool, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	if m.instance == nil {
+	if m.instance == nil || !m.instance.IsRunning() {
 		return false, nil
 	}
-	return m.instance.IsRunning(), nil
+	// A panicked or shut-down guest keeps QEMU alive but can't run anything.
+	if status, err := m.instance.Status(); err == nil {
+		switch status.Status {
+		case "guest-panicked", "shutdown", "internal-error":
+			return false, nil
+		}
+	}
+	return true, nil
 }
 
 func (m *Manager) IsGuestConnected(name string) (bool, error) {
@@ -152,59 +300,95 @@ func (m *Manager) IsGuestConnected(name string) (bool, error) {
 	return m.vsock.IsConnected(), nil
 }
 
-func (m *Manager) Spawn(name string, id string, cmd string, args []string, env map[string]string, cwd string, mounts map[string]string) (string, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+func (m *Manager) Spawn(name string, id string, cmd string, args []string, env map[string]string, cwd string, mounts map[string]process.Mount, opts process.SpawnOptions) (process.SpawnResult, error) {
+	if cmd == "" {
+		return process.SpawnResult{}, fmt.Errorf("%w: empty command", process.ErrInvalidParams)
+	}
 
-	if m.vsock == nil || !m.vsock.IsConnected() {
-		return "", fmt.Errorf("sdk-daemon not connected")
+	// The client sends guest paths like /sessions/<name>/mnt/<mount>, the
+	// same layout the native backend uses.
+	var effective map[string]string
+	if len(mounts) > 0 {
+		shares, err := m.runningShares()
+		if err != nil {
+			return process.SpawnResult{}, err
+		}
+		home, _ := os.UserHomeDir()
+		effective = make(map[string]string, len(mounts))
+		for mountName, mnt := range mounts {
+			hostPath := filepath.Join(home, mnt.Path)
+			os.MkdirAll(hostPath, 0755)
+			guestPath := path.Join("/sessions", name, "mnt", mountName)
+			mode, err := shares.mount(hostPath, guestPath, mnt.ReadOnly())
+			if err != nil {
+				return process.SpawnResult{}, fmt.Errorf("sharing mount %q: %w", mountName, err)
+			}
+			effective[mountName] = mode
+		}
 	}
 
-	resp, err := m.vsock.SendCommand(map[string]interface{}{
+	req := map[string]interface{}{
 		"method": "spawn",
+		"name":   name,
+		"id":     id,
 		"cmd":    cmd,
 		"args":   args,
 		"env":    env,
 		"cwd":    cwd,
-	})
+	}
+	if opts.PTY {
+		req["pty"] = true
+		req["rows"] = opts.Rows
+		req["cols"] = opts.Cols
+	}
+	if opts.Stderr != "" {
+		req["stderr"] = opts.Stderr
+	}
+	if opts.OutputEncoding != "" {
+		req["outputEncoding"] = opts.OutputEncoding
+	}
+	resp, err := m.call(req)
 	if err != nil {
-		return "", err
+		return process.SpawnResult{}, err
 	}
 
 	var result struct {
 		ProcessID string `json:"processId"`
+		ID        string `json:"id"`
 	}
 	if err := json.Unmarshal(resp, &result); err != nil {
-		return "", fmt.Errorf("parsing spawn response: %w", err)
+		return process.SpawnResult{}, fmt.Errorf("parsing spawn response: %w", err)
 	}
-
-	return result.ProcessID, nil
-}
-
-func (m *Manager) Kill(processID string) error {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	if m.vsock == nil || !m.vsock.IsConnected() {
-		return fmt.Errorf("sdk-daemon not connected")
+	switch {
+	case result.ProcessID != "":
+		id = result.ProcessID
+	case result.ID != "":
+		id = result.ID
 	}
+	return process.SpawnResult{ID: id, Mounts: effective}, nil
+}
 
-	_, err := m.vsock.SendCommand(map[string]interface{}{
+func (m *Manager) Kill(processID string, signal string) error {
+	_, err := m.call(map[string]interface{}{
 		"method":    "kill",
 		"processId": processID,
+		"signal":    signal,
 	})
 	return err
 }
 
-func (m *Manager) WriteStdin(processID string, data []byte) error {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	if m.vsock == nil || !m.vsock.IsConnected() {
-		return fmt.Errorf("sdk-daemon not connected")
-	}
+func (m *Manager) ResizeTerminal(processID string, rows int, cols int) error {
+	_, err := m.call(map[string]interface{}{
+		"method":    "resizeTerminal",
+		"processId": processID,
+		"rows":      rows,
+		"cols":      cols,
+	})
+	return err
+}
 
-	_, err := m.vsock.SendCommand(map[string]interface{}{
+func (m *Manager) WriteStdin(processID string, data []byte) error {
+	_, err := m.call(map[string]interface{}{
 		"method":    "writeStdin",
 		"processId": processID,
 		"data":      string(data),
@@ -212,15 +396,18 @@ func (m *Manager) WriteStdin(processID string, data []byte) error {
 	return err
 }
 
-func (m *Manager) IsProcessRunning(processID string) (bool, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	if m.vsock == nil || !m.vsock.IsConnected() {
-		return false, fmt.Errorf("sdk-daemon not connected")
-	}
+func (m *Manager) SendMcpMessage(processID string, server string, message []byte) error {
+	_, err := m.call(map[string]interface{}{
+		"method":    "sendMcpMessage",
+		"processId": processID,
+		"server":    server,
+		"message":   json.RawMessage(message),
+	})
+	return err
+}
 
-	resp, err := m.vsock.SendCommand(map[string]interface{}{
+func (m *Manager) IsProcessRunning(processID string) (bool, error) {
+	resp, err := m.call(map[string]interface{}{
 		"method":    "isProcessRunning",
 		"processId": processID,
 	})
@@ -238,21 +425,62 @@ func (m *Manager) IsProcessRunning(processID string) (bool, error) {
 	return result.Running, nil
 }
 
-func (m *Manager) MountPath(name string, hostPath string, guestPath string) error {
-	// virtio-9p mounts need to be configured at QEMU launch time.
-	// For now, return not implemented.
-	return fmt.Errorf("dynamic mount not yet implemented; configure mounts before VM start")
+func (m *Manager) ListProcesses(name string) ([]process.Info, error) {
+	resp, err := m.call(map[string]interface{}{
+		"method": "listProcesses",
+		"name":   name,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Processes []process.Info `json:"processes"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return nil, fmt.Errorf("parsing listProcesses response: %w", err)
+	}
+	return result.Processes, nil
 }
 
-func (m *Manager) ReadFile(name string, path string) ([]byte, error) {
+func (m *Manager) GetProcessInfo(processID string) (process.Info, error) {
+	resp, err := m.call(map[string]interface{}{
+		"method":    "getProcessInfo",
+		"processId": processID,
+	})
+	if err != nil {
+		return process.Info{}, err
+	}
+
+	var info process.Info
+	if err := json.Unmarshal(resp, &info); err != nil {
+		return process.Info{}, fmt.Errorf("parsing getProcessInfo response: %w", err)
+	}
+	return info, nil
+}
+
+// MountPath shares a host directory with the guest at guestPath and returns
+// the mode the host enforces (see shareManager.mode).
+func (m *Manager) MountPath(name string, hostPath string, guestPath string, mode string) (string, error) {
+	shares, err := m.runningShares()
+	if err != nil {
+		return "", err
+	}
+	return shares.mount(hostPath, guestPath, process.NormalizeMountMode(mode) == process.MountReadOnly)
+}
+
+// runningShares returns the share manager of the running VM.
+func (m *Manager) runningShares() (*shareManager, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-
-	if m.vsock == nil || !m.vsock.IsConnected() {
-		return nil, fmt.Errorf("sdk-daemon not connected")
+	if m.shares == nil {
+		return nil, fmt.Errorf("%w: VM not running", process.ErrBackendUnavailable)
 	}
+	return m.shares, nil
+}
 
-	resp, err := m.vsock.SendCommand(map[string]interface{}{
+func (m *Manager) ReadFile(name string, path string) ([]byte, error) {
+	resp, err := m.call(map[string]interface{}{
 		"method": "readFile",
 		"path":   path,
 	})
@@ -260,38 +488,61 @@ func (m *Manager) ReadFile(name string, path string) ([]byte, error) {
 		return nil, err
 	}
 
-	return []byte(resp), nil
+	// Guests that answer with the readFile RPC result shape wrap the
+	// contents in "data"; older ones send the contents as is.
+	var result struct {
+		Data *string `json:"data"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil || result.Data == nil {
+		return []byte(resp), nil
+	}
+	return []byte(*result.Data), nil
 }
 
 func (m *Manager) InstallSdk(name string) error {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	if m.vsock == nil || !m.vsock.IsConnected() {
-		return fmt.Errorf("sdk-daemon not connected")
-	}
-
-	_, err := m.vsock.SendCommand(map[string]interface{}{
+	ctx, cancel := context.WithTimeout(context.Background(), installSdkTimeout)
+	defer cancel()
+	_, err := m.callContext(ctx, map[string]interface{}{
 		"method": "installSdk",
 	})
 	return err
 }
 
 func (m *Manager) AddApprovedOauthToken(name string, token string) error {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	if m.vsock == nil || !m.vsock.IsConnected() {
-		return fmt.Errorf("sdk-daemon not connected")
-	}
-
-	_, err := m.vsock.SendCommand(map[string]interface{}{
+	_, err := m.call(map[string]interface{}{
 		"method": "addApprovedOauthToken",
+		"name":   name,
 		"token":  token,
 	})
 	return err
 }
 
+// call sends a command to the sdk-daemon in the guest and waits up to
+// guestCallTimeout for the result.
+func (m *Manager) call(cmd map[string]interface{}) (json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), guestCallTimeout)
+	defer cancel()
+	return m.callContext(ctx, cmd)
+}
+
+// callContext sends a command to the sdk-daemon and waits for the result
+// until ctx is done. Calls run concurrently; stopping the VM fails the ones
+// still waiting.
+func (m *Manager) callContext(ctx context.Context, cmd map[string]interface{}) (json.RawMessage, error) {
+	m.mu.RLock()
+	vsock := m.vsock
+	m.mu.RUnlock()
+
+	if vsock == nil || !vsock.IsConnected() {
+		return nil, fmt.Errorf("%w: sdk-daemon not connected", process.ErrBackendUnavailable)
+	}
+	result, err := vsock.SendCommand(ctx, cmd)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w: %v", process.ErrBackendUnavailable, err)
+	}
+	return result, err
+}
+
 // Shutdown stops any running VM, intended for use during service exit.
 func (m *Manager) Shutdown() {
 	log.Printf("VM manager shutting down...")
@@ -307,22 +558,15 @@ func (m *Manager) SetDebugLogging(enabled bool) {
 	}
 }
 
-func (m *Manager) SubscribeEvents(name string, callback func(event interface{})) (func(), error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	m.subscribers = append(m.subscribers, callback)
-	idx := len(m.subscribers) - 1
-
-	cancel := func() {
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		if idx < len(m.subscribers) {
-			m.subscribers[idx] = nil
-		}
-	}
+// SetEventOverflowPolicy sets how new subscriptions handle a full event queue.
+func (m *Manager) SetEventOverflowPolicy(policy eventbus.OverflowPolicy) {
+	m.events.SetPolicy(policy)
+}
 
-	return cancel, nil
+// SubscribeEvents registers a callback for VM and guest events, with the same
+// ordering and replay guarantees as the native backend (see eventbus.Bus).
+func (m *Manager) SubscribeEvents(opts process.SubscribeOptions, callback func(event interface{})) (func(), error) {
+	return m.events.Subscribe(opts, callback), nil
 }
 
 func (m *Manager) GetDownloadStatus() string {
@@ -347,14 +591,43 @@ func (m *Manager) GetDownloadStatus() string {
 	return "NotDownloaded"
 }
 
-func (m *Manager) emitEvent(event interface{}) {
-	for _, cb := range m.subscribers {
-		if cb != nil {
-			go cb(event)
+// handleQMPEvent reacts to QEMU events for the given VM. Guest panics are
+// forwarded to the client as guestPanicked events; QEMU leaves the guest
+// paused, so the client is expected to stop the VM.
+func (m *Manager) handleQMPEvent(name string, shares *shareManager, e qmp.Event) {
+	switch e.Event {
+	case "DEVICE_DELETED":
+		var data struct {
+			Device string `json:"device"`
+		}
+		json.Unmarshal(e.Data, &data)
+		shares.deviceDeleted(data.Device)
+	case "GUEST_PANICKED":
+		var data struct {
+			Action string `json:"action"`
+		}
+		json.Unmarshal(e.Data, &data)
+		log.Printf("VM %s: guest kernel panicked (action: %s)", name, data.Action)
+		m.emitEvent(name, map[string]string{"type": "guestPanicked", "name": name, "action": data.Action})
+	case "SHUTDOWN":
+		var data struct {
+			Guest  bool   `json:"guest"`
+			Reason string `json:"reason"`
+		}
+		json.Unmarshal(e.Data, &data)
+		log.Printf("VM %s: shutdown (reason: %s, guest-initiated: %v)", name, data.Reason, data.Guest)
+	default:
+		if m.debug {
+			log.Printf("VM %s: QMP event %s %s", name, e.Event, e.Data)
 		}
 	}
 }
 
+// emitEvent publishes an event belonging to the given VM.
+func (m *Manager) emitEvent(name string, event interface{}) {
+	m.events.Emit(name, event)
+}
+
 func (m *Manager) findLatestBundle() (string, error) {
 	// Look in Claude Desktop's bundle directory
 	entries, err := os.ReadDir(m.bundlesDir)
@@ -0,0 +1,155 @@
+package vm
+
+import (
+	"encoding/json"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/patrickjaja/claude-cowork-service/pipe"
+	"github.com/patrickjaja/claude-cowork-service/process"
+)
+
+// attachGuest serves session name through the host end of a net.Pipe and
+// returns the guest end.
+func attachGuest(t *testing.T, m *Manager, name string) net.Conn {
+	t.Helper()
+	host, guest := net.Pipe()
+	m.AttachGuest(name, host)
+	t.Cleanup(func() {
+		m.StopVM(name)
+		guest.Close()
+	})
+	return guest
+}
+
+func TestManagerReadFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  string
+	}{
+		{"data object", `{"data":"hello\n"}`, "hello\n"},
+		{"empty data", `{"data":""}`, ""},
+		{"object without data", `{"contents":"hello"}`, `{"contents":"hello"}`},
+		{"non-string data", `{"data":{"text":"hello"}}`, `{"data":{"text":"hello"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(t.TempDir(), t.TempDir(), false)
+			guest := attachGuest(t, m, "s")
+			go func() {
+				data, err := pipe.ReadMessage(guest)
+				if err != nil {
+					return
+				}
+				var cmd map[string]interface{}
+				json.Unmarshal(data, &cmd)
+				if cmd["method"] != "readFile" || cmd["path"] != "/sessions/s/notes.txt" {
+					t.Errorf("guest got %s", data)
+				}
+				pipe.WriteMessage(guest, []byte(tt.reply))
+			}()
+
+			got, err := m.ReadFile("s", "/sessions/s/notes.txt")
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ReadFile = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManagerStopVMAttachedGuest(t *testing.T) {
+	m := NewManager(t.TempDir(), t.TempDir(), false)
+	events := make(chan interface{}, 8)
+	cancel := m.events.Subscribe(process.SubscribeOptions{Name: "s"}, func(event interface{}) {
+		events <- event.(process.SequencedEvent).Event
+	})
+	defer cancel()
+	attachGuest(t, m, "s") // emits apiReachable
+
+	// No VM runs, but subscribers still learn that the session stopped.
+	if err := m.StopVM("s"); err != nil {
+		t.Fatalf("StopVM: %v", err)
+	}
+	if ok, _ := m.IsGuestConnected("s"); ok {
+		t.Error("guest still connected after StopVM")
+	}
+	timeout := time.After(time.Second)
+	for stopped := false; !stopped; {
+		select {
+		case event := <-events:
+			if e, ok := event.(map[string]string); ok && e["type"] == "vmStopped" {
+				stopped = true
+			}
+		case <-timeout:
+			t.Fatal("no vmStopped event")
+		}
+	}
+
+	// The session's history went with it.
+	replayed := make(chan interface{}, 8)
+	defer m.events.Subscribe(process.SubscribeOptions{Name: "s", SinceSeq: 1}, func(event interface{}) {
+		replayed <- event
+	})()
+	select {
+	case event := <-replayed:
+		t.Errorf("replayed %v after StopVM", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// slowInstance returns a running instance whose process takes a while to
+// exit after SIGTERM, as a guest powering down does.
+func slowInstance(t *testing.T) *QEMUInstance {
+	t.Helper()
+	cmd := exec.Command("/bin/sh", "-c", `trap 'sleep 1; kill $!; exit 0' TERM; sleep 30 & wait`)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		<-exited
+	})
+	time.Sleep(50 * time.Millisecond) // let the shell install its trap
+	q := NewQEMUInstance("s", t.TempDir(), "", 0, 0, 0)
+	q.cmd, q.running, q.exited = cmd, true, exited
+	return q
+}
+
+func TestManagerStopVMDoesNotBlockQueries(t *testing.T) {
+	m := NewManager(t.TempDir(), t.TempDir(), false)
+	m.instance = slowInstance(t)
+	attachGuest(t, m, "s")
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- m.StopVM("s") }()
+	time.Sleep(100 * time.Millisecond) // StopVM is waiting for the process
+
+	queried := make(chan struct{})
+	go func() {
+		m.IsRunning("s")
+		m.IsGuestConnected("s")
+		close(queried)
+	}()
+	select {
+	case <-queried:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("IsRunning and IsGuestConnected wait for StopVM")
+	}
+	if running, _ := m.IsRunning("s"); running {
+		t.Error("IsRunning = true while stopping")
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("StopVM: %v", err)
+	}
+}
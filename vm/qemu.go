@@ -1,6 +1,7 @@
 package vm
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -11,19 +12,45 @@ import (
 	"sync"
 	"syscall"
 	"time"
+
+	"github.com/patrickjaja/claude-cowork-service/qmp"
+)
+
+const (
+	// qmpConnectTimeout bounds waiting for QEMU's QMP socket after launch.
+	qmpConnectTimeout = 5 * time.Second
+	// qmpCommandTimeout bounds a single QMP command.
+	qmpCommandTimeout = 5 * time.Second
+	// powerdownTimeout is how long Stop waits for the guest to power off
+	// after the ACPI request before falling back to SIGTERM.
+	powerdownTimeout = 20 * time.Second
+	// terminateTimeout is how long Stop waits after SIGTERM before SIGKILL.
+	terminateTimeout = 10 * time.Second
 )
 
 // QEMUInstance represents a running QEMU virtual machine.
 type QEMUInstance struct {
-	Name       string
-	DataDir    string
-	BundleDir  string
-	Memory     int    // MB
-	CPUs       int
-	CID        uint32 // vsock CID
-	cmd        *exec.Cmd
-	running    bool
-	mu         sync.Mutex
+	Name      string
+	DataDir   string
+	BundleDir string
+	Memory    int // MB
+	CPUs      int
+	CID       uint32 // vsock CID
+	cmd       *exec.Cmd
+	running   bool
+	exited    chan struct{} // closed once QEMU has exited
+	qmp       *qmp.Client   // nil if the QMP socket couldn't be reached
+	mu        sync.Mutex
+
+	// SharedMemory backs guest RAM with shared memory, which vhost-user
+	// devices such as virtiofs need.
+	SharedMemory bool
+	// HomeShare, if set, is exported over 9p with the tag homeShareTag.
+	HomeShare string
+
+	// OnEvent, if set before Start, receives QMP events (SHUTDOWN,
+	// GUEST_PANICKED, ...) from the reader goroutine.
+	OnEvent func(qmp.Event)
 }
 
 // NewQEMUInstance creates a new QEMU instance configuration.
@@ -104,11 +131,24 @@ func (q *QEMUInstance) Start() error {
 		"-netdev", "user,id=net0",
 		"-device", "virtio-net-pci,netdev=net0",
 		"-qmp", fmt.Sprintf("unix:%s,server,nowait", qmpSocket),
+		// Lets the guest kernel report panics as GUEST_PANICKED events.
+		"-device", "pvpanic",
 		"-nographic",
 		"-nodefaults",
 		"-serial", "stdio",
 	}
 
+	if q.SharedMemory {
+		args = append(args,
+			"-object", fmt.Sprintf("memory-backend-memfd,id=mem,size=%dM,share=on", q.Memory),
+			"-numa", "node,memdev=mem",
+		)
+	}
+	if q.HomeShare != "" {
+		args = append(args, "-virtfs",
+			fmt.Sprintf("local,path=%s,mount_tag=%s,security_model=none,id=%s", q.HomeShare, homeShareTag, homeShareTag))
+	}
+
 	// Add smol-bin device if the image exists.
 	// The sdk-daemon inside the VM looks for a block device labeled "smol-bin".
 	if _, err := os.Stat(smolBinPath); err == nil {
@@ -132,18 +172,13 @@ func (q *QEMUInstance) Start() error {
 	q.running = true
 	log.Printf("VM %s started (PID %d, CID %d)", q.Name, q.cmd.Process.Pid, q.CID)
 
-	// Wait briefly for QEMU to either stabilize or fail.
-	// QEMU exits within milliseconds when it can't open a disk or access KVM.
-	time.Sleep(500 * time.Millisecond)
-	if !q.isProcessAlive() {
-		q.running = false
-		removePIDFile(stateDir)
-		return fmt.Errorf("QEMU process exited immediately (check disk image or KVM access)")
-	}
-
-	// Monitor process in background
+	// Monitor process in background. Only this goroutine calls Wait; Stop
+	// waits for exited instead.
+	exited := make(chan struct{})
+	q.exited = exited
 	go func() {
 		err := q.cmd.Wait()
+		close(exited)
 		q.mu.Lock()
 		q.running = false
 		q.mu.Unlock()
@@ -155,17 +190,50 @@ func (q *QEMUInstance) Start() error {
 		}
 	}()
 
+	// Wait briefly for QEMU to either stabilize or fail.
+	// QEMU exits within milliseconds when it can't open a disk or access KVM.
+	select {
+	case <-exited:
+		q.running = false
+		return fmt.Errorf("QEMU process exited immediately (check disk image or KVM access)")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), qmpConnectTimeout)
+	defer cancel()
+	client, err := qmp.Dial(ctx, qmpSocket, func(e qmp.Event) {
+		if q.OnEvent != nil {
+			q.OnEvent(e)
+		}
+	})
+	if err != nil {
+		// The VM still runs; Stop falls back to signals.
+		log.Printf("Warning: QMP unavailable for VM %s: %v", q.Name, err)
+	} else {
+		q.qmp = client
+	}
+
 	return nil
 }
 
-// isProcessAlive checks whether the QEMU process is still running.
-func (q *QEMUInstance) isProcessAlive() bool {
-	if q.cmd == nil || q.cmd.Process == nil {
-		return false
+// QMP returns the QMP client, or nil if QMP is unavailable.
+func (q *QEMUInstance) QMP() *qmp.Client {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.qmp
+}
+
+// Status returns the VM's run state as reported by QEMU.
+func (q *QEMUInstance) Status() (qmp.Status, error) {
+	q.mu.Lock()
+	client := q.qmp
+	q.mu.Unlock()
+	if client == nil {
+		return qmp.Status{}, fmt.Errorf("QMP not connected")
 	}
-	// Signal 0 checks if the process exists without actually sending a signal
-	err := q.cmd.Process.Signal(syscall.Signal(0))
-	return err == nil
+	ctx, cancel := context.WithTimeout(context.Background(), qmpCommandTimeout)
+	defer cancel()
+	return client.QueryStatus(ctx)
 }
 
 // createOverlay creates a qcow2 copy-on-write overlay backed by baseImage.
@@ -240,7 +308,8 @@ func removePIDFile(stateDir string) {
 	os.Remove(filepath.Join(stateDir, "qemu.pid"))
 }
 
-// Stop sends ACPI shutdown to the VM, with SIGTERM fallback.
+// Stop asks the guest to power off via ACPI and waits for QEMU to exit,
+// escalating to SIGTERM and then SIGKILL if it doesn't.
 func (q *QEMUInstance) Stop() error {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -251,32 +320,58 @@ func (q *QEMUInstance) Stop() error {
 
 	log.Printf("Stopping VM %s (PID %d)...", q.Name, q.cmd.Process.Pid)
 
-	// Try graceful shutdown via SIGTERM first
-	if err := q.cmd.Process.Signal(syscall.SIGTERM); err != nil {
-		log.Printf("SIGTERM failed: %v, trying SIGKILL", err)
-		q.cmd.Process.Kill()
+	if q.powerdown() {
+		log.Printf("VM %s powered off", q.Name)
+	} else {
+		if err := q.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			log.Printf("SIGTERM failed: %v, trying SIGKILL", err)
+		}
+		select {
+		case <-q.exited:
+			log.Printf("VM %s stopped after SIGTERM", q.Name)
+		case <-time.After(terminateTimeout):
+			log.Printf("VM %s did not stop after SIGTERM, killing", q.Name)
+			q.cmd.Process.Kill()
+			<-q.exited
+		}
 	}
 
-	// Wait up to 10 seconds for graceful shutdown
-	done := make(chan struct{})
-	go func() {
-		q.cmd.Wait()
-		close(done)
-	}()
-
-	select {
-	case <-done:
-		log.Printf("VM %s stopped gracefully", q.Name)
-	case <-time.After(10 * time.Second):
-		log.Printf("VM %s did not stop gracefully, killing", q.Name)
-		q.cmd.Process.Kill()
+	if q.qmp != nil {
+		q.qmp.Close()
+		q.qmp = nil
 	}
-
 	q.running = false
 	removePIDFile(filepath.Join(q.DataDir, "state", q.Name))
 	return nil
 }
 
+// powerdown sends an ACPI power button press and reports whether QEMU
+// exited within powerdownTimeout. A guest that isn't running (paused,
+// panicked) can't handle the request, so it isn't tried.
+func (q *QEMUInstance) powerdown() bool {
+	if q.qmp == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), qmpCommandTimeout)
+	defer cancel()
+	if status, err := q.qmp.QueryStatus(ctx); err != nil || !status.Running {
+		log.Printf("VM %s not running (status %q, err %v), skipping ACPI shutdown", q.Name, status.Status, err)
+		return false
+	}
+	if err := q.qmp.SystemPowerdown(ctx); err != nil {
+		log.Printf("ACPI shutdown of VM %s failed: %v", q.Name, err)
+		return false
+	}
+
+	select {
+	case <-q.exited:
+		return true
+	case <-time.After(powerdownTimeout):
+		log.Printf("VM %s did not power off within %s", q.Name, powerdownTimeout)
+		return false
+	}
+}
+
 // createSmolBinImage creates a small ext4 filesystem image for the smol-bin device.
 // The sdk-daemon inside the VM expects this device for its updater mechanism.
 func createSmolBinImage(path string) error {
@@ -0,0 +1,353 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickjaja/claude-cowork-service/process"
+	"github.com/patrickjaja/claude-cowork-service/qmp"
+)
+
+// homeShareTag is the 9p mount tag of the home directory export used when
+// virtiofsd is not installed.
+const homeShareTag = "hosthome"
+
+// virtiofsdStartTimeout bounds waiting for virtiofsd to create its socket.
+const virtiofsdStartTimeout = 5 * time.Second
+
+// deviceDeleteTimeout bounds waiting for the guest to release an unplugged
+// device.
+const deviceDeleteTimeout = 10 * time.Second
+
+// virtiofsdPaths are where distributions install virtiofsd when it isn't
+// on PATH.
+var virtiofsdPaths = []string{
+	"/usr/libexec/virtiofsd",
+	"/usr/lib/virtiofsd",
+	"/usr/lib/qemu/virtiofsd",
+}
+
+// findVirtiofsd returns the path of virtiofsd, or "" if it isn't installed.
+func findVirtiofsd() string {
+	if path, err := exec.LookPath("virtiofsd"); err == nil {
+		return path
+	}
+	for _, path := range virtiofsdPaths {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return path
+		}
+	}
+	return ""
+}
+
+// shareManager exports host directories to a running VM.
+//
+// With virtiofsd, each share gets its own virtiofsd and a vhost-user-fs
+// device hotplugged through QMP, which the guest mounts by tag. QEMU can't
+// hotplug 9p devices, so without virtiofsd sharing needs the opt-in 9p
+// export of the whole home directory at boot (see Manager.SetHomeShare9p);
+// shares are then bind mounts of subdirectories of it, and only folders
+// under the home directory can be shared.
+type shareManager struct {
+	stateDir  string
+	virtiofsd string // "" uses the 9p home export, if home9p
+	readonly  bool   // virtiofsd supports --readonly
+	home      string
+	home9p    bool // the home directory is exported over 9p
+	qmp       func() *qmp.Client
+	guest     func(cmd map[string]interface{}) (json.RawMessage, error)
+	debug     bool
+
+	shares map[string]*share // guest path → share
+	nextID int
+	mu     sync.Mutex
+
+	deleted map[string]chan struct{} // device id → closed on DEVICE_DELETED
+	delMu   sync.Mutex
+}
+
+// share is one host directory mounted in the guest.
+type share struct {
+	hostPath  string
+	guestPath string
+	readOnly  bool
+	id        string    // QMP device id and virtiofs tag; "" for 9p
+	daemon    *exec.Cmd // virtiofsd
+	socket    string
+}
+
+func newShareManager(stateDir string, home string, home9p bool, debug bool) *shareManager {
+	sm := &shareManager{
+		stateDir:  stateDir,
+		virtiofsd: findVirtiofsd(),
+		home:      home,
+		debug:     debug,
+		shares:    make(map[string]*share),
+		deleted:   make(map[string]chan struct{}),
+	}
+	switch {
+	case sm.virtiofsd != "":
+		help, _ := exec.Command(sm.virtiofsd, "--help").CombinedOutput()
+		sm.readonly = strings.Contains(string(help), "--readonly")
+		if !sm.readonly {
+			log.Printf("%s has no --readonly; read-only folders will be shared read-write", sm.virtiofsd)
+		}
+	case home9p:
+		sm.home9p = true
+		log.Printf("virtiofsd not found; exporting %s read-write over 9p for folder sharing", home)
+	default:
+		log.Printf("virtiofsd not found; folder sharing is disabled (install virtiofsd, or use -vm-9p-home)")
+	}
+	return sm
+}
+
+// mount makes hostPath visible in the guest at guestPath. Mounting the same
+// directory with the same mode again is a no-op; anything else already at
+// guestPath is replaced. It returns the mode actually enforced.
+func (sm *shareManager) mount(hostPath string, guestPath string, readOnly bool) (string, error) {
+	if !filepath.IsAbs(hostPath) || !filepath.IsAbs(guestPath) {
+		return "", fmt.Errorf("%w: hostPath and guestPath must be absolute", process.ErrInvalidParams)
+	}
+	hostPath = filepath.Clean(hostPath)
+	guestPath = filepath.Clean(guestPath)
+	if info, err := os.Stat(hostPath); err != nil {
+		return "", err
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("%w: %s is not a directory", process.ErrInvalidParams, hostPath)
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if s, ok := sm.shares[guestPath]; ok {
+		if s.hostPath == hostPath && s.readOnly == readOnly {
+			return sm.mode(s), nil
+		}
+		if err := sm.unmountLocked(s); err != nil {
+			return "", err
+		}
+	}
+
+	s := &share{hostPath: hostPath, guestPath: guestPath, readOnly: readOnly}
+	var err error
+	if sm.virtiofsd != "" {
+		err = sm.attachVirtiofs(s)
+	} else {
+		err = sm.attach9p(s)
+	}
+	if err != nil {
+		return "", err
+	}
+	sm.shares[guestPath] = s
+	if sm.debug {
+		log.Printf("Shared %s at %s (%s)", hostPath, guestPath, sm.mode(s))
+	}
+	return sm.mode(s), nil
+}
+
+// mode reports the mode the host enforces for a share. Read-only shares are
+// always mounted read-only in the guest, but root in the guest could remount
+// them; they only count as read-only when virtiofsd refuses writes with
+// --readonly. 9p shares are part of the read-write home export.
+func (sm *shareManager) mode(s *share) string {
+	if s.readOnly && s.id != "" && sm.readonly {
+		return process.MountReadOnly
+	}
+	return process.MountReadWrite
+}
+
+// attachVirtiofs starts virtiofsd for the share, hotplugs its device and
+// has the guest mount it.
+func (sm *shareManager) attachVirtiofs(s *share) error {
+	client := sm.qmp()
+	if client == nil {
+		return fmt.Errorf("%w: QMP not connected, can't hotplug a virtiofs device", process.ErrBackendUnavailable)
+	}
+
+	sm.nextID++
+	s.id = fmt.Sprintf("share%d", sm.nextID)
+	s.socket = filepath.Join(sm.stateDir, s.id+".sock")
+	os.Remove(s.socket)
+
+	args := []string{"--socket-path=" + s.socket, "--shared-dir=" + s.hostPath, "--cache=auto"}
+	if os.Geteuid() != 0 {
+		// The namespace sandbox needs root; as a user virtiofsd runs with
+		// the daemon's own permissions.
+		args = append(args, "--sandbox=none")
+	}
+	if s.readOnly && sm.readonly {
+		args = append(args, "--readonly")
+	}
+	s.daemon = exec.Command(sm.virtiofsd, args...)
+	s.daemon.Stderr = os.Stderr
+	if err := s.daemon.Start(); err != nil {
+		return fmt.Errorf("starting virtiofsd: %w", err)
+	}
+	go s.daemon.Wait()
+
+	if err := waitForSocket(s.socket, virtiofsdStartTimeout); err != nil {
+		sm.stopDaemon(s)
+		return fmt.Errorf("virtiofsd for %s: %w", s.hostPath, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), qmpCommandTimeout)
+	defer cancel()
+	chardev := "char-" + s.id
+	if _, err := client.Execute(ctx, "chardev-add", map[string]interface{}{
+		"id": chardev,
+		"backend": map[string]interface{}{
+			"type": "socket",
+			"data": map[string]interface{}{
+				"addr":   map[string]interface{}{"type": "unix", "data": map[string]string{"path": s.socket}},
+				"server": false,
+			},
+		},
+	}); err != nil {
+		sm.stopDaemon(s)
+		return fmt.Errorf("adding virtiofs chardev: %w", err)
+	}
+	if _, err := client.Execute(ctx, "device_add", map[string]interface{}{
+		"driver":  "vhost-user-fs-pci",
+		"id":      s.id,
+		"chardev": chardev,
+		"tag":     s.id,
+	}); err != nil {
+		client.Execute(ctx, "chardev-remove", map[string]string{"id": chardev})
+		sm.stopDaemon(s)
+		return fmt.Errorf("hotplugging virtiofs device: %w", err)
+	}
+
+	if _, err := sm.guest(map[string]interface{}{
+		"method":    "mountPath",
+		"fsType":    "virtiofs",
+		"tag":       s.id,
+		"guestPath": s.guestPath,
+		"readOnly":  s.readOnly,
+	}); err != nil {
+		sm.detachVirtiofs(s)
+		return fmt.Errorf("mounting in guest: %w", err)
+	}
+	return nil
+}
+
+// attach9p has the guest bind mount hostPath's counterpart in the 9p home
+// export.
+func (sm *shareManager) attach9p(s *share) error {
+	if !sm.home9p {
+		return fmt.Errorf("%w: virtiofsd is not installed; install it, or start the daemon with -vm-9p-home to share folders under %s over 9p", process.ErrBackendUnavailable, sm.home)
+	}
+	rel, err := filepath.Rel(sm.home, s.hostPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("%w: %s is outside %s; install virtiofsd to share it", process.ErrPermissionDenied, s.hostPath, sm.home)
+	}
+	if _, err := sm.guest(map[string]interface{}{
+		"method":    "mountPath",
+		"fsType":    "9p",
+		"tag":       homeShareTag,
+		"subdir":    rel,
+		"guestPath": s.guestPath,
+		"readOnly":  s.readOnly,
+	}); err != nil {
+		return fmt.Errorf("mounting in guest: %w", err)
+	}
+	return nil
+}
+
+// unmountLocked removes a share from the guest and releases its device.
+// sm.mu must be held.
+func (sm *shareManager) unmountLocked(s *share) error {
+	if _, err := sm.guest(map[string]interface{}{
+		"method":    "unmountPath",
+		"guestPath": s.guestPath,
+	}); err != nil {
+		return fmt.Errorf("unmounting %s in guest: %w", s.guestPath, err)
+	}
+	if s.id != "" {
+		sm.detachVirtiofs(s)
+	}
+	delete(sm.shares, s.guestPath)
+	return nil
+}
+
+// detachVirtiofs unplugs a share's device and stops its virtiofsd.
+func (sm *shareManager) detachVirtiofs(s *share) {
+	if client := sm.qmp(); client != nil {
+		deleted := make(chan struct{})
+		sm.delMu.Lock()
+		sm.deleted[s.id] = deleted
+		sm.delMu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), deviceDeleteTimeout)
+		defer cancel()
+		if _, err := client.Execute(ctx, "device_del", map[string]string{"id": s.id}); err != nil {
+			log.Printf("Removing virtiofs device %s: %v", s.id, err)
+		} else {
+			// device_del only asks the guest; the chardev stays busy until
+			// the guest has released the device.
+			select {
+			case <-deleted:
+			case <-ctx.Done():
+				log.Printf("Guest did not release virtiofs device %s", s.id)
+			}
+		}
+		client.Execute(ctx, "chardev-remove", map[string]string{"id": "char-" + s.id})
+
+		sm.delMu.Lock()
+		delete(sm.deleted, s.id)
+		sm.delMu.Unlock()
+	}
+	sm.stopDaemon(s)
+}
+
+// deviceDeleted handles QMP's DEVICE_DELETED event.
+func (sm *shareManager) deviceDeleted(id string) {
+	sm.delMu.Lock()
+	defer sm.delMu.Unlock()
+	if ch, ok := sm.deleted[id]; ok {
+		close(ch)
+		delete(sm.deleted, id)
+	}
+}
+
+// stopDaemon stops a share's virtiofsd and removes its socket.
+func (sm *shareManager) stopDaemon(s *share) {
+	if s.daemon != nil && s.daemon.Process != nil {
+		s.daemon.Process.Kill()
+	}
+	os.Remove(s.socket)
+}
+
+// close forgets every share after the VM has stopped, stopping their
+// virtiofsd processes. The guest and its devices are already gone.
+func (sm *shareManager) close() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for guestPath, s := range sm.shares {
+		if s.id != "" {
+			sm.stopDaemon(s)
+		}
+		delete(sm.shares, guestPath)
+	}
+}
+
+// waitForSocket waits until path exists.
+func waitForSocket(path string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("socket %s not created within %s", path, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
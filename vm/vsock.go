@@ -1,34 +1,98 @@
 package vm
 
 import (
-	"encoding/binary"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
 	"sync"
 	"syscall"
 	"unsafe"
+
+	"github.com/patrickjaja/claude-cowork-service/pipe"
+	"github.com/patrickjaja/claude-cowork-service/process"
+)
+
+const (
+	afVsock      = 40         // AF_VSOCK
+	vmaddrCIDAny = 0xFFFFFFFF // VMADDR_CID_ANY
+	vsockPort    = 0xC822     // 51234 - matches HVSocket GUID 0000c822-facb-11e6-bd58-64006a7986d3
 )
 
 const (
-	afVsock       = 40         // AF_VSOCK
-	vmaddrCIDAny  = 0xFFFFFFFF // VMADDR_CID_ANY
-	vsockPort     = 0xC822     // 51234 - matches HVSocket GUID 0000c822-facb-11e6-bd58-64006a7986d3
+	// HostCID is the vsock CID under which a guest reaches the host.
+	HostCID = 2
+	// SDKDaemonPort is the vsock port the host listens on for the sdk-daemon.
+	SDKDaemonPort = vsockPort
 )
 
 // VsockListener manages a vsock connection to the sdk-daemon inside a VM.
+//
+// Every frame is a length-prefixed JSON object (see pipe.ReadMessage).
+// Commands carry a "requestId" the guest echoes in its GuestResponse, so any
+// number of calls can be in flight at once. A single reader goroutine per
+// connection routes the frames.
+//
+// Two kinds of guest are supported. A guest that opens the connection with
+// a GuestHello (such as cowork-guest-agent) is multiplexed: responses are
+// matched by requestId, and frames without one are events pushed by the
+// guest (stdout, exit, ...) that go to OnEvent. Any other guest, such as the
+// sdk-daemon in Claude Desktop's bundle, is assumed to answer one frame per
+// command, in order, without echoing requestId: each such frame answers the
+// oldest command still unanswered, and the whole frame is its result.
 type VsockListener struct {
-	cid       uint32
-	port      uint32
-	conn      net.Conn
-	connected bool
-	debug     bool
-	fd        int
-	closed    bool
-	mu        sync.RWMutex
+	cid         uint32
+	port        uint32
+	conn        net.Conn
+	connected   bool
+	debug       bool
+	fd          int
+	closed      bool
+	nextID      uint64
+	pending     map[uint64]chan GuestResponse // requestId → waiting caller
+	multiplexed bool                          // the current guest sent a GuestHello
+	order       []uint64                      // requestIds in the order sent, until multiplexed
+	mu          sync.RWMutex
+	writeMu     sync.Mutex // one frame at a time on conn
+
+	// OnConnect, if set before Listen, is called each time the sdk-daemon
+	// connects.
+	OnConnect func()
+	// OnEvent, if set before Listen, receives every unsolicited frame from
+	// the guest, in the order they arrive.
+	OnEvent func(frame json.RawMessage)
+}
+
+// GuestResponse answers one command. It mirrors pipe.Response, with Code
+// taken from the same table, and RequestID in place of the RPC id.
+type GuestResponse struct {
+	RequestID uint64          `json:"requestId"`
+	Success   bool            `json:"success"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Code      int             `json:"code,omitempty"`
+}
+
+// GuestProtocolMultiplexed is the GuestHello protocol version of guests
+// that echo requestId and push events.
+const GuestProtocolMultiplexed = 2
+
+// GuestHello is the first frame a multiplexed guest sends after connecting:
+// {"type": "hello", "protocol": 2}.
+type GuestHello struct {
+	Type     string `json:"type"`
+	Protocol int    `json:"protocol"`
+}
+
+// unnumberedFrame is what readLoop needs of a frame without a requestId:
+// either a GuestHello or, from a legacy guest, a response.
+type unnumberedFrame struct {
+	GuestHello
+	Success *bool  `json:"success"`
+	Error   string `json:"error"`
+	Code    int    `json:"code"`
 }
 
 // sockaddrVM is the Linux sockaddr_vm structure.
@@ -44,9 +108,10 @@ type sockaddrVM struct {
 // NewVsockListener creates a new vsock listener for a specific port.
 func NewVsockListener(port uint32, debug bool) *VsockListener {
 	return &VsockListener{
-		port:  port,
-		debug: debug,
-		fd:    -1,
+		port:    port,
+		debug:   debug,
+		fd:      -1,
+		pending: make(map[uint64]chan GuestResponse),
 	}
 }
 
@@ -90,8 +155,11 @@ func (v *VsockListener) Listen() error {
 }
 
 func (v *VsockListener) acceptLoop() {
+	v.mu.RLock()
+	fd := v.fd
+	v.mu.RUnlock()
 	for {
-		nfd, _, err := syscall.Accept(v.fd)
+		conn, err := acceptVsock(fd)
 		if err != nil {
 			v.mu.RLock()
 			closed := v.closed
@@ -105,25 +173,28 @@ func (v *VsockListener) acceptLoop() {
 			continue
 		}
 
-		file := os.NewFile(uintptr(nfd), "vsock")
-		conn, err := net.FileConn(file)
-		file.Close()
-		if err != nil {
-			if v.debug {
-				log.Printf("Vsock FileConn error: %v", err)
-			}
-			continue
-		}
+		log.Printf("sdk-daemon connected via vsock from %s", conn.RemoteAddr())
+		v.Attach(conn)
+	}
+}
 
-		v.mu.Lock()
-		if v.conn != nil {
-			v.conn.Close()
-		}
-		v.conn = conn
-		v.connected = true
-		v.mu.Unlock()
+// Attach makes conn the connection to the sdk-daemon, replacing any current
+// one. Listen calls it for every accepted vsock connection; tests can use it
+// to connect a guest agent over a Unix socket or net.Pipe instead.
+func (v *VsockListener) Attach(conn net.Conn) {
+	v.mu.Lock()
+	if v.conn != nil {
+		v.conn.Close()
+	}
+	v.conn = conn
+	v.connected = true
+	v.multiplexed = false
+	v.order = nil
+	v.mu.Unlock()
+	go v.readLoop(conn)
 
-		log.Printf("sdk-daemon connected via vsock")
+	if v.OnConnect != nil {
+		v.OnConnect()
 	}
 }
 
@@ -134,62 +205,179 @@ func (v *VsockListener) IsConnected() bool {
 	return v.connected
 }
 
-// SendCommand sends a length-prefixed JSON command to the sdk-daemon.
-func (v *VsockListener) SendCommand(cmd interface{}) (json.RawMessage, error) {
-	v.mu.RLock()
+// SendCommand sends a command to the sdk-daemon and waits for its response,
+// until ctx is done. It returns the response's result.
+func (v *VsockListener) SendCommand(ctx context.Context, cmd map[string]interface{}) (json.RawMessage, error) {
+	v.mu.Lock()
 	conn := v.conn
-	v.mu.RUnlock()
-
 	if conn == nil {
-		return nil, fmt.Errorf("sdk-daemon not connected")
+		v.mu.Unlock()
+		return nil, fmt.Errorf("%w: sdk-daemon not connected", process.ErrBackendUnavailable)
 	}
+	v.nextID++
+	id := v.nextID
+	ch := make(chan GuestResponse, 1)
+	v.pending[id] = ch
+	v.mu.Unlock()
 
-	data, err := json.Marshal(cmd)
+	// The caller's map is left untouched.
+	frame := make(map[string]interface{}, len(cmd)+1)
+	for k, val := range cmd {
+		frame[k] = val
+	}
+	frame["requestId"] = id
+	data, err := json.Marshal(frame)
 	if err != nil {
+		v.forget(id)
 		return nil, fmt.Errorf("marshaling command: %w", err)
 	}
 
-	// Write length-prefixed message
-	lenBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenBuf, uint32(len(data)))
-	if _, err := conn.Write(lenBuf); err != nil {
-		v.markDisconnected()
-		return nil, fmt.Errorf("writing to sdk-daemon: %w", err)
+	v.writeMu.Lock()
+	v.mu.Lock()
+	if !v.multiplexed {
+		v.order = append(v.order, id)
 	}
-	if _, err := conn.Write(data); err != nil {
-		v.markDisconnected()
-		return nil, fmt.Errorf("writing to sdk-daemon: %w", err)
+	v.mu.Unlock()
+	err = pipe.WriteMessage(conn, data)
+	v.writeMu.Unlock()
+	if err != nil {
+		v.forget(id)
+		v.disconnect(conn, err)
+		return nil, fmt.Errorf("%w: writing to sdk-daemon: %v", process.ErrBackendUnavailable, err)
 	}
 
-	// Read response
-	respLen := make([]byte, 4)
-	if _, err := io.ReadFull(conn, respLen); err != nil {
-		v.markDisconnected()
-		return nil, fmt.Errorf("reading from sdk-daemon: %w", err)
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("%w: sdk-daemon disconnected", process.ErrBackendUnavailable)
+		}
+		if !resp.Success {
+			return nil, pipe.CodeError(resp.Code, resp.Error)
+		}
+		return resp.Result, nil
+	case <-ctx.Done():
+		v.forget(id)
+		return nil, fmt.Errorf("sdk-daemon %v: %w", cmd["method"], ctx.Err())
 	}
+}
 
-	length := binary.BigEndian.Uint32(respLen)
-	if length > 10*1024*1024 {
-		return nil, fmt.Errorf("response too large: %d bytes", length)
+// readLoop reads frames from one connection until it fails, delivering
+// responses to their callers and everything else to OnEvent.
+func (v *VsockListener) readLoop(conn net.Conn) {
+	for {
+		data, err := pipe.ReadMessage(conn)
+		if err != nil {
+			v.disconnect(conn, err)
+			return
+		}
+
+		var resp GuestResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			log.Printf("Ignoring malformed frame from sdk-daemon: %v", err)
+			continue
+		}
+		if resp.RequestID == 0 {
+			v.routeUnnumbered(data)
+			continue
+		}
+
+		v.mu.Lock()
+		ch, ok := v.pending[resp.RequestID]
+		delete(v.pending, resp.RequestID)
+		v.dropOrder(resp.RequestID)
+		v.mu.Unlock()
+		if ok {
+			ch <- resp
+		} else if v.debug {
+			log.Printf("Dropping sdk-daemon response to unknown or cancelled request %d", resp.RequestID)
+		}
 	}
+}
 
-	resp := make([]byte, length)
-	if _, err := io.ReadFull(conn, resp); err != nil {
-		v.markDisconnected()
-		return nil, fmt.Errorf("reading response: %w", err)
+// routeUnnumbered handles a frame without a requestId: a GuestHello, an
+// event from a multiplexed guest, or a legacy guest's response to the
+// oldest unanswered command.
+func (v *VsockListener) routeUnnumbered(data []byte) {
+	var frame unnumberedFrame
+	json.Unmarshal(data, &frame)
+
+	v.mu.Lock()
+	if frame.Type == "hello" && !v.multiplexed {
+		v.multiplexed = frame.Protocol >= GuestProtocolMultiplexed
+		v.order = nil
+		v.mu.Unlock()
+		log.Printf("sdk-daemon speaks guest protocol %d", frame.Protocol)
+		return
+	}
+	if v.multiplexed || len(v.order) == 0 {
+		v.mu.Unlock()
+		if v.OnEvent != nil {
+			v.OnEvent(json.RawMessage(data))
+		}
+		return
+	}
+	// A command that timed out keeps its place in order, so its late
+	// response is dropped here instead of answering the next one.
+	id := v.order[0]
+	v.order = v.order[1:]
+	ch, ok := v.pending[id]
+	delete(v.pending, id)
+	v.mu.Unlock()
+	if !ok {
+		if v.debug {
+			log.Printf("Dropping sdk-daemon response to cancelled request %d", id)
+		}
+		return
 	}
 
-	return json.RawMessage(resp), nil
+	resp := GuestResponse{RequestID: id, Success: true, Result: json.RawMessage(data)}
+	if frame.Success != nil && !*frame.Success {
+		resp = GuestResponse{RequestID: id, Error: frame.Error, Code: frame.Code}
+		if resp.Error == "" {
+			resp.Error = "sdk-daemon reported a failure"
+		}
+	}
+	ch <- resp
 }
 
-func (v *VsockListener) markDisconnected() {
+// dropOrder removes a request that was answered by requestId from order.
+// v.mu must be held.
+func (v *VsockListener) dropOrder(id uint64) {
+	for i, queued := range v.order {
+		if queued == id {
+			v.order = append(v.order[:i], v.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// forget stops waiting for a response; a late one is dropped.
+func (v *VsockListener) forget(id uint64) {
 	v.mu.Lock()
+	delete(v.pending, id)
+	v.mu.Unlock()
+}
+
+// disconnect drops conn if it is still the current connection and fails
+// every call waiting on it.
+func (v *VsockListener) disconnect(conn net.Conn, cause error) {
+	conn.Close()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.conn != conn {
+		return
+	}
+	if !v.closed && cause != nil {
+		log.Printf("sdk-daemon connection lost: %v", cause)
+	}
+	v.conn = nil
 	v.connected = false
-	if v.conn != nil {
-		v.conn.Close()
-		v.conn = nil
+	v.order = nil
+	for id, ch := range v.pending {
+		close(ch)
+		delete(v.pending, id)
 	}
-	v.mu.Unlock()
 }
 
 // Close closes the vsock listener and any active connection.
@@ -202,8 +390,100 @@ func (v *VsockListener) Close() {
 		v.conn = nil
 		v.connected = false
 	}
+	for id, ch := range v.pending {
+		close(ch)
+		delete(v.pending, id)
+	}
 	if v.fd >= 0 {
+		// Closing alone doesn't wake a blocked accept.
+		syscall.Shutdown(v.fd, syscall.SHUT_RDWR)
 		syscall.Close(v.fd)
 		v.fd = -1
 	}
 }
+
+// The syscall package can't decode vsock addresses: syscall.Accept closes
+// the new socket when it fails to, and net.FileConn rejects vsock sockets.
+// accept4 and connect are called directly instead, and vsockConn wraps the
+// socket as a net.Conn.
+
+// vsockAddr is a vsock address.
+type vsockAddr struct {
+	cid  uint32
+	port uint32
+}
+
+func (a vsockAddr) Network() string { return "vsock" }
+
+func (a vsockAddr) String() string { return fmt.Sprintf("%d:%d", a.cid, a.port) }
+
+// vsockConn is a connected vsock socket. The fd is non-blocking, so the
+// *os.File goes through the runtime poller and supports deadlines.
+type vsockConn struct {
+	*os.File
+	local  vsockAddr
+	remote vsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr { return c.local }
+
+func (c *vsockConn) RemoteAddr() net.Addr { return c.remote }
+
+// newVsockConn wraps a connected socket.
+func newVsockConn(fd int, remote vsockAddr) (net.Conn, error) {
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	var local sockaddrVM
+	size := uint32(unsafe.Sizeof(local))
+	syscall.RawSyscall(syscall.SYS_GETSOCKNAME, uintptr(fd), uintptr(unsafe.Pointer(&local)), uintptr(unsafe.Pointer(&size)))
+	return &vsockConn{
+		File:   os.NewFile(uintptr(fd), "vsock"),
+		local:  vsockAddr{cid: local.CID, port: local.Port},
+		remote: remote,
+	}, nil
+}
+
+// acceptVsock waits for a connection on a listening vsock socket.
+func acceptVsock(fd int) (net.Conn, error) {
+	var addr sockaddrVM
+	size := uint32(unsafe.Sizeof(addr))
+	nfd, _, errno := syscall.Syscall6(
+		syscall.SYS_ACCEPT4,
+		uintptr(fd),
+		uintptr(unsafe.Pointer(&addr)),
+		uintptr(unsafe.Pointer(&size)),
+		syscall.SOCK_CLOEXEC,
+		0, 0,
+	)
+	if errno != 0 {
+		return nil, errno
+	}
+	return newVsockConn(int(nfd), vsockAddr{cid: addr.CID, port: addr.Port})
+}
+
+// DialVsock connects to a vsock port; a guest reaches the host's
+// VsockListener at HostCID, SDKDaemonPort.
+func DialVsock(cid uint32, port uint32) (net.Conn, error) {
+	fd, err := syscall.Socket(afVsock, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("creating vsock socket: %w", err)
+	}
+	addr := sockaddrVM{
+		Family: afVsock,
+		Port:   port,
+		CID:    cid,
+	}
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_CONNECT,
+		uintptr(fd),
+		uintptr(unsafe.Pointer(&addr)),
+		unsafe.Sizeof(addr),
+	)
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("connecting to vsock %d:%d: %w", cid, port, errno)
+	}
+	return newVsockConn(fd, vsockAddr{cid: cid, port: port})
+}
@@ -0,0 +1,151 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/patrickjaja/claude-cowork-service/pipe"
+	"github.com/patrickjaja/claude-cowork-service/process"
+)
+
+// attachPipe connects a listener to the guest end of a net.Pipe.
+func attachPipe(t *testing.T, onEvent func(json.RawMessage)) (*VsockListener, net.Conn) {
+	t.Helper()
+	host, guest := net.Pipe()
+	v := NewVsockListener(vsockPort, false)
+	v.OnEvent = onEvent
+	v.Attach(host)
+	t.Cleanup(func() {
+		v.Close()
+		guest.Close()
+	})
+	return v, guest
+}
+
+// readCommand reads one command frame on the guest side.
+func readCommand(t *testing.T, guest net.Conn) map[string]interface{} {
+	t.Helper()
+	data, err := pipe.ReadMessage(guest)
+	if err != nil {
+		t.Fatalf("reading command: %v", err)
+	}
+	var cmd map[string]interface{}
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		t.Fatalf("decoding command %s: %v", data, err)
+	}
+	return cmd
+}
+
+// writeFrame writes one frame from the guest side.
+func writeFrame(t *testing.T, guest net.Conn, v interface{}) {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.WriteMessage(guest, data); err != nil {
+		t.Fatalf("writing frame: %v", err)
+	}
+}
+
+type callResult struct {
+	result json.RawMessage
+	err    error
+}
+
+// send runs SendCommand in the background.
+func send(v *VsockListener, ctx context.Context, method string) <-chan callResult {
+	done := make(chan callResult, 1)
+	go func() {
+		result, err := v.SendCommand(ctx, map[string]interface{}{"method": method})
+		done <- callResult{result, err}
+	}()
+	return done
+}
+
+func TestVsockMultiplexed(t *testing.T) {
+	events := make(chan string, 1)
+	v, guest := attachPipe(t, func(frame json.RawMessage) { events <- string(frame) })
+	writeFrame(t, guest, GuestHello{Type: "hello", Protocol: GuestProtocolMultiplexed})
+
+	ctx := context.Background()
+	first := send(v, ctx, "first")
+	cmd1 := readCommand(t, guest)
+	second := send(v, ctx, "second")
+	cmd2 := readCommand(t, guest)
+
+	// Answer out of order, with an event in between.
+	writeFrame(t, guest, GuestResponse{RequestID: uint64(cmd2["requestId"].(float64)), Success: true, Result: json.RawMessage(`"two"`)})
+	writeFrame(t, guest, map[string]string{"type": "stdout", "id": "p1", "data": "hi"})
+	writeFrame(t, guest, GuestResponse{RequestID: uint64(cmd1["requestId"].(float64)), Code: pipe.CodeProcessNotFound, Error: "process not found: p1"})
+
+	if r := <-second; r.err != nil || string(r.result) != `"two"` {
+		t.Errorf("second = %s, %v", r.result, r.err)
+	}
+	if r := <-first; !errors.Is(r.err, process.ErrProcessNotFound) {
+		t.Errorf("first error = %v, want ErrProcessNotFound", r.err)
+	}
+	if e := <-events; e != `{"data":"hi","id":"p1","type":"stdout"}` {
+		t.Errorf("event = %s", e)
+	}
+}
+
+func TestVsockLegacyGuest(t *testing.T) {
+	v, guest := attachPipe(t, func(frame json.RawMessage) { t.Errorf("unexpected event %s", frame) })
+
+	ctx := context.Background()
+	first := send(v, ctx, "first")
+	if cmd := readCommand(t, guest); cmd["method"] != "first" {
+		t.Fatalf("got %v", cmd)
+	}
+	second := send(v, ctx, "second")
+	if cmd := readCommand(t, guest); cmd["method"] != "second" {
+		t.Fatalf("got %v", cmd)
+	}
+
+	// Responses without a requestId answer commands in the order sent.
+	writeFrame(t, guest, map[string]string{"processId": "p1"})
+	writeFrame(t, guest, map[string]interface{}{"success": false, "error": "boom"})
+
+	if r := <-first; r.err != nil || string(r.result) != `{"processId":"p1"}` {
+		t.Errorf("first = %s, %v", r.result, r.err)
+	}
+	if r := <-second; r.err == nil || r.err.Error() != "boom" {
+		t.Errorf("second error = %v, want boom", r.err)
+	}
+}
+
+func TestVsockLegacyGuestLateResponse(t *testing.T) {
+	v, guest := attachPipe(t, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	late := send(v, ctx, "slow")
+	readCommand(t, guest)
+	if r := <-late; !errors.Is(r.err, context.DeadlineExceeded) {
+		t.Fatalf("slow error = %v, want deadline exceeded", r.err)
+	}
+
+	next := send(v, context.Background(), "next")
+	readCommand(t, guest)
+	// The late answer to "slow" must not be taken for the answer to "next".
+	writeFrame(t, guest, map[string]string{"answer": "slow"})
+	writeFrame(t, guest, map[string]string{"answer": "next"})
+	if r := <-next; r.err != nil || string(r.result) != `{"answer":"next"}` {
+		t.Errorf("next = %s, %v", r.result, r.err)
+	}
+}
+
+func TestVsockDisconnectFailsPending(t *testing.T) {
+	v, guest := attachPipe(t, nil)
+	call := send(v, context.Background(), "spawn")
+	readCommand(t, guest)
+	guest.Close()
+	if r := <-call; !errors.Is(r.err, process.ErrBackendUnavailable) {
+		t.Errorf("error = %v, want ErrBackendUnavailable", r.err)
+	}
+}